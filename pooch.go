@@ -13,9 +13,12 @@ import (
 	. "github.com/aarzilli/pooch/pooch"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 )
 
 //import _ "http/pprof"
@@ -35,12 +38,40 @@ var commands map[string](func(args []string)) = map[string](func(args []string))
 	"rentag":     CmdRenTag,
 	"errlog":     CmdErrorLog,
 	"ontocheck":  CmdOntoCheck,
+	"history":    CmdHistory,
+	"trash":      CmdTrash,
+	"restore":    CmdRestore,
+	"revert":     CmdRevert,
+
+	"attach":      CmdAttach,
+	"attachments": CmdAttachments,
+	"detach":      CmdDetach,
+	"link":        CmdLink,
+	"unlink":      CmdUnlink,
+	"links":       CmdLinks,
+	"coltype":     CmdColumnType,
+	"coltypes":    CmdColumnTypes,
+	"start":       CmdStart,
+	"stop":        CmdStop,
+	"timereport":  CmdTimeReport,
+	"export":      CmdExport,
+	"import":      CmdImport,
+	"ics":         CmdIcs,
+	"importics":   CmdImportIcs,
+	"todotxt":     CmdTodoTxt,
+	"export-md":   CmdExportMd,
+	"export-org":  CmdExportOrg,
+	"import-org":  CmdImportOrg,
+	"csvimport":   CmdCsvImport,
+	"merge":       CmdMerge,
 
 	"multiserve":      CmdMultiServe,
 	"multiserveplain": CmdMultiServePlain,
+	"daemon":          CmdDaemon,
 
-	"setopt": CmdSetOption,
-	"getopt": CmdGetOption,
+	"setopt":        CmdSetOption,
+	"getopt":        CmdGetOption,
+	"setpassphrase": CmdSetPassphrase,
 
 	"run": CmdRun,
 }
@@ -61,10 +92,37 @@ var help_commands map[string](func()) = map[string](func()){
 	"errlog":          HelpErrorLog,
 	"compat":          CompatHelp,
 	"ontocheck":       HelpOntoCheck,
+	"history":         HelpHistory,
+	"trash":           HelpTrash,
+	"restore":         HelpRestore,
+	"revert":          HelpRevert,
+	"attach":          HelpAttach,
+	"attachments":     HelpAttachments,
+	"detach":          HelpDetach,
+	"link":            HelpLink,
+	"unlink":          HelpUnlink,
+	"links":           HelpLinks,
+	"coltype":         HelpColumnType,
+	"coltypes":        HelpColumnTypes,
+	"start":           HelpStart,
+	"stop":            HelpStop,
+	"timereport":      HelpTimeReport,
+	"export":          HelpExport,
+	"import":          HelpImport,
+	"ics":             HelpIcs,
+	"importics":       HelpImportIcs,
+	"todotxt":         HelpTodoTxt,
+	"export-md":       HelpExportMd,
+	"export-org":      HelpExportOrg,
+	"import-org":      HelpImportOrg,
+	"csvimport":       HelpCsvImport,
+	"merge":           HelpMerge,
 	"multiserve":      HelpMultiServe,
 	"multiserveplain": HelpMultiServePlain,
+	"daemon":          HelpDaemon,
 	"setopt":          HelpSetOption,
 	"getopt":          HelpGetOption,
+	"setpassphrase":   HelpSetPassphrase,
 	"run":             HelpRun,
 }
 
@@ -94,7 +152,8 @@ func CmdCreate(args []string) {
 
 	CheckCondition(found, "Database already exists at: %s\n", filename)
 
-	tasklist := OpenOrCreate(filename)
+	tasklist, err := OpenOrCreate(filename)
+	Must(err)
 	tasklist.Close()
 }
 
@@ -103,41 +162,83 @@ func HelpCreate() {
 	fmt.Fprintf(os.Stderr, "\tCreates a new empty db named <db>\n")
 }
 
+// Reads a passphrase from the terminal, without echoing it
+func readPassphrase(in *bufio.Reader, prompt string) string {
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	noecho := exec.Command("stty", "-echo")
+	noecho.Stdin = os.Stdin
+	if noecho.Run() == nil {
+		defer func() {
+			echo := exec.Command("stty", "echo")
+			echo.Stdin = os.Stdin
+			echo.Run()
+			fmt.Fprintf(os.Stderr, "\n")
+		}()
+	}
+	line, err := in.ReadString('\n')
+	CheckCondition(err != nil && line == "", "Could not read passphrase: %v\n", err)
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Reads the passphrase of tl from POOCHPASSPHRASE or the terminal and unlocks tl with it
+func unlockTasklist(tl *Tasklist) {
+	passphrase := os.Getenv("POOCHPASSPHRASE")
+	if passphrase == "" {
+		passphrase = readPassphrase(bufio.NewReader(os.Stdin), "Passphrase")
+	}
+
+	key, err := tl.SecretKey(passphrase)
+	Must(err)
+	tl.Unlock(key)
+}
+
 func CmdQuickAdd(args []string) {
-	CheckArgsOpenDb(args, map[string]bool{}, 0, 1000, "add", func(tl *Tasklist, args []string, flags map[string]bool) {
+	CheckArgsOpenDb(args, map[string]bool{"-unlock": true}, 0, 1000, "add", func(tl *Tasklist, args []string, flags map[string]bool) {
+		if flags["-unlock"] {
+			unlockTasklist(tl)
+		}
 		var entry *Entry
 		if (len(args) == 1) && (args[0] == "-") {
 			entry = tl.ExtendedAddParse()
 		} else {
 			entry = tl.ParseNew(strings.Join(args[0:], " "), "")
 		}
-		tl.Add(entry)
+		Must(tl.Add(entry))
 		Logf(INFO, "Added entry: %s\n", entry.Id())
 	})
 }
 
 func HelpQuickAdd() {
-	fmt.Fprintf(os.Stderr, "Usage: add <quickadd string>\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: add [--unlock] <quickadd string>\n\n")
 	fmt.Fprintf(os.Stderr, "\tInterprets the quickadd string and adds it to the db. Using a single - as the quickadd string makes the program read the quickadd string from stdin, in a special format that allows easier setting of columns\n")
+	fmt.Fprintf(os.Stderr, "\tTimed entries repeat according to the rule in their recur column, for example: daily, weekly, every 3 days, monthly on day 15, every 2nd tuesday, last weekday of month, every 2 weeks on mon,thu, weekly until 2014-12-31, monthly for 12 times, 7 days after completion. The shorthand #<date>+<daily|weekly|biweekly|monthly|yearly|N> sets both the date and the recur column\n")
+	fmt.Fprintf(os.Stderr, "\tThe remind column of an entry with a date lists when reminders should be sent, separated by commas, for example: 30m before, 2 hours before, 1 day before, at 09:00. Reminders are sent by serve, multiserve and daemon through the configured notifiers (see setopt)\n")
+	fmt.Fprintf(os.Stderr, "\tEntries with the tag named by the secrettag option can only be added with --unlock, which asks for the passphrase used to encrypt their text. When reading the quickadd string from stdin the passphrase must be passed in POOCHPASSPHRASE\n")
 }
 
 func CmdQuickUpdate(args []string) {
-	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "update", func(tl *Tasklist, args []string, flags map[string]bool) {
+	CheckArgsOpenDb(args, map[string]bool{"-unlock": true}, 1, 1000, "update", func(tl *Tasklist, args []string, flags map[string]bool) {
 		CheckId(tl, args[0], "update")
+		if flags["-unlock"] {
+			unlockTasklist(tl)
+		}
 
 		entry := tl.ParseNew(strings.Join(args[1:], " "), "")
 
 		entry.SetId(args[0])
-		tl.Update(entry, false)
+		Must(tl.Update(entry, false))
 	})
 }
 
 func HelpQuickUpdate() {
-	fmt.Fprintf(os.Stderr, "Usage: update <id> <quickadd string>\n\n")
-	fmt.Fprintf(os.Stderr, "\tInterprets the quickadd string and updates selected entry in the db")
+	fmt.Fprintf(os.Stderr, "Usage: update [--unlock] <id> <quickadd string>\n\n")
+	fmt.Fprintf(os.Stderr, "\tInterprets the quickadd string and updates selected entry in the db\n")
+	fmt.Fprintf(os.Stderr, "\tThe tag named by the secrettag option can only be added to an entry with text with --unlock, which asks for the passphrase used to encrypt the text\n")
 }
 
 func CmdSearch(args []string) {
+	in, args := extractArgValue(args, "in")
+
 	CheckArgsOpenDb(args, map[string]bool{"t": true, "d": true, "j": true}, 0, 1000, "search", func(tl *Tasklist, args []string, flags map[string]bool) {
 		var input string
 		if (len(args) == 1) && (args[0] == "-") {
@@ -152,21 +253,35 @@ func CmdSearch(args []string) {
 		tsv := flags["t"]
 		js := flags["j"]
 
-		theselect, command, _, _, _, showCols, _, sortCols, perr := tl.ParseSearch(input, nil)
+		query, filenames, err := tl.SearchScope(input, in)
+		Must(err)
+
+		theselect, command, _, _, _, showCols, options, sortCols, perr := tl.ParseSearch(query, nil)
 		Must(perr)
 
-		Logf(DEBUG, "Search statement\n%s\n", theselect)
+		var entries []*Entry
+		if filenames != nil {
+			entries, showCols, err = tl.SearchTasklists(query, filenames)
+			Must(err)
+		} else {
+			Logf(DEBUG, "Search statement\n%s\n", theselect)
 
-		entries, serr := tl.Retrieve(theselect, command, false, sortCols)
-		Must(serr)
+			entries, err = tl.Retrieve(theselect, command, false, sortCols)
+			Must(err)
+		}
 
 		catordering := tl.CategoryDepth()
+		aggregates := AggregateSpecFromOptions(options)
 
 		switch {
 		case tsv:
 			CmdListExTsv(entries, showCols, timezone)
 		case js:
 			CmdListExJS(entries, timezone)
+		case aggregates != nil:
+			a, err := tl.Aggregate(entries, aggregates)
+			Must(err)
+			CmdListExAggregates(entries, a, showCols, timezone, catordering)
 		default:
 			CmdListEx(entries, showCols, timezone, catordering)
 		}
@@ -174,8 +289,9 @@ func CmdSearch(args []string) {
 }
 
 func HelpSearch() {
-	fmt.Fprintf(os.Stderr, "Usage: search [-tj] <search string>\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: search [-tj] [--in <tasklists>] <search string>\n\n")
 	fmt.Fprintf(os.Stderr, "\tReturns a list of matching entries\n")
+	fmt.Fprintf(os.Stderr, "\t--in\tSearches the tasklists in POOCHPATH named in a comma separated list (or all of them with all) instead of the current one, the tasklist column shows where each entry comes from. The search option #:in=<tasklists> does the same, and can be used in saved searches\n")
 	fmt.Fprintf(os.Stderr, "\t-t\tWrites output in tsv format\n")
 	fmt.Fprintf(os.Stderr, "\t-j\tPrints JSON\n")
 	fmt.Fprintf(os.Stderr, `Using a single - as the search string will make the program read the search string from standard input.
@@ -191,9 +307,17 @@ QUERY FORMAT
 	fmt.Fprintf(w, "#[time_expr]	Only include entries that match the given time\n")
 	fmt.Fprintf(w, "#[colname]?	Only include entries that have the given column name and show it in output\n")
 	fmt.Fprintf(w, "#[colname]=[value]	Only include entries that have the given column set to value\n")
-	fmt.Fprintf(w, "#[colname][op][value]	Like colname=value but compare the value instead, available operators are: < > = <= >= !=")
+	fmt.Fprintf(w, "#[colname][op][value]	Like colname=value but compare the value instead, available operators are: < > = <= >= !=, columns with a declared type (see coltype) are compared as numbers, dates, durations or in the order of the enum")
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "#:created[op][value]	Compares the creation time of entries with value, same operators as #[colname][op][value]\n")
+	fmt.Fprintf(w, "#:modified[op][value]	Compares the last modification time of entries with value\n")
 	fmt.Fprintf(w, "\n")
-	fmt.Fprintf(w, "#:sort=[column]	Sorts output by [column]\n")
+	fmt.Fprintf(w, "#:sort=[column]	Sorts output by [column], use created or modified to sort by creation or modification time\n")
+	fmt.Fprintf(w, "#:sort=rank	Sorts output by relevance to the text of the search\n")
+	fmt.Fprintf(w, "#:group=[column]	Groups output by the value of [column], showing the aggregates of each group\n")
+	fmt.Fprintf(w, "#:sum=[column]	Shows the total of [column], can be repeated\n")
+	fmt.Fprintf(w, "#:avg=[column]	Shows the average of [column], can be repeated\n")
+	fmt.Fprintf(w, "#:count	Shows the number of entries\n")
 	fmt.Fprintf(w, "#:-when	Excludes entries with a trigger time\n")
 	fmt.Fprintf(w, "#:sub	Includes subcategories\n")
 	fmt.Fprintf(w, "#:cal	Defaults to calendar view\n")
@@ -203,16 +327,20 @@ QUERY FORMAT
 	fmt.Fprintf(w, "#:hideprioritycol	Hides the priority column\n")
 	fmt.Fprintf(w, "#:hidetimecol	Hides time column\n")
 	fmt.Fprintf(w, "#:w/done	Include entries with priority set to 'done'\n")
+	fmt.Fprintf(w, "#:w/trash	Include removed entries that are still in the trash\n")
+	fmt.Fprintf(w, "#:has-attachment	Only entries with attachments\n")
+	fmt.Fprintf(w, "#:blocked	Only entries that depend on entries that aren't done (#:-blocked excludes them)\n")
 	fmt.Fprintf(w, "\n")
 	fmt.Fprintf(w, "#%%[saved_search]	Recalls [saved_search]\n")
 	w.Flush()
 
 	fmt.Fprintf(os.Stderr, "Anywhere '#' is used '@' can also be used\n")
+	fmt.Fprintf(os.Stderr, "\nThe rest of the search string is matched against title and text of entries, words are matched regardless of their inflection, words ending with * match any word with that prefix, text between double quotes is matched as a phrase and AND, OR, NOT can be used as operators\n")
 }
 
 func CmdSaveSearch(args []string) {
 	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "savesearch", func(tl *Tasklist, args []string, flags map[string]bool) {
-		tl.SaveSearch(args[0], strings.Join(args[1:], " "))
+		Must(tl.SaveSearch(args[0], strings.Join(args[1:], " ")))
 	})
 }
 
@@ -224,13 +352,44 @@ func HelpSaveSearch() {
 func CmdRemove(args []string) {
 	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "remove", func(tl *Tasklist, args []string, flags map[string]bool) {
 		CheckId(tl, args[0], "remove")
-		tl.Remove(args[0])
+		Must(tl.Remove(args[0]))
 	})
 }
 
 func HelpRemove() {
 	fmt.Fprintf(os.Stderr, "Usage: remove <id>\n\n")
-	fmt.Fprintf(os.Stderr, "\tRemoves specified entry from <db>\n")
+	fmt.Fprintf(os.Stderr, "\tMoves specified entry, and its subitems, to the trash\n")
+}
+
+func CmdTrash(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 0, "trash", func(tl *Tasklist, args []string, flags map[string]bool) {
+		trash, err := tl.GetTrash()
+		Must(err)
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, te := range trash {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", te.Entry.Id(), te.TimeString(), te.Entry.Title())
+		}
+		w.Flush()
+	})
+}
+
+func HelpTrash() {
+	fmt.Fprintf(os.Stderr, "Usage: trash\n\n")
+	fmt.Fprintf(os.Stderr, "\tLists removed entries, most recently removed first. Entries are purged from the trash after the number of days specified by the trashretention option (0 keeps them forever)\n")
+}
+
+func CmdRestore(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "restore", func(tl *Tasklist, args []string, flags map[string]bool) {
+		trashed, err := tl.IsTrashed(args[0])
+		Must(err)
+		CheckCondition(!trashed, "Cannot restore, id isn't in the trash: %s\n", args[0])
+		Must(tl.Restore(args[0]))
+	})
+}
+
+func HelpRestore() {
+	fmt.Fprintf(os.Stderr, "Usage: restore <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tTakes <id> and its subitems out of the trash\n")
 }
 
 func GetSizesForList(v []*Entry, showCols []string) (id_size, title_size, cat_size int, colSizes map[string]int) {
@@ -262,7 +421,7 @@ func GetSizesForList(v []*Entry, showCols []string) (id_size, title_size, cat_si
 
 var LINE_SIZE int = 80
 
-func CmdListExTsv(v []*Entry, showCols []string, timezone int) {
+func CmdListExTsv(v []*Entry, showCols []string, timezone *time.Location) {
 	fmt.Printf("\t\t")
 	for showCol, _ := range showCols {
 		fmt.Printf("\t%s", showCol)
@@ -279,16 +438,51 @@ func CmdListExTsv(v []*Entry, showCols []string, timezone int) {
 	}
 }
 
-func CmdListEx(v []*Entry, showCols []string, timezone int, catordering map[string]int) {
-	id_size, title_size, cat_size, col_sizes := GetSizesForList(v, showCols)
+type listPrinter struct {
+	showCols    []string
+	timezone    *time.Location
+	catordering map[string]int
 
-	var curp Priority = INVALID
+	id_size, title_size, cat_size int
+	col_sizes                     map[string]int
+}
+
+func makeListPrinter(v []*Entry, showCols []string, timezone *time.Location, catordering map[string]int) *listPrinter {
+	lp := &listPrinter{showCols: showCols, timezone: timezone, catordering: catordering}
+	lp.id_size, lp.title_size, lp.cat_size, lp.col_sizes = GetSizesForList(v, showCols)
+	return lp
+}
 
-	fmt.Printf("%s %s %s %s", RepeatString(" ", id_size), RepeatString(" ", title_size), RepeatString(" ", 19), RepeatString(" ", cat_size))
-	for _, colName := range showCols {
-		fmt.Printf(" %s%s", colName, RepeatString(" ", col_sizes[colName]-len(colName)))
+func (lp *listPrinter) header() {
+	fmt.Printf("%s %s %s %s", RepeatString(" ", lp.id_size), RepeatString(" ", lp.title_size), RepeatString(" ", 19), RepeatString(" ", lp.cat_size))
+	for _, colName := range lp.showCols {
+		fmt.Printf(" %s%s", colName, RepeatString(" ", lp.col_sizes[colName]-len(colName)))
 	}
 	fmt.Printf("\n")
+}
+
+func (lp *listPrinter) entry(entry *Entry) {
+	timeString := TimeString(entry.TriggerAt(), entry.Sort(), lp.timezone)
+
+	fmt.Printf("%s%s %s%s %s%s %s%s",
+		entry.Id(), RepeatString(" ", lp.id_size-len(entry.Id())),
+		entry.Title(), RepeatString(" ", lp.title_size-len(entry.Title())),
+		timeString, RepeatString(" ", 19-len(timeString)),
+		entry.CatString(lp.catordering), RepeatString(" ", lp.cat_size-len(entry.CatString(lp.catordering))))
+
+	for _, colName := range lp.showCols {
+		fmt.Printf(" %s%s", entry.Columns()[colName], RepeatString(" ", lp.col_sizes[colName]-len(entry.Columns()[colName])))
+	}
+
+	fmt.Printf("\n")
+}
+
+func CmdListEx(v []*Entry, showCols []string, timezone *time.Location, catordering map[string]int) {
+	lp := makeListPrinter(v, showCols, timezone, catordering)
+
+	var curp Priority = INVALID
+
+	lp.header()
 
 	for _, entry := range v {
 		if entry.Priority() != curp {
@@ -296,23 +490,44 @@ func CmdListEx(v []*Entry, showCols []string, timezone int, catordering map[stri
 			fmt.Printf("\n%s:\n", strings.ToUpper(curp.String()))
 		}
 
-		timeString := TimeString(entry.TriggerAt(), entry.Sort(), timezone)
+		lp.entry(entry)
+	}
+}
+
+// Like CmdListEx but splits entries in the groups of agg, followed by their aggregates
+func CmdListExAggregates(v []*Entry, agg *Aggregates, showCols []string, timezone *time.Location, catordering map[string]int) {
+	if len(agg.Groups) == 0 {
+		CmdListEx(v, showCols, timezone, catordering)
+	} else {
+		lp := makeListPrinter(v, showCols, timezone, catordering)
+		lp.header()
 
-		fmt.Printf("%s%s %s%s %s%s %s%s",
-			entry.Id(), RepeatString(" ", id_size-len(entry.Id())),
-			entry.Title(), RepeatString(" ", title_size-len(entry.Title())),
-			timeString, RepeatString(" ", 19-len(timeString)),
-			entry.CatString(catordering), RepeatString(" ", cat_size-len(entry.CatString(catordering))))
+		entries := map[string]*Entry{}
+		for _, entry := range v {
+			entries[entry.Id()] = entry
+		}
 
-		for _, colName := range showCols {
-			fmt.Printf(" %s%s", entry.Columns()[colName], RepeatString(" ", col_sizes[colName]-len(entry.Columns()[colName])))
+		for _, group := range agg.Groups {
+			if group.Group == "" {
+				fmt.Printf("\nWITHOUT %s:\n", agg.Spec.GroupBy)
+			} else {
+				fmt.Printf("\n%s=%s:\n", agg.Spec.GroupBy, group.Group)
+			}
+			for _, id := range group.Ids {
+				lp.entry(entries[id])
+			}
+			if s := group.String(); s != "" {
+				fmt.Printf("  %s\n", s)
+			}
 		}
+	}
 
-		fmt.Printf("\n")
+	if s := agg.Total.String(); s != "" {
+		fmt.Printf("\nTOTAL: %s\n", s)
 	}
 }
 
-func CmdListExJS(v []*Entry, timezone int) {
+func CmdListExJS(v []*Entry, timezone *time.Location) {
 	for _, entry := range v {
 		json.NewEncoder(os.Stdout).Encode(MarshalEntry(entry, timezone, true))
 	}
@@ -347,6 +562,7 @@ func CmdMultiServe(args []string) {
 func HelpMultiServe() {
 	fmt.Fprintf(os.Stderr, "usage: multiserve <port> <directory> <logfile>\n\n")
 	fmt.Fprintf(os.Stderr, "\tStarts a multi-user http server, information will be stored in <directory>. Writes logs to <logfile>\n\n")
+	fmt.Fprintf(os.Stderr, "\tTasklists that aren't used for 30 minutes are closed, at most 64 tasklists are kept open. These limits can be changed with the POOCHIDLETIMEOUT (for example 10m) and POOCHMAXOPEN environment variables\n\n")
 }
 
 func CmdMultiServePlain(args []string) {
@@ -359,6 +575,33 @@ func HelpMultiServePlain() {
 	fmt.Fprintf(os.Stderr, "\tJust like multiserve, but cookies are stored insecurely (allows using multiserve without an https proxy)\n")
 }
 
+func CmdDaemon(args []string) {
+	nargs, _ := CheckArgs(args, map[string]bool{}, 0, 1000, "daemon")
+
+	filenames := []string{}
+	if len(nargs) == 0 {
+		dbname := os.Getenv("POOCHDB")
+		CheckCondition(dbname == "", "POOCHDB Not Set\n")
+		filenames = append(filenames, dbname)
+	}
+	for _, name := range nargs {
+		filename, found := name, true
+		if _, err := os.Stat(name); err != nil {
+			filename, found = Resolve(name)
+		}
+		CheckCondition(!found, "Couldn't find tasklist: %s\n", name)
+		filenames = append(filenames, filename)
+	}
+
+	StartScheduler(filenames)
+	select {}
+}
+
+func HelpDaemon() {
+	fmt.Fprintf(os.Stderr, "usage: daemon [<db>...]\n\n")
+	fmt.Fprintf(os.Stderr, "\tRuns the timed triggers of the specified tasklists (or the default one) when they are due, without starting the http server. The serve and multiserve commands do the same in the background\n\n")
+}
+
 func CmdTsvUpdate(argv []string) {
 	CheckArgsOpenDb(argv, map[string]bool{}, 0, 0, "tsvup", func(tl *Tasklist, args []string, flags map[string]bool) {
 		in := bufio.NewReader(os.Stdin)
@@ -372,16 +615,17 @@ func CmdTsvUpdate(argv []string) {
 			entry := ParseTsvFormat(line, tl, tl.GetTimezone())
 			if tl.Exists(entry.Id()) {
 				if entry.Priority() == -1000 {
-					tl.Remove(entry.Id())
+					Must(tl.Remove(entry.Id()))
 				} else {
-					entry2 := tl.Get(entry.Id())
+					entry2, err := tl.Get(entry.Id())
+					Must(err)
 					entry.SetPriority(entry2.Priority())
 					//fmt.Printf("UPDATING\t%s\t%s\n", entry.Id(), entry.TriggerAt().Format("2006-01-02"))
-					tl.Update(entry, false)
+					Must(tl.Update(entry, false))
 				}
 			} else {
 				fmt.Printf("ADDING\t%s\t%s\n", entry.Id(), entry.TriggerAt().Format("2006-01-02"))
-				tl.Add(entry)
+				Must(tl.Add(entry))
 			}
 		}
 	})
@@ -403,10 +647,7 @@ func CmdRename(argv []string) {
 			dst_id = argv[1]
 		}
 
-		entry := tl.Get(src_id)
-		tl.Remove(entry.Id())
-		entry.SetId(dst_id)
-		tl.Add(entry)
+		Must(tl.RenameEntry(src_id, dst_id))
 	})
 }
 
@@ -419,7 +660,7 @@ func CmdRenTag(argv []string) {
 	CheckArgsOpenDb(argv, map[string]bool{}, 2, 2, "rentag", func(tl *Tasklist, args []string, flags map[string]bool) {
 		src_tag := argv[0]
 		dst_tag := argv[1]
-		tl.RenameTag(src_tag, dst_tag)
+		Must(tl.RenameTag(src_tag, dst_tag))
 	})
 }
 
@@ -443,18 +684,43 @@ func HelpRenTag() {
 }
 
 func CmdGet(args []string) {
-	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "get", func(tl *Tasklist, args []string, flags map[string]bool) {
+	in, args := extractArgValue(args, "in")
+
+	CheckArgsOpenDb(args, map[string]bool{"-unlock": true}, 1, 1, "get", func(tl *Tasklist, args []string, flags map[string]bool) {
 		id := args[0]
+
+		if in != "" {
+			var unlock func(*Tasklist)
+			if flags["-unlock"] {
+				unlock = unlockTasklist
+			}
+			entries, err := tl.GetTasklists(id, ResolveTasklists(in), unlock)
+			Must(err)
+			CheckCondition(len(entries) == 0, "Cannot get, id doesn't exist in %s: %s\n", in, id)
+			for _, entry := range entries {
+				fmt.Printf("%s: %s\n", TASKLIST_COLUMN, entry.Column(TASKLIST_COLUMN))
+				entry.RemoveColumn(TASKLIST_COLUMN)
+				entry.Print()
+			}
+			return
+		}
+
 		CheckId(tl, id, "get")
 
-		entry := tl.Get(id)
+		if flags["-unlock"] {
+			unlockTasklist(tl)
+		}
+
+		entry, err := tl.Get(id)
+		Must(err)
 		entry.Print()
 	})
 }
 
 func HelpGet() {
-	fmt.Fprintf(os.Stderr, "Usage: get <id>\n\n")
-	fmt.Fprintf(os.Stderr, "\tPrints the entry associated with <id> inside <db>\n")
+	fmt.Fprintf(os.Stderr, "Usage: get [--unlock] [--in <tasklists>] <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tPrints the entry associated with <id> inside <db>, or inside each of the tasklists in a comma separated list (all for every tasklist in POOCHPATH)\n")
+	fmt.Fprintf(os.Stderr, "\tWith --unlock asks for the passphrase (or reads it from POOCHPASSPHRASE) and prints the text of encrypted entries decrypted (see the secrettag option of setopt)\n")
 }
 
 func CmdSetOption(args []string) {
@@ -476,9 +742,9 @@ func CmdSetOption(args []string) {
 		}
 
 		if private {
-			tl.SetPrivateSetting(name, value)
+			Must(tl.SetPrivateSetting(name, value))
 		} else {
-			tl.SetSetting(name, value)
+			Must(tl.SetSetting(name, value))
 		}
 	})
 }
@@ -487,6 +753,30 @@ func HelpSetOption() {
 	fmt.Fprintf(os.Stderr, "Usage: setopt <name> <value>\n\n")
 	fmt.Fprintf(os.Stderr, "\tSets <name> option to <value>. Prefix <name> with 'private:' if you want to change a private option\n")
 	fmt.Fprintf(os.Stderr, "If <value> is '-' will read from standard input.\n")
+	fmt.Fprintf(os.Stderr, "The timezone option accepts a time zone name (e.g. Europe/Rome) or an offset from UTC in hours.\n")
+	fmt.Fprintf(os.Stderr, "Reminders are delivered through the notifiers configured with these private options:\n")
+	fmt.Fprintf(os.Stderr, "\tnotify_command\t\tshell command to run, the reminder is passed in the POOCH_TASKLIST, POOCH_ID, POOCH_TITLE, POOCH_TEXT, POOCH_WHEN and POOCH_REMIND_AT environment variables\n")
+	fmt.Fprintf(os.Stderr, "\tnotify_smtp_server\thost:port of an SMTP relay, notify_smtp_from and notify_smtp_to (comma separated) must also be set, notify_smtp_user and notify_smtp_password are optional\n")
+	fmt.Fprintf(os.Stderr, "\tnotify_url\t\tURL where reminders are POSTed as JSON\n")
+	fmt.Fprintf(os.Stderr, "The api_token private option is the token calendar clients must pass to /cal.ics (see ics).\n")
+	fmt.Fprintf(os.Stderr, "The text of entries with the tag named by the secrettag option (e.g. secret) is encrypted with a key derived from a passphrase, which is never stored, and is not indexed for search. The passphrase is set once with setpassphrase (or /unlock in the web interface). Use get --unlock, add --unlock and update --unlock from the command line, or /unlock in the web interface.\n")
+}
+
+func CmdSetPassphrase(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 0, "setpassphrase", func(tl *Tasklist, args []string, flags map[string]bool) {
+		passphrase := os.Getenv("POOCHPASSPHRASE")
+		if passphrase == "" {
+			in := bufio.NewReader(os.Stdin)
+			passphrase = readPassphrase(in, "New passphrase")
+			CheckCondition(readPassphrase(in, "Confirm passphrase") != passphrase, "The passphrases don't match\n")
+		}
+		Must(tl.SetPassphrase(passphrase))
+	})
+}
+
+func HelpSetPassphrase() {
+	fmt.Fprintf(os.Stderr, "Usage: setpassphrase\n\n")
+	fmt.Fprintf(os.Stderr, "\tAsks twice for the passphrase (or reads it from POOCHPASSPHRASE) used to encrypt the text of the entries with the tag named by the secrettag option (see setopt). A tasklist has a single passphrase, it can't be changed once set\n")
 }
 
 func CmdGetOption(args []string) {
@@ -517,7 +807,8 @@ func CmdRun(args []string) {
 	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "run", func(tl *Tasklist, args []string, flags map[string]bool) {
 		fname := args[0]
 
-		fentry := tl.Get(fname)
+		fentry, err := tl.Get(fname)
+		Must(err)
 		tl.DoRunString(fentry.Text(), args[1:len(args)])
 
 		if tl.ShowReturnValueRequest() {
@@ -543,7 +834,477 @@ func CmdOntoCheck(args []string) {
 
 func HelpOntoCheck() {
 	fmt.Fprintf(os.Stderr, "Usage: ontocheck\n\n")
-	fmt.Fprintf(os.Stderr, "\tCheck that category hierarchy and category usages match\n")
+	fmt.Fprintf(os.Stderr, "\tCheck that category hierarchy and category usages match and that columns have values of their declared type (see coltype)\n")
+}
+
+func CmdHistory(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "history", func(tl *Tasklist, args []string, flags map[string]bool) {
+		history, err := tl.GetHistory(args[0])
+		Must(err)
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, rev := range history {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", rev.Rev, rev.TimeString(), rev.Action, rev.Title)
+		}
+		w.Flush()
+	})
+}
+
+func HelpHistory() {
+	fmt.Fprintf(os.Stderr, "Usage: history <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tLists the saved revisions of <id>, most recent first. Each revision is the state of the entry before the change described by its action\n")
+}
+
+func CmdRevert(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 2, 2, "revert", func(tl *Tasklist, args []string, flags map[string]bool) {
+		rev, converr := strconv.Atoi(args[1])
+		CheckCondition(converr != nil, "Invalid revision number %s: %s\n", args[1], converr)
+		Must(tl.Revert(args[0], rev))
+	})
+}
+
+func HelpRevert() {
+	fmt.Fprintf(os.Stderr, "Usage: revert <id> <rev>\n\n")
+	fmt.Fprintf(os.Stderr, "\tRestores <id> to revision <rev> (see history), also restores removed entries\n")
+}
+
+func CmdAttach(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 2, 3, "attach", func(tl *Tasklist, args []string, flags map[string]bool) {
+		data, err := ioutil.ReadFile(args[1])
+		CheckCondition(err != nil, "Couldn't read %s: %s\n", args[1], err)
+		name := filepath.Base(args[1])
+		if len(args) > 2 {
+			name = args[2]
+		}
+		Must(tl.Attach(args[0], name, "", data))
+	})
+}
+
+func HelpAttach() {
+	fmt.Fprintf(os.Stderr, "Usage: attach <id> <file> [<name>]\n\n")
+	fmt.Fprintf(os.Stderr, "\tAttaches <file> to <id>, with the name of the file or <name>. An existing attachment with the same name is replaced\n")
+}
+
+func CmdAttachments(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "attachments", func(tl *Tasklist, args []string, flags map[string]bool) {
+		attachments, err := tl.Attachments(args[0])
+		Must(err)
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, a := range attachments {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", a.Name, a.ContentType, a.Size, a.TimeString())
+		}
+		w.Flush()
+	})
+}
+
+func HelpAttachments() {
+	fmt.Fprintf(os.Stderr, "Usage: attachments <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tLists the attachments of <id> with their content type, size and the time they were attached\n")
+}
+
+func CmdDetach(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 2, 2, "detach", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.Detach(args[0], args[1]))
+	})
+}
+
+func HelpDetach() {
+	fmt.Fprintf(os.Stderr, "Usage: detach <id> <name>\n\n")
+	fmt.Fprintf(os.Stderr, "\tRemoves the attachment called <name> from <id>\n")
+}
+
+func CmdLink(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 3, 3, "link", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.Link(args[0], args[1], args[2]))
+	})
+}
+
+func HelpLink() {
+	fmt.Fprintf(os.Stderr, "Usage: link <id> <type> <target>\n\n")
+	fmt.Fprintf(os.Stderr, "\tLinks <id> to <target>, <type> is one of depends-on, blocks or relates-to. Entries that depend on entries that aren't done are blocked (see #:blocked), dependencies can not form cycles\n")
+}
+
+func CmdUnlink(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 3, 3, "unlink", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.Unlink(args[0], args[1], args[2]))
+	})
+}
+
+func HelpUnlink() {
+	fmt.Fprintf(os.Stderr, "Usage: unlink <id> <type> <target>\n\n")
+	fmt.Fprintf(os.Stderr, "\tRemoves a link created with link\n")
+}
+
+func CmdLinks(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "links", func(tl *Tasklist, args []string, flags map[string]bool) {
+		links, err := tl.Links(args[0])
+		Must(err)
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, link := range links {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", link.Type, link.Id, link.Priority.String(), link.Title)
+		}
+		w.Flush()
+	})
+}
+
+func HelpLinks() {
+	fmt.Fprintf(os.Stderr, "Usage: links <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tLists the links of <id>, including the ones created from other entries\n")
+}
+
+func CmdColumnType(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{"d": true}, 1, 3, "coltype", func(tl *Tasklist, args []string, flags map[string]bool) {
+		if flags["d"] {
+			CheckCondition(len(args) > 2, "Too many arguments for coltype -d\n")
+			tag := ""
+			if len(args) > 1 {
+				tag = args[1]
+			}
+			Must(tl.RemoveColumnType(args[0], tag))
+			return
+		}
+
+		CheckCondition(len(args) < 2, "Missing type for coltype\n")
+		tag := ""
+		if len(args) > 2 {
+			tag = args[2]
+		}
+		Must(tl.DeclareColumnType(args[0], args[1], tag))
+	})
+}
+
+func HelpColumnType() {
+	fmt.Fprintf(os.Stderr, "Usage: coltype <column> <type> [<tag>]\n")
+	fmt.Fprintf(os.Stderr, "       coltype -d <column> [<tag>]\n\n")
+	fmt.Fprintf(os.Stderr, "\tDeclares the type of <column>, <type> is one of number, date, duration (1h30m), enum:<value>,<value>... or text. If <tag> is specified the declaration only applies to entries with <tag>. Values are checked when entries are saved and searches like #column>value compare them according to their type. With -d removes the declaration\n")
+}
+
+func CmdColumnTypes(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 0, "coltypes", func(tl *Tasklist, args []string, flags map[string]bool) {
+		cts, err := tl.ColumnTypes()
+		Must(err)
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, ct := range cts {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", ct.Column, ct.String(), ct.Tag)
+		}
+		w.Flush()
+	})
+}
+
+func HelpColumnTypes() {
+	fmt.Fprintf(os.Stderr, "Usage: coltypes\n\n")
+	fmt.Fprintf(os.Stderr, "\tLists the declared column types, see coltype\n")
+}
+
+func CmdStart(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1, "start", func(tl *Tasklist, args []string, flags map[string]bool) {
+		stopped, err := tl.StartTimer(args[0])
+		Must(err)
+		if stopped != nil {
+			fmt.Printf("Stopped %s after %s\n", stopped.Id, FormatColumnDuration(stopped.Duration().Seconds()))
+		}
+	})
+}
+
+func HelpStart() {
+	fmt.Fprintf(os.Stderr, "Usage: start <id>\n\n")
+	fmt.Fprintf(os.Stderr, "\tStarts tracking time spent on <id>, stopping the timer that is running\n")
+}
+
+func CmdStop(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 0, "stop", func(tl *Tasklist, args []string, flags map[string]bool) {
+		stopped, err := tl.StopTimer()
+		Must(err)
+		fmt.Printf("Stopped %s after %s\n", stopped.Id, FormatColumnDuration(stopped.Duration().Seconds()))
+	})
+}
+
+func HelpStop() {
+	fmt.Fprintf(os.Stderr, "Usage: stop\n\n")
+	fmt.Fprintf(os.Stderr, "\tStops the running timer\n")
+}
+
+// Removes --name value from args, returns value
+func extractArgValue(args []string, name string) (string, []string) {
+	for i := range args {
+		if args[i] == "--"+name && i+1 < len(args) {
+			return args[i+1], append(append([]string{}, args[:i]...), args[i+2:]...)
+		}
+	}
+	return "", args
+}
+
+func CmdTimeReport(args []string) {
+	fromStr, args := extractArgValue(args, "from")
+	toStr, args := extractArgValue(args, "to")
+
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 1000, "timereport", func(tl *Tasklist, args []string, flags map[string]bool) {
+		timezone := tl.GetTimezone()
+		var from, to *time.Time
+		var err error
+		if fromStr != "" {
+			from, err = ParseDateTime(fromStr, timezone)
+			Must(err)
+		}
+		if toStr != "" {
+			to, err = ParseDateTime(toStr, timezone)
+			Must(err)
+		}
+
+		report, err := tl.TimeReport(strings.Join(args, " "), from, to)
+		Must(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 8, 8, 2, ' ', 0)
+		for _, line := range report.Entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", line.Name, line.DurationString(), line.Title)
+		}
+		fmt.Fprintf(w, "\t%s\tTOTAL\n", report.Total.DurationString())
+		fmt.Fprintf(w, "\n")
+		for _, line := range report.Tags {
+			fmt.Fprintf(w, "#%s\t%s\n", line.Name, line.DurationString())
+		}
+		w.Flush()
+	})
+}
+
+func HelpTimeReport() {
+	fmt.Fprintf(os.Stderr, "Usage: timereport [--from <date>] [--to <date>] <search string>\n\n")
+	fmt.Fprintf(os.Stderr, "\tShows the time tracked with start and stop on the entries matching the search string, by entry and by tag. Entries with priority done are included\n")
+}
+
+func CmdExport(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{"private": true}, 0, 1, "export", func(tl *Tasklist, args []string, flags map[string]bool) {
+		if len(args) == 0 || args[0] == "-" {
+			Must(tl.ExportTo(os.Stdout, flags["private"]))
+			return
+		}
+		out, err := os.Create(args[0])
+		Must(err)
+		defer out.Close()
+		Must(tl.ExportTo(out, flags["private"]))
+	})
+}
+
+func HelpExport() {
+	fmt.Fprintf(os.Stderr, "Usage: export [-private] [<file>]\n\n")
+	fmt.Fprintf(os.Stderr, "\tWrites the whole tasklist to <file> (or standard output) as JSON: entries with all their columns, removed entries, saved searches, settings, column types, links, attachments and tracked time. The format is described in pooch/export.go\n")
+	fmt.Fprintf(os.Stderr, "\tPrivate settings (passwords, notification commands...) are only written with -private\n")
+}
+
+func CmdImport(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{"replace": true, "private": true}, 1, 1, "import", func(tl *Tasklist, args []string, flags map[string]bool) {
+		in := os.Stdin
+		if args[0] != "-" {
+			var err error
+			in, err = os.Open(args[0])
+			Must(err)
+			defer in.Close()
+		}
+		ex, err := ReadExport(in)
+		Must(err)
+		Must(tl.Import(ex, flags["replace"], flags["private"]))
+	})
+}
+
+func HelpImport() {
+	fmt.Fprintf(os.Stderr, "Usage: import [-replace] [-private] <file>\n\n")
+	fmt.Fprintf(os.Stderr, "\tImports a file written by export (- reads standard input). Entries in the file replace the entries with the same id, everything else is merged with the tasklist. With -replace the contents of the tasklist are deleted first\n")
+	fmt.Fprintf(os.Stderr, "\tPrivate settings in the file (passwords, notification commands...) are ignored unless -private is passed, only import them from files you wrote\n")
+}
+
+func CmdIcs(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 1000, "ics", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.WriteICS(os.Stdout, strings.Join(args, " ")))
+	})
+}
+
+func HelpIcs() {
+	fmt.Fprintf(os.Stderr, "Usage: ics <search string>\n\n")
+	fmt.Fprintf(os.Stderr, "\tWrites the entries matching the search string (or saved search) as an iCalendar file: entries with a time become events (all-day if the time is midnight), NOW and LATER entries become to-dos, recurring entries are written once with their recurrence rule\n")
+	fmt.Fprintf(os.Stderr, "The same feed is served by serve and multiserve at /cal.ics?q=<search string>&apiToken=<token>, the token is one of the API tokens of the user with multiserve and the api_token private option with serve\n")
+}
+
+func CmdImportIcs(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "importics", func(tl *Tasklist, args []string, flags map[string]bool) {
+		in := os.Stdin
+		if args[0] != "-" {
+			var err error
+			in, err = os.Open(args[0])
+			Must(err)
+			defer in.Close()
+		}
+		added, updated, err := tl.ImportICS(in, strings.Join(args[1:], " "))
+		Must(err)
+		fmt.Printf("Added %d entries, updated %d\n", added, updated)
+	})
+}
+
+func HelpImportIcs() {
+	fmt.Fprintf(os.Stderr, "Usage: importics <file> [#tags]\n\n")
+	fmt.Fprintf(os.Stderr, "\tImports the events and to-dos of an iCalendar file (- reads standard input) as entries, with the given tags. Summary becomes the title, description the text, the start (or due) date the time of the entry and categories become tags. Recurrences that can be written as a recur column are kept\n")
+	fmt.Fprintf(os.Stderr, "The UID of each event is saved in the ics-uid column, importing the file again updates the entries instead of adding new ones. Files can also be uploaded to /importics (file and tags parameters)\n")
+}
+
+func CmdTodoTxt(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "todotxt", func(tl *Tasklist, args []string, flags map[string]bool) {
+		switch args[0] {
+		case "export":
+			Must(tl.TodoTxtExport(os.Stdout, strings.Join(args[1:], " ")))
+		case "import":
+			CheckCondition(len(args) != 2, "Usage: todotxt import <file>\n")
+			in := os.Stdin
+			if args[1] != "-" {
+				var err error
+				in, err = os.Open(args[1])
+				Must(err)
+				defer in.Close()
+			}
+			added, updated, err := tl.TodoTxtImport(in)
+			Must(err)
+			fmt.Printf("Added %d entries, updated %d\n", added, updated)
+		default:
+			CheckCondition(true, "Unknown todotxt command: %s\n", args[0])
+		}
+	})
+}
+
+func HelpTodoTxt() {
+	fmt.Fprintf(os.Stderr, "Usage: todotxt export <search string>\n")
+	fmt.Fprintf(os.Stderr, "       todotxt import <file>\n\n")
+	fmt.Fprintf(os.Stderr, "\tWrites the entries matching the search string in todo.txt format, or reads a todo.txt file (- reads standard input). Priorities (A) to (D) are sticky, now, later and notes, x marks done entries, +project and @context are tags, key:value pairs are columns and due: (with at: for the time of the day) is the time of timed entries\n")
+	fmt.Fprintf(os.Stderr, "Every exported line has an id: key, when the file is imported again the lines with an id update their entry instead of adding a new one. Columns with more than one word and the text of entries are not exported and are left unchanged by import\n")
+}
+
+func CmdExportMd(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 1000, "export-md", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.ExportMarkdown(os.Stdout, strings.Join(args, " ")))
+	})
+}
+
+func HelpExportMd() {
+	fmt.Fprintf(os.Stderr, "Usage: export-md <search string>\n\n")
+	fmt.Fprintf(os.Stderr, "\tWrites the entries matching the search string as a Markdown list, subitems are nested under their parent. Done entries are checked, now, later and timed entries unchecked, tags are written as #tag, columns between parenthesis\n")
+}
+
+func CmdExportOrg(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 0, 1000, "export-org", func(tl *Tasklist, args []string, flags map[string]bool) {
+		Must(tl.ExportOrg(os.Stdout, strings.Join(args, " ")))
+	})
+}
+
+func HelpExportOrg() {
+	fmt.Fprintf(os.Stderr, "Usage: export-org <search string>\n\n")
+	fmt.Fprintf(os.Stderr, "\tWrites the entries matching the search string as an Org-mode outline, subitems are nested headings. Now and timed entries are TODO, later entries TODO [#C], done entries DONE, sticky entries [#A] and notes have no keyword. The time of the entry is SCHEDULED, tags are heading tags and columns are in the property drawer, with the id of the entry as ID\n")
+}
+
+func CmdImportOrg(args []string) {
+	CheckArgsOpenDb(args, map[string]bool{}, 1, 1000, "import-org", func(tl *Tasklist, args []string, flags map[string]bool) {
+		in := os.Stdin
+		if args[0] != "-" {
+			var err error
+			in, err = os.Open(args[0])
+			Must(err)
+			defer in.Close()
+		}
+		added, updated, err := tl.ImportOrg(in, strings.Join(args[1:], " "))
+		Must(err)
+		fmt.Printf("Added %d entries, updated %d\n", added, updated)
+	})
+}
+
+func HelpImportOrg() {
+	fmt.Fprintf(os.Stderr, "Usage: import-org <file> [#tags]\n\n")
+	fmt.Fprintf(os.Stderr, "\tImports an Org-mode file (- reads standard input) written with the same conventions as export-org, top level headings get the given tags and nested headings become subitems. Headings with the ID of an existing entry update it\n")
+}
+
+func CmdCsvImport(args []string) {
+	sep, args := extractArgValue(args, "sep")
+
+	CheckArgsOpenDb(args, map[string]bool{"dry-run": true}, 2, 1000, "csvimport", func(tl *Tasklist, args []string, flags map[string]bool) {
+		comma := ','
+		if sep != "" {
+			CheckCondition(len([]rune(sep)) != 1, "Separator should be a single character: %s\n", sep)
+			comma = []rune(sep)[0]
+		}
+
+		mappingArgs, queryArgs := []string{}, []string{}
+		for _, arg := range args[1:] {
+			// #col=value is part of the query, not a mapping
+			if strings.Contains(arg, "=") && !strings.HasPrefix(arg, "#") {
+				mappingArgs = append(mappingArgs, arg)
+			} else {
+				queryArgs = append(queryArgs, arg)
+			}
+		}
+		mapping, err := ParseCsvMapping(mappingArgs)
+		Must(err)
+
+		in := os.Stdin
+		if args[0] != "-" {
+			in, err = os.Open(args[0])
+			Must(err)
+			defer in.Close()
+		}
+
+		entries, err := tl.ImportCSV(in, comma, mapping, strings.Join(queryArgs, " "), flags["dry-run"])
+		Must(err)
+
+		if flags["dry-run"] {
+			lp := makeListPrinter(entries, []string{}, tl.GetTimezone(), tl.CategoryDepth())
+			for _, e := range entries {
+				priority := e.Priority()
+				fmt.Printf("%-6s ", priority.String())
+				lp.entry(e)
+			}
+			fmt.Printf("Would add %d entries\n", len(entries))
+		} else {
+			fmt.Printf("Added %d entries\n", len(entries))
+		}
+	})
+}
+
+func HelpCsvImport() {
+	fmt.Fprintf(os.Stderr, "Usage: csvimport [-dry-run] [--sep <separator>] <file> <csv column>=<target>... [#tag...] [#name=value...]\n\n")
+	fmt.Fprintf(os.Stderr, "\tAdds an entry for each row of a csv file (- reads standard input), whose first row names the columns. Each mapping sends a csv column to a target: title, text, priority, when (time of the entry), sort, tag (tags separated by spaces or commas) or any other name for a column with that name. Csv columns without a mapping are ignored, the given tags and columns (#name=value) are added to every entry\n")
+	fmt.Fprintf(os.Stderr, "Every row is checked first: if any row is wrong the errors are reported with their line number and nothing is imported, otherwise all the entries are added in a single transaction. With -dry-run the entries are shown and not added\n")
+}
+
+func CmdMerge(args []string) {
+	args, _ = CheckArgs(args, map[string]bool{}, 3, 3, "merge")
+
+	for _, filename := range args {
+		_, err := os.Stat(filename)
+		CheckCondition(err != nil, "Cannot open %s: %v\n", filename, err)
+	}
+
+	// base and theirs are only read
+	base, err := ExportFile(args[0], false)
+	Must(err)
+	theirs, err := ExportFile(args[2], false)
+	Must(err)
+
+	tl, err := OpenOrCreate(args[1])
+	Must(err)
+	defer tl.Close()
+	report, err := tl.Merge(base, theirs)
+	Must(err)
+
+	for _, c := range report.Conflicts {
+		switch {
+		case c.CopyId != "":
+			fmt.Printf("CONFLICT\t%s\t%s\t%s, their version is %s\n", c.Id, c.Title, strings.Join(c.Fields, " "), c.CopyId)
+		case c.Id != "":
+			fmt.Printf("CONFLICT\t%s\t%s\t%s, kept\n", c.Id, c.Title, strings.Join(c.Fields, " "))
+		default:
+			fmt.Printf("CONFLICT\t%s %s, kept ours\n", strings.Join(c.Fields, " "), c.Title)
+		}
+	}
+	fmt.Printf("Added %d entries, updated %d, removed %d, %d conflicts\n", report.Added, report.Updated, report.Removed, len(report.Conflicts))
+}
+
+func HelpMerge() {
+	fmt.Fprintf(os.Stderr, "Usage: merge <base db> <our db> <their db>\n\n")
+	fmt.Fprintf(os.Stderr, "\tMerges into <our db> the changes made to <their db> since <base db>, the copy both were made from. Entries are matched by id and merged field by field, saved searches, settings and column types by name\n")
+	fmt.Fprintf(os.Stderr, "When both copies changed the same field of an entry our value is kept and their version is added as a new entry tagged #conflict, with a conflict-of column with the id of the original. Conflicts are listed at the end\n")
 }
 
 func CmdHelp(args []string) {
@@ -583,8 +1344,12 @@ func main() {
 		w.WriteString("\tupdate\tUpdate command\n")
 		w.WriteString("\ttsvup\tAdd or update from tsv file\n")
 		w.WriteString("\tremove\tRemove entry\n")
+		w.WriteString("\ttrash\tList removed entries\n")
+		w.WriteString("\trestore\tRestore removed entry\n")
 		w.WriteString("\trename\tRename entry\n")
 		w.WriteString("\trentag\tRename tags\n")
+		w.WriteString("\thistory\tShows the revisions of an entry\n")
+		w.WriteString("\trevert\tReverts an entry to a previous revision\n")
 		w.WriteString("\tontocheck\tChecks compilance to category hierarchy\n")
 		w.WriteString("\n")
 		w.WriteString("\tsetopt\tSets options\n")
@@ -0,0 +1,225 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ Aggregates are requested with search options:
+
+	#:group=col	splits the results by the value of col
+	#:sum=col	adds the values of col
+	#:avg=col	averages the values of col
+	#:count		counts entries
+
+ sum and avg can be repeated. Values are numbers, or durations if the
+ column is declared as a duration (see coltypes.go), values that can't be
+ converted are ignored. The results have one Aggregate for each group and
+ one for all the entries.
+*/
+
+type Aggregate struct {
+	Group string   `json:",omitempty"`
+	Ids   []string `json:",omitempty"`
+	Count int
+	Sum   map[string]float64 `json:",omitempty"`
+	Avg   map[string]float64 `json:",omitempty"`
+
+	n         map[string]int
+	spec      *AggregateSpec
+	durations map[string]bool
+}
+
+type AggregateSpec struct {
+	GroupBy string
+	Sum     []string
+	Avg     []string
+	Count   bool
+}
+
+type Aggregates struct {
+	Spec   *AggregateSpec
+	Groups []*Aggregate `json:",omitempty"`
+	Total  *Aggregate
+}
+
+// Returns the aggregates requested by the options of a search, nil if there aren't any
+func AggregateSpecFromOptions(options map[string]string) *AggregateSpec {
+	spec := &AggregateSpec{}
+	spec.GroupBy = options["group"]
+	spec.Sum = splitOptionList(options["sum"])
+	spec.Avg = splitOptionList(options["avg"])
+	_, spec.Count = options["count"]
+
+	if spec.GroupBy == "" && len(spec.Sum) == 0 && len(spec.Avg) == 0 && !spec.Count {
+		return nil
+	}
+	return spec
+}
+
+func splitOptionList(s string) []string {
+	r := []string{}
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			r = append(r, x)
+		}
+	}
+	return r
+}
+
+func (spec *AggregateSpec) makeAggregate(group string, durations map[string]bool) *Aggregate {
+	return &Aggregate{Group: group, Ids: []string{}, Sum: map[string]float64{}, Avg: map[string]float64{}, n: map[string]int{}, spec: spec, durations: durations}
+}
+
+// Columns whose values are added or averaged, without repetitions
+func (spec *AggregateSpec) valueColumns() []string {
+	r := []string{}
+	seen := map[string]bool{}
+	for _, col := range append(append([]string{}, spec.Sum...), spec.Avg...) {
+		if !seen[col] {
+			seen[col] = true
+			r = append(r, col)
+		}
+	}
+	return r
+}
+
+func (tl *Tasklist) Aggregate(entries []*Entry, spec *AggregateSpec) (r *Aggregates, err error) {
+	defer catchError(&err)
+
+	durations := map[string]bool{}
+	for _, ct := range tl.columnTypes() {
+		if ct.Type == COLTYPE_DURATION {
+			durations[ct.Column] = true
+		}
+	}
+
+	r = &Aggregates{Spec: spec, Total: spec.makeAggregate("", durations)}
+
+	groups := map[string]*Aggregate{}
+
+	for _, entry := range entries {
+		targets := []*Aggregate{r.Total}
+		if spec.GroupBy != "" {
+			key := entry.Columns()[spec.GroupBy]
+			g, ok := groups[key]
+			if !ok {
+				g = spec.makeAggregate(key, durations)
+				groups[key] = g
+				r.Groups = append(r.Groups, g)
+			}
+			targets = append(targets, g)
+		}
+
+		for _, a := range targets {
+			a.Ids = append(a.Ids, entry.Id())
+			a.Count++
+		}
+
+		for _, col := range spec.valueColumns() {
+			value, ok := entry.Columns()[col]
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if durations[col] {
+				n, err = ParseColumnDuration(value)
+			}
+			if err != nil {
+				continue
+			}
+			for _, a := range targets {
+				a.Sum[col] += n
+				a.n[col]++
+			}
+		}
+	}
+
+	sort.SliceStable(r.Groups, func(i, j int) bool {
+		// entries without the column go last
+		if r.Groups[i].Group == "" || r.Groups[j].Group == "" {
+			return r.Groups[j].Group == "" && r.Groups[i].Group != ""
+		}
+		return r.Groups[i].Group < r.Groups[j].Group
+	})
+
+	for _, a := range append([]*Aggregate{r.Total}, r.Groups...) {
+		a.finish()
+	}
+
+	return r, nil
+}
+
+func (a *Aggregate) finish() {
+	sums := map[string]float64{}
+	for _, col := range a.spec.Sum {
+		sums[col] = a.Sum[col]
+	}
+	for _, col := range a.spec.Avg {
+		if a.n[col] > 0 {
+			a.Avg[col] = a.Sum[col] / float64(a.n[col])
+		}
+	}
+	a.Sum = sums
+}
+
+// Formats a value of col, durations are formatted like 1h30m
+func (a *Aggregate) FormatValue(col string, n float64) string {
+	if a.durations[col] {
+		return FormatColumnDuration(n)
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func FormatColumnDuration(seconds float64) string {
+	s := int64(seconds + 0.5)
+	if s == 0 {
+		return "0m"
+	}
+	r := ""
+	for _, unit := range []struct {
+		name    string
+		seconds int64
+	}{{"d", 24 * 3600}, {"h", 3600}, {"m", 60}, {"s", 1}} {
+		if s >= unit.seconds {
+			r += fmt.Sprintf("%d%s", s/unit.seconds, unit.name)
+			s = s % unit.seconds
+		}
+	}
+	return r
+}
+
+// Returns the aggregates of a, in the order they were requested, as name, value pairs
+func (a *Aggregate) Values() [][2]string {
+	r := [][2]string{}
+	if a.spec.Count {
+		r = append(r, [2]string{"count", strconv.Itoa(a.Count)})
+	}
+	for _, col := range a.spec.Sum {
+		r = append(r, [2]string{"sum(" + col + ")", a.FormatValue(col, a.Sum[col])})
+	}
+	for _, col := range a.spec.Avg {
+		value := "-"
+		if avg, ok := a.Avg[col]; ok {
+			value = a.FormatValue(col, avg)
+		}
+		r = append(r, [2]string{"avg(" + col + ")", value})
+	}
+	return r
+}
+
+func (a *Aggregate) String() string {
+	v := []string{}
+	for _, x := range a.Values() {
+		v = append(v, x[0]+" "+x[1])
+	}
+	return strings.Join(v, ", ")
+}
@@ -0,0 +1,116 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+/*
+ Attachments are files stored in the attachments table, identified by the
+ id of their entry and their name. They follow their entry: they are hidden
+ while the entry is in the trash and deleted when it is purged.
+*/
+
+type Attachment struct {
+	Id          string
+	Name        string
+	ContentType string
+	Size        int
+	Time        time.Time
+	Data        []byte `json:"-"`
+}
+
+func (a *Attachment) TimeString() string {
+	return a.Time.Format("2006-01-02 15:04:05")
+}
+
+// Guesses the content type from the name of the file, or from its contents
+func AttachmentContentType(name string, data []byte) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(data)
+}
+
+func (tl *Tasklist) checkAttachable(id string) {
+	if !tl.Exists(id) {
+		panic(MakeNotFoundError("Couldn't find entry %s", id))
+	}
+}
+
+// Attaches data to id with the specified name, replacing any attachment with the same name
+func (tl *Tasklist) Attach(id, name, contentType string, data []byte) (err error) {
+	defer catchError(&err)
+	tl.checkAttachable(id)
+	if name == "" {
+		panic(MakeParseError("Attachment name can not be empty"))
+	}
+	if contentType == "" {
+		contentType = AttachmentContentType(name, data)
+	}
+	tl.MustExec("INSERT OR REPLACE INTO attachments(id, name, content_type, size, created_at, data) VALUES (?, ?, ?, ?, ?, ?)", id, name, contentType, len(data), time.Now().UTC().Format("2006-01-02 15:04:05"), data)
+	return nil
+}
+
+// Returns the attachments of id, without their data
+func (tl *Tasklist) Attachments(id string) (r []*Attachment, err error) {
+	defer catchError(&err)
+	tl.checkAttachable(id)
+
+	stmt, serr := tl.conn.Prepare("SELECT id, name, content_type, size, created_at FROM attachments WHERE id = ? ORDER BY name")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+
+	r = []*Attachment{}
+	for stmt.Next() {
+		a := &Attachment{}
+		var createdAt string
+		Must(stmt.Scan(&a.Id, &a.Name, &a.ContentType, &a.Size, &createdAt))
+		if t, _ := ParseDateTime(createdAt, time.UTC); t != nil {
+			a.Time = *t
+		}
+		r = append(r, a)
+	}
+	return r, nil
+}
+
+func (tl *Tasklist) GetAttachment(id, name string) (a *Attachment, err error) {
+	defer catchError(&err)
+	tl.checkAttachable(id)
+
+	stmt, serr := tl.conn.Prepare("SELECT id, name, content_type, size, created_at, data FROM attachments WHERE id = ? AND name = ?")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id, name))
+
+	if !stmt.Next() {
+		panic(MakeNotFoundError("Couldn't find attachment %s of %s", name, id))
+	}
+
+	a = &Attachment{}
+	var createdAt string
+	var data []byte
+	Must(stmt.Scan(&a.Id, &a.Name, &a.ContentType, &a.Size, &createdAt, &data))
+	if t, _ := ParseDateTime(createdAt, time.UTC); t != nil {
+		a.Time = *t
+	}
+	// data points to memory owned by sqlite
+	a.Data = append([]byte{}, data...)
+	return a, nil
+}
+
+func (tl *Tasklist) Detach(id, name string) (err error) {
+	defer catchError(&err)
+	_, err = tl.GetAttachment(id, name)
+	Must(err)
+	tl.MustExec("DELETE FROM attachments WHERE id = ? AND name = ?", id, name)
+	return nil
+}
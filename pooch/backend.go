@@ -11,9 +11,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,15 +29,13 @@ type Tasklist struct {
 	luaFlags              *LuaFlags
 	mutex                 *sync.Mutex
 	refs                  int
-	timestamp             int64
+	lastUsed              time.Time
+	discarded             bool
 	executionLimitEnabled bool
 	curCut                string
+	secretKey             []byte
 }
 
-var enabledCaching bool = true
-var tasklistCache map[string]*Tasklist = make(map[string]*Tasklist)
-var tasklistCacheMutex sync.Mutex
-
 func MustExec(conn *sqlite.Conn, stmt string, v ...interface{}) {
 	Must(conn.Exec(stmt, v...))
 }
@@ -74,32 +72,24 @@ func internalTasklistOpenOrCreate(filename string) *Tasklist {
 	conn, err := sqlite.Open(filename)
 	Must(err)
 
-	if !HasTable(conn, "errorlog") { // optimization, if the last added table exists exists do not try to create anything
-		MustExec(conn, "CREATE TABLE IF NOT EXISTS tasks(id TEXT PRIMARY KEY, title_field TEXT, text_field TEXT, priority INTEGER, trigger_at_field DATE, sort TEXT);")
-		MustExec(conn, "CREATE INDEX IF NOT EXISTS tasks_id ON tasks(id);")
-
-		if !HasTable(conn, "ridx") { // Workaround for non-accepted CREATE VIRTUAL TABLE IF NOT EXISTS
-			MustExec(conn, "CREATE VIRTUAL TABLE ridx USING fts3(id TEXT, title_field TEXT, text_field TEXT);")
-		}
-
-		MustExec(conn, "CREATE TABLE IF NOT EXISTS columns(id TEXT, name TEXT, value TEXT, FOREIGN KEY (id) REFERENCES tasks (id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED)")
-		MustExec(conn, "CREATE INDEX IF NOT EXISTS columns_id ON columns(id);")
-
-		MustExec(conn, "CREATE TABLE IF NOT EXISTS saved_searches(name TEXT, value TEXT);")
-	}
-
-	MustExec(conn, "CREATE TABLE IF NOT EXISTS settings(name TEXT UNIQUE, value TEXT);")
-	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"timezone\", \"0\");")
-	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"theme\", \"tlist.css\");")
-	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"setup\", \"\");")
-	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"defaultsorttime\", \"0\");")
-
-	MustExec(conn, "CREATE TABLE IF NOT EXISTS errorlog(timestamp TEXT, message TEXT);")
+	func() {
+		defer func() {
+			if rerr := recover(); rerr != nil {
+				conn.Close()
+				panic(rerr)
+			}
+		}()
+		MigrateSchema(filename, conn)
+	}()
 
-	MustExec(conn, "CREATE TABLE IF NOT EXISTS private_settings(name TEXT UNIQUE, value TEXT);")
-	MustExec(conn, "INSERT OR IGNORE INTO private_settings(name, value) VALUES (\"enable_lua_execution_limit\", \"1\")")
+	tasklist := &Tasklist{filename, conn, MakeLuaState(), &LuaFlags{}, &sync.Mutex{}, 1, time.Now(), false, true, "", nil}
 
-	tasklist := &Tasklist{filename, conn, MakeLuaState(), &LuaFlags{}, &sync.Mutex{}, 1, time.Now().Unix(), true, ""}
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			tasklist.close()
+			panic(rerr)
+		}
+	}()
 
 	if tasklist.GetPrivateSetting("enable_lua_execution_limit") == "0" {
 		Logf(INFO, "Tasklist '%s' runs without lua execution limits", filename)
@@ -109,6 +99,7 @@ func internalTasklistOpenOrCreate(filename string) *Tasklist {
 	tasklist.RunTimedTriggers()
 	tasklist.MustExec("PRAGMA foreign_keys = ON;")
 	tasklist.MustExec("PRAGMA synchronous = OFF;") // makes inserts many many times faster
+	tasklist.purgeTrash()
 
 	// executing setup code
 	setupCode := tasklist.GetSetting("setup")
@@ -119,64 +110,98 @@ func internalTasklistOpenOrCreate(filename string) *Tasklist {
 	return tasklist
 }
 
-func (tl *Tasklist) Truncate() {
-	tl.MustExec("DELETE FROM columns")
-	tl.MustExec("DELETE FROM tasks")
-	tl.MustExec("DELETE FROM ridx")
-	tl.MustExec("DELETE FROM saved_searches")
-	tl.MustExec("DELETE FROM errorlog")
-}
+// Opens the tasklist in filename with a connection that can't write to it, see openReadOnly
+func internalTasklistOpenReadOnly(filename string) *Tasklist {
+	_, err := os.Stat(filename)
+	Must(err) // sqlite.Open would create it
 
-func OpenOrCreate(filename string) *Tasklist {
-	if !enabledCaching {
-		return internalTasklistOpenOrCreate(filename)
-	}
+	conn, err := sqlite.Open(filename)
+	Must(err)
 
-	tasklistCacheMutex.Lock()
-	defer tasklistCacheMutex.Unlock()
+	tasklist := &Tasklist{filename, conn, MakeLuaState(), &LuaFlags{}, &sync.Mutex{}, 1, time.Now(), false, true, "", nil}
 
-	if r, ok := tasklistCache[filename]; ok && r != nil {
-		r.refs++
-		r.RunTimedTriggers() // Must run timed triggers anyways
-		return r
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			tasklist.close()
+			panic(rerr)
+		}
+	}()
+
+	if version := SchemaVersion(conn); version != SchemaVersionLatest() {
+		panic(MakeParseError(fmt.Sprintf("Tasklist %s has schema version %d, it must be opened once to be upgraded to version %d", filename, version, SchemaVersionLatest())))
 	}
+	tasklist.MustExec("PRAGMA query_only = ON;")
 
-	Logf(INFO, "Opening new connection to: %s\n", filename)
+	if tasklist.GetPrivateSetting("enable_lua_execution_limit") == "0" {
+		tasklist.executionLimitEnabled = false
+	}
 
-	r := internalTasklistOpenOrCreate(filename)
-	tasklistCache[filename] = r
-	return r
+	// functions defined by the setup code can be used by searches
+	if setupCode := tasklist.GetSetting("setup"); setupCode != "" {
+		tasklist.DoString(setupCode, nil)
+	}
+
+	return tasklist
 }
 
-func (tasklist *Tasklist) Close() {
-	if !enabledCaching {
-		tasklist.conn.Close()
-		tasklist.luaState.Close()
-		return
-	}
+/*
+ Opens an in-memory copy of the tasklist in filename, the file is only read:
+ the schema of the copy is upgraded in memory and timed triggers, trash
+ purging and setup code are not run. Must be closed with close.
+*/
+func openSnapshot(filename string) *Tasklist {
+	_, err := os.Stat(filename)
+	Must(err) // sqlite.Open would create it
 
-	tasklistCacheMutex.Lock()
-	defer tasklistCacheMutex.Unlock()
+	src, err := sqlite.Open(filename)
+	Must(err)
+	defer src.Close()
+	Must(src.Exec("PRAGMA query_only = ON;"))
 
-	tasklist.refs--
+	conn, err := sqlite.Open(":memory:")
+	Must(err)
 
-	if time.Now().Unix()-tasklist.timestamp < 6*60*60 {
-		return
-	}
-	if tasklist.refs != 0 {
-		Logf(ERROR, "Couldn't close stale connection to %s, active connections %d\n", tasklist.filename, tasklist.refs)
-		return
-	}
+	func() {
+		defer func() {
+			if rerr := recover(); rerr != nil {
+				conn.Close()
+				panic(rerr)
+			}
+		}()
+		backup, err := sqlite.NewBackup(conn, "main", src, "main")
+		Must(err)
+		defer backup.Close()
+		for {
+			err := backup.Step(-1)
+			if err == sqlite.Done {
+				break
+			}
+			Must(err)
+			// the file is locked by another connection
+			time.Sleep(10 * time.Millisecond)
+		}
+		MigrateSchema(filename, conn)
+	}()
 
-	Logf(INFO, "Closing connection to %s\n", tasklist.filename)
+	return &Tasklist{filename, conn, MakeLuaState(), &LuaFlags{}, &sync.Mutex{}, 1, time.Now(), false, true, "", nil}
+}
 
-	tasklist.conn.Close()
-	tasklist.luaState.Close()
-	tasklistCache[tasklist.filename] = nil
+func (tl *Tasklist) Truncate() {
+	tl.MustExec("DELETE FROM ridx") // before tasks, so that the delete trigger has nothing to do
+	tl.MustExec("DELETE FROM columns")
+	tl.MustExec("DELETE FROM tasks")
+	tl.MustExec("DELETE FROM saved_searches")
+	tl.MustExec("DELETE FROM errorlog")
+	tl.MustExec("DELETE FROM history")
+	tl.MustExec("DELETE FROM reminders")
+	tl.MustExec("DELETE FROM attachments")
+	tl.MustExec("DELETE FROM links")
+	tl.MustExec("DELETE FROM coltypes")
+	tl.MustExec("DELETE FROM timelog")
 }
 
 func (tasklist *Tasklist) Exists(id string) bool {
-	stmt, err := tasklist.conn.Prepare("SELECT id FROM tasks WHERE id = ?")
+	stmt, err := tasklist.conn.Prepare("SELECT id FROM tasks WHERE id = ? AND trashed_at = 0")
 	Must(err)
 	defer stmt.Finalize()
 	Must(stmt.Exec(id))
@@ -202,7 +227,7 @@ func MakeRandomString(size int) string {
 func (tasklist *Tasklist) MakeRandomId() string {
 	id := MakeRandomString(6)
 
-	exists := tasklist.Exists(id)
+	exists := tasklist.Exists(id) || tasklist.isTrashed(id)
 
 	if exists {
 		return tasklist.MakeRandomId()
@@ -211,9 +236,16 @@ func (tasklist *Tasklist) MakeRandomId() string {
 	return id
 }
 
-func (tasklist *Tasklist) Remove(id string) {
-	tasklist.MustExec("DELETE FROM tasks WHERE id = ?", id)
-	tasklist.MustExec("DELETE FROM ridx WHERE id = ?", id)
+func (tasklist *Tasklist) Remove(id string) (err error) {
+	defer catchError(&err)
+	tasklist.remove(id)
+	return nil
+}
+
+func (tasklist *Tasklist) remove(id string) {
+	tasklist.WithTransaction(func() {
+		tasklist.trash(id, time.Now().Unix())
+	})
 }
 
 func FormatTriggerAtForAdd(e *Entry) string {
@@ -247,22 +279,31 @@ func (tl *Tasklist) CloneEntry(entry *Entry) *Entry {
 }
 
 func (tasklist *Tasklist) addColumns(e *Entry) {
+	decls := tasklist.columnTypes()
+	timezone := tasklist.GetTimezone()
 	for k, v := range e.Columns() {
 		Logf(DEBUG, "Adding column %s\n", k)
-		tasklist.MustExec("INSERT INTO columns(id, name, value) VALUES (?, ?, ?)", e.Id(), k, v)
+		valueType, typedValue := columnTypedValue(columnTypeFor(decls, k, entryHasTag(e)), v, timezone)
+		tasklist.MustExec("INSERT INTO columns(id, name, value, value_type, typed_value) VALUES (?, ?, ?, ?, NULLIF(?, ''))", e.Id(), k, v, valueType, typedValue)
 	}
 }
 
-func (tasklist *Tasklist) Add(e *Entry) {
-	triggerAtString := FormatTriggerAtForAdd(e)
+func (tasklist *Tasklist) Add(e *Entry) (err error) {
+	defer catchError(&err)
+	checkRecurrence(e, tasklist.GetTimezone())
+	checkReminders(e, tasklist.GetTimezone())
+	tasklist.checkColumnTypes(e)
+	tasklist.add(e)
+	return nil
+}
 
+func (tasklist *Tasklist) add(e *Entry) {
 	tasklist.WithTransaction(func() {
-		priority := e.Priority()
-		tasklist.MustExec("INSERT INTO tasks(id, title_field, text_field, priority, trigger_at_field, sort) VALUES (?, ?, ?, ?, ?, ?)", e.Id(), e.Title(), e.Text(), priority.ToInteger(), triggerAtString, e.Sort())
-		tasklist.MustExec("INSERT INTO ridx(id, title_field, text_field) VALUES (?, ?, ?)", e.Id(), e.Title(), e.Text())
-		tasklist.addColumns(e)
+		tasklist.insert(e)
 	})
 
+	tasklist.notifyScheduler(e)
+
 	if CurrentLogLevel <= DEBUG {
 		exists := tasklist.Exists(e.Id())
 		Log(DEBUG, "Existence check:", exists)
@@ -271,48 +312,141 @@ func (tasklist *Tasklist) Add(e *Entry) {
 	Log(DEBUG, "Add finished!")
 }
 
+// Writes e to the database, must be called inside a transaction
+func (tasklist *Tasklist) insert(e *Entry) {
+	if tasklist.isTrashed(e.Id()) {
+		// the id is being reused, the old entry is lost
+		tasklist.purge(e.Id())
+	}
+	priority := e.Priority()
+	now := time.Now().UTC()
+	createdAt, modifiedAt := e.CreatedAt(), e.ModifiedAt()
+	if createdAt == nil {
+		createdAt = &now
+	}
+	if modifiedAt == nil {
+		modifiedAt = &now
+	}
+	tasklist.MustExec("INSERT INTO tasks(id, title_field, text_field, priority, trigger_at_field, sort, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", e.Id(), e.Title(), tasklist.sealedText(e), priority.ToInteger(), FormatTriggerAtForAdd(e), e.Sort(), createdAt.Format("2006-01-02 15:04:05"), modifiedAt.Format("2006-01-02 15:04:05"))
+	tasklist.addColumns(e)
+}
+
 func (tasklist *Tasklist) LogError(error string) {
 	tasklist.MustExec("INSERT INTO errorlog(timestamp, message) VALUES(?, ?)", time.Now().Unix(), error)
 	Logf(INFO, "error while executing lua function: %s\n", error)
 }
 
-func (tl *Tasklist) RemoveSaveSearch(name string) {
+func (tl *Tasklist) RemoveSaveSearch(name string) (err error) {
+	defer catchError(&err)
 	tl.MustExec("DELETE FROM saved_searches WHERE name = ?", name)
+	return nil
 }
 
-func (tl *Tasklist) SaveSearch(name string, query string) {
+func (tl *Tasklist) SaveSearch(name string, query string) (err error) {
+	defer catchError(&err)
 	tl.WithTransaction(func() {
-		tl.RemoveSaveSearch(name)
+		tl.MustExec("DELETE FROM saved_searches WHERE name = ?", name)
 		tl.MustExec("INSERT INTO saved_searches(name, value) VALUES(?, ?)", name, query)
 	})
+	return nil
 }
 
-func (tasklist *Tasklist) Update(e *Entry, simpleUpdate bool) {
-	triggerAtString := FormatTriggerAtForAdd(e)
-	priority := e.Priority()
+func (tasklist *Tasklist) Update(e *Entry, simpleUpdate bool) (err error) {
+	defer catchError(&err)
+	checkRecurrence(e, tasklist.GetTimezone())
+	checkReminders(e, tasklist.GetTimezone())
+	tasklist.checkColumnTypes(e)
+	tasklist.update(e, simpleUpdate)
+	return nil
+}
 
+func (tasklist *Tasklist) update(e *Entry, simpleUpdate bool) {
+	tasklist.updateEx(e, simpleUpdate, "update")
+}
+
+func (tasklist *Tasklist) updateEx(e *Entry, simpleUpdate bool, action string) {
+	completed := false
 	tasklist.WithTransaction(func() {
-		tasklist.MustExec("UPDATE tasks SET title_field = ?, text_field = ?, priority = ?, trigger_at_field = ?, sort = ? WHERE id = ?", e.Title(), e.Text(), priority.ToInteger(), triggerAtString, e.Sort(), e.Id())
-		if !simpleUpdate {
-			tasklist.MustExec("UPDATE ridx SET title_field = ?, text_field = ? WHERE id = ?", e.Title(), e.Text(), e.Id())
-			tasklist.MustExec("DELETE FROM columns WHERE id = ?", e.Id())
-			tasklist.addColumns(e)
-		}
+		completed = tasklist.rewrite(e, simpleUpdate, action)
 	})
+	tasklist.afterUpdate(e, completed)
 
 	Log(DEBUG, "Update finished!")
 }
 
+// Writes the changes to e to the database, must be called inside a transaction. Returns true if the change completed e
+func (tasklist *Tasklist) rewrite(e *Entry, simpleUpdate bool, action string) bool {
+	triggerAtString := FormatTriggerAtForAdd(e)
+	priority := e.Priority()
+	completed := priority == DONE && tasklist.storedPriority(e.Id()) != DONE
+	text := tasklist.sealedText(e)
+
+	tasklist.saveRevision(e.Id(), action)
+	tasklist.MustExec("UPDATE tasks SET title_field = ?, text_field = ?, priority = ?, trigger_at_field = ?, sort = ?, modified_at = ? WHERE id = ?", e.Title(), text, priority.ToInteger(), triggerAtString, e.Sort(), time.Now().UTC().Format("2006-01-02 15:04:05"), e.Id())
+	if !simpleUpdate {
+		tasklist.MustExec("DELETE FROM columns WHERE id = ?", e.Id())
+		tasklist.addColumns(e)
+	}
+	if IsEncrypted(text) {
+		tasklist.forgetPlainText(e.Id())
+	}
+	if completed {
+		tasklist.unblock(tasklist.laterDependents(e.Id()))
+	}
+	return completed
+}
+
+// To be called after rewrite commits, reschedules e and adds the next occurrence of entries recurring after completion
+func (tasklist *Tasklist) afterUpdate(e *Entry, completed bool) {
+	tasklist.notifyScheduler(e)
+
+	if completed {
+		timezone := tasklist.GetTimezone()
+		if r := e.Recurrence(timezone); r != nil && r.AfterCompletion {
+			if next := e.NextEntry(tasklist.MakeRandomId(), timezone); next != nil {
+				tasklist.add(next)
+			}
+		}
+	}
+}
+
+// Priority of the entry as currently saved, -1 if it doesn't exist
+func (tasklist *Tasklist) storedPriority(id string) Priority {
+	stmt, err := tasklist.conn.Prepare("SELECT priority FROM tasks WHERE id = ?")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+
+	if !stmt.Next() {
+		return Priority(-1)
+	}
+	var priority int
+	Must(stmt.Scan(&priority))
+	return Priority(priority)
+}
+
+// Parses the columns of an entry, as returned by the group_concat in SELECT_HEADER
+func ParseColumnsString(columns string) Columns {
+	cols := make(Columns)
+	pieces := strings.Split(columns, "\u001f")
+	for i := 0; i+1 < len(pieces); i += 2 {
+		Logf(DEBUG, "   col: [%s] [%s]\n", pieces[i], pieces[i+1])
+		cols[pieces[i]] = pieces[i+1]
+	}
+	return cols
+}
+
 func StatementScan(stmt *sqlite.Stmt, hasCols bool) (*Entry, error) {
 	var priority_num int
 	var trigger_str, id, title, text, sort, columns string
+	var created_str, modified_str string
 	var scanerr error
 	if hasCols {
-		scanerr = stmt.Scan(&id, &title, &text, &priority_num, &trigger_str, &sort, &columns)
+		scanerr = stmt.Scan(&id, &title, &text, &priority_num, &trigger_str, &sort, &created_str, &modified_str, &columns)
 	} else {
 		scanerr = stmt.Scan(&id, &title, &text, &priority_num, &trigger_str, &sort)
 	}
-	triggerAt, _ := ParseDateTime(trigger_str, 0)
+	triggerAt, _ := ParseDateTime(trigger_str, time.UTC)
 	priority := Priority(priority_num)
 
 	if scanerr != nil {
@@ -323,45 +457,62 @@ func StatementScan(stmt *sqlite.Stmt, hasCols bool) (*Entry, error) {
 
 	cols := make(Columns)
 	if hasCols {
-		pieces := strings.Split(columns, "\u001f")
-		for i := 0; i+1 < len(pieces); i += 2 {
-			Logf(DEBUG, "   col: [%s] [%s]\n", pieces[0], pieces[1])
-			cols[pieces[i]] = pieces[i+1]
-		}
+		cols = ParseColumnsString(columns)
 	}
 
 	Logf(DEBUG, "Columns are: %v\n", cols)
 
-	return MakeEntry(id, title, text, priority, triggerAt, sort, cols), nil
+	entry := MakeEntry(id, title, text, priority, triggerAt, sort, cols)
+	createdAt, _ := ParseDateTime(created_str, time.UTC)
+	entry.SetCreatedAt(createdAt)
+	modifiedAt, _ := ParseDateTime(modified_str, time.UTC)
+	entry.SetModifiedAt(modifiedAt)
+
+	return entry, nil
+}
+
+func (tl *Tasklist) Get(id string) (entry *Entry, err error) {
+	defer catchError(&err)
+	return tl.get(id), nil
 }
 
-func (tl *Tasklist) Get(id string) *Entry {
+func (tl *Tasklist) get(id string) *Entry {
 	stmt, serr := tl.conn.Prepare(SELECT_HEADER + "WHERE tasks.id = ? GROUP BY tasks.id")
 	Must(serr)
 	defer stmt.Finalize()
 	Must(stmt.Exec(id))
 
 	if !stmt.Next() {
-		panic(fmt.Sprintf("Couldn't find request entry at Tasklist.Get"))
+		panic(MakeNotFoundError("Couldn't find entry %s", id))
 	}
 
 	entry, err := StatementScan(stmt, true)
 	Must(err)
 
 	entry.SetId(id)
+	tl.openSecret(entry)
 
 	return entry
 }
 
-func (tl *Tasklist) Explode(id string) {
-	entry := tl.Get(id)
-	childs := explodeBody(entry.Text(), entry.Id())
+func (tl *Tasklist) Explode(id string) (err error) {
+	defer catchError(&err)
+	entry := tl.get(id)
+	if IsEncrypted(entry.Text()) {
+		panic(MakeParseError("Can not explode encrypted text, unlock the tasklist first"))
+	}
+	childs := explodeBody(entry.Text())
 	entry.SetText("")
-	tl.Update(entry, false)
-	for i := range childs {
-		childs[i].SetId(tl.MakeRandomId())
-		tl.Add(childs[i])
+	tl.checkOutline(childs)
+	written := map[*Entry]bool{}
+	tl.WithTransaction(func() {
+		written[entry] = tl.rewrite(entry, false, "update")
+		tl.addOutline(entry.Id(), len(tl.GetChildren(entry.Id())), childs, written)
+	})
+	for e, completed := range written {
+		tl.afterUpdate(e, completed)
 	}
+	return nil
 }
 
 func (tl *Tasklist) GetListEx(stmt *sqlite.Stmt, code string, incsub bool, sortCols []string) ([]*Entry, error) {
@@ -385,6 +536,7 @@ func (tl *Tasklist) GetListEx(stmt *sqlite.Stmt, code string, incsub bool, sortC
 	for stmt.Next() {
 		entry, scanerr := StatementScan(stmt, true)
 		Must(scanerr)
+		tl.openSecret(entry)
 
 		if code != "" {
 			if cerr := tl.CallLuaFunction(SEARCHFUNCTION, entry); cerr != nil {
@@ -392,16 +544,16 @@ func (tl *Tasklist) GetListEx(stmt *sqlite.Stmt, code string, incsub bool, sortC
 			}
 
 			if tl.luaFlags.remove {
-				tl.Remove(entry.Id())
+				tl.remove(entry.Id())
 			}
 
 			if tl.luaFlags.persist {
 				if !tl.luaFlags.remove && tl.luaFlags.cursorEdited {
-					tl.Update(entry, false)
+					tl.update(entry, false)
 				}
 				if tl.luaFlags.cursorCloned {
 					newentry := GetEntryFromLua(tl.luaState, CURSOR, "%internal%")
-					tl.Add(newentry)
+					tl.add(newentry)
 				}
 			}
 
@@ -427,10 +579,9 @@ func (tl *Tasklist) GetListEx(stmt *sqlite.Stmt, code string, incsub bool, sortC
 	}
 
 	sort.SliceStable(v, func(i, j int) bool {
-		colsi, colsj := v[i].Columns(), v[j].Columns()
 		for k := range sortCols {
-			ci := colsi[sortCols[k]]
-			cj := colsj[sortCols[k]]
+			ci := v[i].SortKey(sortCols[k])
+			cj := v[j].SortKey(sortCols[k])
 			if ci != cj {
 				return ci < cj
 			}
@@ -441,7 +592,8 @@ func (tl *Tasklist) GetListEx(stmt *sqlite.Stmt, code string, incsub bool, sortC
 	return v, err
 }
 
-func (tl *Tasklist) Retrieve(theselect, code string, incsub bool, sortCols []string) ([]*Entry, error) {
+func (tl *Tasklist) Retrieve(theselect, code string, incsub bool, sortCols []string) (v []*Entry, err error) {
+	defer catchError(&err)
 	stmt, serr := tl.conn.Prepare(theselect)
 	Must(serr)
 	defer stmt.Finalize()
@@ -553,9 +705,13 @@ func (tl *Tasklist) GetPrivateSetting(name string) string {
 	return value
 }
 
-func (tl *Tasklist) GetTimezone() int {
-	r, _ := strconv.Atoi(tl.GetSetting("timezone"))
-	return r
+func (tl *Tasklist) GetTimezone() *time.Location {
+	loc, err := ParseTimezone(tl.GetSetting("timezone"))
+	if err != nil {
+		Logf(ERROR, "Invalid timezone setting for %s: %s\n", tl.filename, err)
+		return time.UTC
+	}
+	return loc
 }
 
 func (tl *Tasklist) GetSettings() (r map[string]string) {
@@ -577,7 +733,7 @@ func (tl *Tasklist) GetSettings() (r map[string]string) {
 func (tl *Tasklist) GetTags() []string {
 	r := make([]string, 0)
 
-	stmt, serr := tl.conn.Prepare("SELECT DISTINCT name FROM columns WHERE value = ''")
+	stmt, serr := tl.conn.Prepare("SELECT DISTINCT name FROM columns WHERE value = '' AND id IN (SELECT id FROM tasks WHERE trashed_at = 0)")
 	Must(serr)
 	defer stmt.Finalize()
 	Must(stmt.Exec())
@@ -593,37 +749,97 @@ func (tl *Tasklist) GetTags() []string {
 	return r
 }
 
-func (tl *Tasklist) SetSetting(name, value string) {
+func checkSetting(name, value string) {
+	if name == "timezone" {
+		_, err := ParseTimezone(value)
+		Must(err)
+	}
+}
+
+func (tl *Tasklist) SetSetting(name, value string) (err error) {
+	defer catchError(&err)
+	checkSetting(name, value)
 	tl.MustExec("INSERT OR REPLACE INTO settings(name, value) VALUES (?, ?);", name, value)
+	if name == "secrettag" {
+		forgetSecretText(tl.conn)
+	}
+	return nil
 }
 
-func (tl *Tasklist) SetPrivateSetting(name, value string) {
+func (tl *Tasklist) SetPrivateSetting(name, value string) (err error) {
+	defer catchError(&err)
 	tl.MustExec("INSERT OR REPLACE INTO private_settings(name, value) VALUES (?, ?);", name, value)
+	return nil
 }
 
-func (tl *Tasklist) SetSettings(settings map[string]string) {
+func (tl *Tasklist) SetSettings(settings map[string]string) (err error) {
+	defer catchError(&err)
+	for k, v := range settings {
+		checkSetting(k, v)
+	}
 	for k, v := range settings {
 		Logf(INFO, "Saving %s to %s\n", v, k)
 		tl.MustExec("INSERT OR REPLACE INTO settings(name, value) VALUES (?, ?);", k, v)
 	}
+	if _, ok := settings["secrettag"]; ok {
+		forgetSecretText(tl.conn)
+	}
+	return nil
 }
 
-func (tl *Tasklist) RenameTag(src, dst string) {
+func (tl *Tasklist) RenameTag(src, dst string) (err error) {
+	defer catchError(&err)
 	if isQuickTagStart(rune(src[0])) {
 		src = src[1:len(src)]
 	}
 	if isQuickTagStart(rune(dst[0])) {
 		dst = dst[1:len(dst)]
 	}
-	tl.MustExec("UPDATE columns SET name = ? WHERE name = ?", dst, src)
+	tl.WithTransaction(func() {
+		tl.MustExec("UPDATE columns SET name = ? WHERE name = ?", dst, src)
+		tl.MustExec("UPDATE OR REPLACE coltypes SET name = ? WHERE name = ?", dst, src)
+		tl.MustExec("UPDATE OR REPLACE coltypes SET tag = ? WHERE tag = ?", dst, src)
+		for _, ct := range tl.columnTypes() {
+			if ct.Column == dst || ct.Tag == dst {
+				tl.retypeColumn(ct.Column)
+			}
+		}
+		tl.retypeColumn(dst)
+	})
+	return nil
+}
+
+// Changes the id of src to dst, keeping its subitems, attachments, links, time log, reminders and history
+func (tl *Tasklist) RenameEntry(src, dst string) (err error) {
+	defer catchError(&err)
+	if !tl.Exists(src) && !tl.isTrashed(src) {
+		panic(MakeNotFoundError("Couldn't find entry %s", src))
+	}
+	if tl.Exists(dst) || tl.isTrashed(dst) {
+		panic(MakeParseError(fmt.Sprintf("An entry with id %s already exists", dst)))
+	}
+	tl.WithTransaction(func() {
+		tl.MustExec("UPDATE tasks SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE columns SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE columns SET name = ? WHERE name = ?", "sub/"+dst, "sub/"+src)
+		tl.MustExec("UPDATE attachments SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE links SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE links SET target = ? WHERE target = ?", dst, src)
+		tl.MustExec("UPDATE timelog SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE reminders SET id = ? WHERE id = ?", dst, src)
+		tl.MustExec("UPDATE history SET id = ? WHERE id = ?", dst, src)
+	})
+	return nil
 }
 
 func (tl *Tasklist) RunTimedTriggers() {
-	stmt, serr := tl.conn.Prepare(SELECT_HEADER + "WHERE tasks.trigger_at_field < ? AND tasks.priority = ? GROUP BY id")
+	stmt, serr := tl.conn.Prepare(SELECT_HEADER + "WHERE tasks.trigger_at_field < ? AND tasks.priority = ? AND tasks.trashed_at = 0 GROUP BY id")
 	Must(serr)
 	defer stmt.Finalize()
 
-	Must(stmt.Exec(time.Now().Format("2006-01-02 15:04:05"), TIMED))
+	Must(stmt.Exec(time.Now().UTC().Format("2006-01-02 15:04:05"), TIMED))
+
+	timezone := tl.GetTimezone()
 
 	for stmt.Next() {
 		entry, scanerr := StatementScan(stmt, true)
@@ -641,7 +857,7 @@ func (tl *Tasklist) RunTimedTriggers() {
 			tl.DoString(triggerCode, entry)
 
 			if tl.luaFlags.remove {
-				tl.Remove(entry.Id())
+				tl.remove(entry.Id())
 				update = false
 			}
 
@@ -649,13 +865,13 @@ func (tl *Tasklist) RunTimedTriggers() {
 				if tl.luaFlags.cursorCloned {
 					newentry := GetEntryFromLua(tl.luaState, CURSOR, "%internal%")
 					Logf(INFO, "Cloned, the clone id is: %s\n", newentry.Id())
-					tl.Add(newentry)
+					tl.add(newentry)
 					checkFreq = false
 				}
 
 				if !tl.luaFlags.remove && tl.luaFlags.cursorEdited {
 					entry.SetPriority(NOW)
-					tl.Update(entry, false)
+					tl.update(entry, false)
 					update = false
 				}
 			}
@@ -663,26 +879,29 @@ func (tl *Tasklist) RunTimedTriggers() {
 		}
 
 		if checkFreq {
-			freq := entry.Freq()
+			Logf(INFO, "Triggering: %v %v %v\n", entry.Id(), entry.TriggerAt(), entry.Column("recur"))
 
-			Logf(INFO, "Triggering: %v %v %v\n", entry.Id(), entry.TriggerAt(), freq)
-
-			if freq > 0 {
-				tl.Add(entry.NextEntry(tl.MakeRandomId()))
+			// rules that recur after completion are handled by updateEx
+			if r := entry.Recurrence(timezone); r != nil && !r.AfterCompletion {
+				if next := entry.NextEntry(tl.MakeRandomId(), timezone); next != nil {
+					tl.add(next)
+				}
 			}
 		}
 
 		if update {
-			tl.MustExec("UPDATE tasks SET priority = ? WHERE id = ?", NOW, entry.Id())
+			tl.saveRevision(entry.Id(), "trigger")
+			tl.MustExec("UPDATE tasks SET priority = ?, modified_at = ? WHERE id = ?", NOW, time.Now().UTC().Format("2006-01-02 15:04:05"), entry.Id())
 		}
 	}
 }
 
-func (tl *Tasklist) UpgradePriority(id string, special bool) Priority {
-	entry := tl.Get(id)
+func (tl *Tasklist) UpgradePriority(id string, special bool) (p Priority, err error) {
+	defer catchError(&err)
+	entry := tl.get(id)
 	simpleUpdate := entry.UpgradePriority(special)
-	tl.Update(entry, simpleUpdate)
-	return entry.Priority()
+	tl.update(entry, simpleUpdate)
+	return entry.Priority(), nil
 }
 
 type Statistic struct {
@@ -710,9 +929,9 @@ func (tl *Tasklist) GetStatistic(tag string) *Statistic {
 	var stmt *sqlite.Stmt
 	var err error
 	if tag == "" {
-		stmt, err = tl.conn.Prepare("SELECT priority, count(priority) FROM tasks GROUP BY priority")
+		stmt, err = tl.conn.Prepare("SELECT priority, count(priority) FROM tasks WHERE trashed_at = 0 GROUP BY priority")
 	} else {
-		stmt, err = tl.conn.Prepare("SELECT priority, count(priority) FROM tasks WHERE id IN (SELECT id FROM columns WHERE name = ?) GROUP BY priority")
+		stmt, err = tl.conn.Prepare("SELECT priority, count(priority) FROM tasks WHERE trashed_at = 0 AND id IN (SELECT id FROM columns WHERE name = ?) GROUP BY priority")
 	}
 	Must(err)
 	defer stmt.Finalize()
@@ -855,6 +1074,8 @@ func (tl *Tasklist) OntoCheck(debug bool) []OntoCheckError {
 	}
 
 	unk := 0
+	decls := tl.columnTypes()
+	timezone := tl.GetTimezone()
 
 	for _, entry := range v {
 		result := DOES_NOT_APPLY
@@ -888,6 +1109,8 @@ func (tl *Tasklist) OntoCheck(debug bool) []OntoCheckError {
 		if result == MATCH_FAIL {
 			errors = append(errors, OntoCheckError{entry, failAt, failWith})
 		}
+
+		errors = append(errors, columnTypeErrors(entry, decls, timezone)...)
 	}
 
 	if debug {
@@ -927,19 +1150,7 @@ func (tl *Tasklist) CategoryDepth() map[string]int {
 }
 
 func (tl *Tasklist) GetChildren(id string) []string {
-	stmt, serr := tl.conn.Prepare("select id from columns where name = ? order by cast(value as int) asc")
-	Must(serr)
-	defer stmt.Finalize()
-	serr = stmt.Exec("sub/" + id)
-	Must(serr)
-
-	r := []string{}
-	for stmt.Next() {
-		var x string
-		Must(stmt.Scan(&x))
-		r = append(r, x)
-	}
-	return r
+	return tl.getChildrenEx(id, false)
 }
 
 func (tl *Tasklist) UpdateChildren(pid string, childs []string) {
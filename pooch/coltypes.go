@@ -0,0 +1,345 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ Columns can be declared to have one of these types:
+
+	number		a decimal number
+	date		anything accepted as the date of an entry
+	duration	a sequence of numbers followed by w, d, h, m or s (1h30m)
+	enum:a,b,c	one of the listed values, ordered as listed
+	text		any value, the default
+
+ A declaration can be scoped to a tag, in which case it only applies to
+ entries that have the tag and takes precedence over the unscoped one.
+ Values are checked when entries are saved and a typed copy of each value
+ (the number, the unix time of the date, the seconds of the duration or
+ the index of the enum value) is stored in columns.typed_value, which is
+ what searches compare against.
+*/
+
+const (
+	COLTYPE_NUMBER   = "number"
+	COLTYPE_DATE     = "date"
+	COLTYPE_DURATION = "duration"
+	COLTYPE_ENUM     = "enum"
+	COLTYPE_TEXT     = "text"
+)
+
+type ColumnType struct {
+	Column string
+	// Empty if the declaration applies to every entry
+	Tag    string
+	Type   string
+	Values []string
+}
+
+func ParseColumnType(column, tag, spec string) (*ColumnType, error) {
+	ct := &ColumnType{Column: column, Tag: tag}
+	v := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	ct.Type = strings.ToLower(v[0])
+
+	switch ct.Type {
+	case COLTYPE_NUMBER, COLTYPE_DATE, COLTYPE_DURATION, COLTYPE_TEXT:
+		if len(v) > 1 {
+			return nil, MakeParseError(fmt.Sprintf("Column type %s doesn't take values", ct.Type))
+		}
+	case COLTYPE_ENUM:
+		if len(v) > 1 {
+			for _, value := range strings.Split(v[1], ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					ct.Values = append(ct.Values, value)
+				}
+			}
+		}
+		if len(ct.Values) == 0 {
+			return nil, MakeParseError("Enum columns need a list of values (enum:a,b,c)")
+		}
+	default:
+		return nil, MakeParseError(fmt.Sprintf("Unknown column type %s (must be one of %s, %s, %s, %s, %s)", ct.Type, COLTYPE_NUMBER, COLTYPE_DATE, COLTYPE_DURATION, COLTYPE_ENUM, COLTYPE_TEXT))
+	}
+
+	return ct, nil
+}
+
+func (ct *ColumnType) String() string {
+	if ct.Type == COLTYPE_ENUM {
+		return ct.Type + ":" + strings.Join(ct.Values, ",")
+	}
+	return ct.Type
+}
+
+var durationRE *regexp.Regexp = regexp.MustCompile("^([0-9]+(?:\\.[0-9]+)?) *(w|d|h|m|s)")
+
+// Returns the number of seconds of a duration like 1h30m or 2d
+func ParseColumnDuration(value string) (float64, error) {
+	rest := strings.ToLower(strings.TrimSpace(value))
+	if rest == "" {
+		return 0, MakeParseError("Empty duration")
+	}
+
+	r := 0.0
+	for rest != "" {
+		m := durationRE.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, MakeParseError(fmt.Sprintf("Not a duration: %s", value))
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		switch m[2] {
+		case "w":
+			n *= 7 * 24 * 3600
+		case "d":
+			n *= 24 * 3600
+		case "h":
+			n *= 3600
+		case "m":
+			n *= 60
+		}
+		r += n
+		rest = strings.TrimSpace(rest[len(m[0]):])
+	}
+	return r, nil
+}
+
+// Converts value to the value stored in typed_value, returns false for text columns
+func (ct *ColumnType) TypedValue(value string, timezone *time.Location) (float64, bool, error) {
+	value = strings.TrimSpace(value)
+
+	switch ct.Type {
+	case COLTYPE_NUMBER:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false, MakeParseError(fmt.Sprintf("Not a number: %s", value))
+		}
+		return n, true, nil
+
+	case COLTYPE_DATE:
+		t, err := ParseDateTime(value, timezone)
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(t.Unix()), true, nil
+
+	case COLTYPE_DURATION:
+		n, err := ParseColumnDuration(value)
+		return n, err == nil, err
+
+	case COLTYPE_ENUM:
+		for i, x := range ct.Values {
+			if strings.EqualFold(x, value) {
+				return float64(i), true, nil
+			}
+		}
+		return 0, false, MakeParseError(fmt.Sprintf("%s is not one of %s", value, strings.Join(ct.Values, ", ")))
+	}
+
+	return 0, false, nil
+}
+
+func (tl *Tasklist) DeclareColumnType(column, spec, tag string) (err error) {
+	defer catchError(&err)
+	ct, err := ParseColumnType(column, tag, spec)
+	Must(err)
+	tl.WithTransaction(func() {
+		tl.MustExec("INSERT OR REPLACE INTO coltypes(name, tag, type) VALUES (?, ?, ?)", column, tag, ct.String())
+		tl.retypeColumn(column)
+	})
+	return nil
+}
+
+func (tl *Tasklist) RemoveColumnType(column, tag string) (err error) {
+	defer catchError(&err)
+	tl.WithTransaction(func() {
+		tl.MustExec("DELETE FROM coltypes WHERE name = ? AND tag = ?", column, tag)
+		tl.retypeColumn(column)
+	})
+	return nil
+}
+
+func (tl *Tasklist) ColumnTypes() (r []*ColumnType, err error) {
+	defer catchError(&err)
+	return tl.columnTypes(), nil
+}
+
+func (tl *Tasklist) columnTypes() []*ColumnType {
+	stmt, serr := tl.conn.Prepare("SELECT name, tag, type FROM coltypes ORDER BY name, tag")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec())
+
+	r := []*ColumnType{}
+	for stmt.Next() {
+		var name, tag, spec string
+		Must(stmt.Scan(&name, &tag, &spec))
+		ct, err := ParseColumnType(name, tag, spec)
+		if err != nil {
+			Logf(WARN, "Ignoring type of column %s: %s\n", name, err)
+			continue
+		}
+		r = append(r, ct)
+	}
+	return r
+}
+
+// Returns the declaration that applies to column of an entry that has the tags accepted by hasTag, nil if there isn't one
+func columnTypeFor(decls []*ColumnType, column string, hasTag func(tag string) bool) *ColumnType {
+	var r *ColumnType
+	for _, ct := range decls {
+		if ct.Column != column {
+			continue
+		}
+		if ct.Tag == "" {
+			if r == nil {
+				r = ct
+			}
+		} else if hasTag(ct.Tag) {
+			return ct
+		}
+	}
+	return r
+}
+
+func entryHasTag(e *Entry) func(string) bool {
+	return func(tag string) bool {
+		_, ok := e.Columns()[tag]
+		return ok
+	}
+}
+
+// Checks that the columns of e have values of their declared type
+func (tl *Tasklist) checkColumnTypes(e *Entry) {
+	decls := tl.columnTypes()
+	if len(decls) == 0 {
+		return
+	}
+	if errs := columnTypeErrors(e, decls, tl.GetTimezone()); len(errs) > 0 {
+		panic(MakeParseError(fmt.Sprintf("Column %s %s", errs[0].ProblemCategory, errs[0].ProblemDetail)))
+	}
+}
+
+// Returns one error for each column of e that violates its declared type
+func columnTypeErrors(e *Entry, decls []*ColumnType, timezone *time.Location) []OntoCheckError {
+	names := []string{}
+	for name := range e.Columns() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := []OntoCheckError{}
+	for _, name := range names {
+		value := e.Columns()[name]
+		ct := columnTypeFor(decls, name, entryHasTag(e))
+		if ct == nil || value == "" {
+			continue
+		}
+		if _, _, err := ct.TypedValue(value, timezone); err != nil {
+			r = append(r, OntoCheckError{e, name, fmt.Sprintf("must be a %s: %s", ct.Type, err)})
+		}
+	}
+	return r
+}
+
+// Returns value_type and typed_value of a column, both are empty for untyped columns.
+// An empty typed_value is stored as NULL.
+func columnTypedValue(ct *ColumnType, value string, timezone *time.Location) (string, string) {
+	if ct == nil {
+		return "", ""
+	}
+	n, ok, err := ct.TypedValue(value, timezone)
+	if !ok || err != nil {
+		return ct.String(), ""
+	}
+	return ct.String(), formatTypedValue(n)
+}
+
+// Recomputes the typed values of column after a change to its declarations
+func (tl *Tasklist) retypeColumn(column string) {
+	decls := tl.columnTypes()
+	timezone := tl.GetTimezone()
+
+	tagged := map[string]map[string]bool{}
+	for _, ct := range decls {
+		if ct.Column == column && ct.Tag != "" {
+			tagged[ct.Tag] = map[string]bool{}
+			for _, id := range tl.queryIds("SELECT id FROM columns WHERE name = ?", ct.Tag) {
+				tagged[ct.Tag][id] = true
+			}
+		}
+	}
+
+	type row struct{ id, value string }
+	rows := []row{}
+	stmt, serr := tl.conn.Prepare("SELECT id, value FROM columns WHERE name = ?")
+	Must(serr)
+	Must(stmt.Exec(column))
+	for stmt.Next() {
+		var r row
+		Must(stmt.Scan(&r.id, &r.value))
+		rows = append(rows, r)
+	}
+	stmt.Finalize()
+
+	for _, r := range rows {
+		ct := columnTypeFor(decls, column, func(tag string) bool { return tagged[tag][r.id] })
+		valueType, typedValue := columnTypedValue(ct, r.value, timezone)
+		tl.MustExec("UPDATE columns SET value_type = ?, typed_value = NULLIF(?, '') WHERE id = ? AND name = ?", valueType, typedValue, r.id, column)
+	}
+}
+
+func formatTypedValue(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+// Returns the clause comparing column with value using the declared types of column, an empty string if it has none.
+// Declarations that value can't be converted to are skipped, it's an error only if none can
+func (tl *Tasklist) typedColumnClause(column, sqlop, value string) string {
+	if sqlop == "LIKE" || sqlop == "NOT LIKE" {
+		return ""
+	}
+
+	timezone := tl.GetTimezone()
+	seen := map[string]bool{}
+	typed := []string{}
+	clauses := []string{}
+	var convErr error
+
+	for _, ct := range tl.columnTypes() {
+		if ct.Column != column || ct.Type == COLTYPE_TEXT || seen[ct.String()] {
+			continue
+		}
+		seen[ct.String()] = true
+		typed = append(typed, tl.Quote(ct.String()))
+		n, _, err := ct.TypedValue(value, timezone)
+		if err != nil {
+			// values of this type can't match
+			convErr = err
+			continue
+		}
+		clauses = append(clauses, fmt.Sprintf("(value_type = %s AND typed_value %s %s)", tl.Quote(ct.String()), sqlop, formatTypedValue(n)))
+	}
+
+	if len(typed) == 0 {
+		return ""
+	}
+	if len(clauses) == 0 {
+		// value can't be converted to any of the declared types
+		panic(convErr)
+	}
+
+	// values without a type are still compared as text
+	clauses = append(clauses, fmt.Sprintf("(value_type NOT IN (%s) AND value %s %s)", strings.Join(typed, ", "), sqlop, tl.Quote(value)))
+	return fmt.Sprintf("SELECT id FROM columns WHERE name = %s AND (%s)", tl.Quote(column), strings.Join(clauses, " OR "))
+}
@@ -0,0 +1,235 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+ CSV files are imported by mapping the columns named in their header row to
+ fields of the new entries:
+
+	title		title of the entry (required)
+	text		text of the entry
+	priority	now, later, notes, sticky, timed or done (default: timed if
+			the entry has a time, now otherwise)
+	when		time of the entry, any format accepted by the parser
+	sort		sort key (default: calculated from the time)
+	tag		tags, separated by spaces or commas
+	anything else	a column with that name
+
+ Every row is checked before the tasklist is changed, if any row is wrong
+ nothing is imported and the error lists all the wrong rows with their line
+ number. The entries are added in a single transaction.
+*/
+
+/*
+ Parses mapping arguments in the form <csv column>=<target>, returns the
+ target of each csv column
+*/
+func ParseCsvMapping(args []string) (map[string]string, error) {
+	mapping := map[string]string{}
+	hasTitle := false
+	for _, arg := range args {
+		v := strings.SplitN(arg, "=", 2)
+		if len(v) != 2 || strings.TrimSpace(v[0]) == "" || strings.TrimSpace(v[1]) == "" {
+			return nil, MakeParseError(fmt.Sprintf("Wrong mapping %s, should be <csv column>=<target>", arg))
+		}
+		target := strings.TrimSpace(v[1])
+		if target == "title" {
+			if hasTitle {
+				return nil, MakeParseError("Only one csv column can be mapped to title")
+			}
+			hasTitle = true
+		}
+		if strings.ContainsAny(target, " \t#") || strings.HasPrefix(target, "sub/") {
+			return nil, MakeParseError(fmt.Sprintf("Wrong target %s for csv column %s", target, v[0]))
+		}
+		mapping[strings.TrimSpace(v[0])] = target
+	}
+	if !hasTitle {
+		return nil, MakeParseError("No csv column is mapped to title")
+	}
+	return mapping, nil
+}
+
+// Returns the entry for a row of the csv file, header has the name of the csv columns
+func (tl *Tasklist) csvEntry(header []string, row []string, mapping map[string]string, extraCols Columns) (*Entry, error) {
+	timezone := tl.GetTimezone()
+	priority := INVALID
+	cols := Columns{}
+	for k, v := range extraCols {
+		cols[k] = v
+	}
+	e := MakeEntry("", "", "", NOW, nil, "", cols)
+
+	for i, name := range header {
+		target, ok := mapping[name]
+		if !ok || i >= len(row) {
+			continue
+		}
+		value := strings.TrimSpace(row[i])
+
+		switch target {
+		case "title":
+			e.SetTitle(value)
+		case "text":
+			e.SetText(row[i])
+		case "priority":
+			if value == "" {
+				continue
+			}
+			if priority = ParsePriority(strings.ToLower(value)); priority == INVALID {
+				return nil, MakeParseError(fmt.Sprintf("wrong priority %q in column %s", value, name))
+			}
+		case "when":
+			if value == "" {
+				continue
+			}
+			triggerAt, err := ParseDateTime(value, timezone)
+			if err != nil {
+				return nil, MakeParseError(fmt.Sprintf("wrong time %q in column %s", value, name))
+			}
+			e.SetTriggerAt(triggerAt)
+		case "sort":
+			e.SetSort(value)
+		case "tag":
+			for _, tag := range strings.FieldsFunc(value, func(ch rune) bool { return ch == ',' || ch == ' ' || ch == '\t' }) {
+				cols[strings.TrimPrefix(tag, "#")] = ""
+			}
+		default:
+			if value != "" {
+				cols[target] = value
+			}
+		}
+	}
+
+	if e.Title() == "" {
+		return nil, MakeParseError("empty title")
+	}
+
+	switch {
+	case priority == INVALID && e.TriggerAt() != nil:
+		priority = TIMED
+	case priority == INVALID:
+		priority = NOW
+	case priority == TIMED && e.TriggerAt() == nil:
+		return nil, MakeParseError("timed entry without a time")
+	}
+	e.SetPriority(priority)
+
+	if e.Sort() == "" {
+		e.SetSort(SortFromTriggerAt(e.TriggerAt(), tl.GetSetting("defaultsorttime") == "1"))
+	}
+
+	tl.ExpandColumnsFromOntology(cols)
+	setUncat(cols)
+
+	if err := func() (err error) {
+		defer catchError(&err)
+		checkRecurrence(e, timezone)
+		checkReminders(e, timezone)
+		tl.checkColumnTypes(e)
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+/*
+ Reads the csv file in r (with fields separated by sep) and adds one entry
+ for each row, with the columns of queryText (see importColumns). If dryRun
+ is true the tasklist isn't changed. Returns the entries, without ids if
+ dryRun is true.
+*/
+func (tl *Tasklist) ImportCSV(r io.Reader, sep rune, mapping map[string]string, queryText string, dryRun bool) (entries []*Entry, err error) {
+	defer catchError(&err)
+
+	in := csv.NewReader(r)
+	in.Comma = sep
+	in.FieldsPerRecord = -1
+
+	header, err := in.Read()
+	if err == io.EOF {
+		panic(MakeParseError("Empty csv file"))
+	}
+	Must(err)
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	for name := range mapping {
+		found := false
+		for _, h := range header {
+			if h == name {
+				found = true
+			}
+		}
+		if !found {
+			panic(MakeParseError(fmt.Sprintf("Column %s is not in the header of the csv file", name)))
+		}
+	}
+
+	extraCols := tl.importColumns(queryText)
+
+	errors := []string{}
+	for {
+		row, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the csv reader can't continue after a syntax error
+			errors = append(errors, err.Error())
+			break
+		}
+		line, _ := in.FieldPos(0)
+
+		empty := true
+		for _, v := range row {
+			if strings.TrimSpace(v) != "" {
+				empty = false
+			}
+		}
+		if empty {
+			continue
+		}
+
+		e, err := tl.csvEntry(header, row, mapping, extraCols)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("line %d: %s", line, err.Error()))
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if len(errors) > 0 {
+		panic(MakeParseError("Nothing imported, wrong csv file:\n" + strings.Join(errors, "\n")))
+	}
+
+	if dryRun {
+		return entries, nil
+	}
+
+	tl.WithTransaction(func() {
+		for _, e := range entries {
+			e.SetId(tl.MakeRandomId())
+			tl.insert(e)
+		}
+	})
+
+	for _, e := range entries {
+		tl.notifyScheduler(e)
+	}
+
+	return entries, nil
+}
@@ -24,11 +24,10 @@ func WithOpenDefault(rest func(tl *Tasklist)) {
 	if dbname == "" {
 		panic("POOCHDB Not Set")
 	}
-	tl := OpenOrCreate(dbname)
+	tl, err := OpenOrCreate(dbname)
+	Must(err)
 	defer tl.Close()
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-	rest(tl)
+	tl.withLock(func() { rest(tl) })
 }
 
 func SearchFile(name string) (outname string, found bool) {
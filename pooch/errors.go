@@ -0,0 +1,107 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+/*
+ Errors returned by the exported methods of Tasklist that have an error
+ result, use errors.Is to check which kind of error was returned:
+
+	ErrNotFound	the requested entry (or revision) doesn't exist
+	ErrParse	the query or entry couldn't be parsed (see ParseError)
+	ErrLua		lua code failed (see LuaIntError)
+	ErrStorage	the database couldn't be read or written (see StorageError)
+
+ Internally the backend still reports errors by panicking, exported methods
+ with an error result convert those panics into errors with catchError.
+
+ The exported methods without an error result can panic instead:
+ the lua interface (CallLuaFunction, DoString, DoStringNoLock, DoRunString,
+ LuaResultToEntries, ResetLuaFlags, SetEntryInLua, SetTasklistInLua,
+ ShowReturnValueRequest), the parser (ParseEx, ParseNew, ExtendedAddParse,
+ Quote), settings and saved searches (GetSetting, GetSettings,
+ GetPrivateSetting, GetSavedSearch, GetSavedSearches, GetTimezone),
+ ontology and statistics (GetOntology, OntoCheck, ExpandColumnsFromOntology,
+ CategoryDepth, CountCategoryItems, GetStatistic, GetStatistics, GetTags),
+ and Exists, GetChildren, GetListEx, CloneEntry, ExplainRetrieve, LogError,
+ MakeRandomId, RetrieveErrors, RunTimedTriggers, SortFromSubitems,
+ UpdateChildren, Truncate, Close, MustExec and WithTransaction. Callers
+ outside of the package must use them inside a function that recovers (like
+ the http handlers and the commands of the pooch program do). New exported
+ methods must return an error instead.
+*/
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrParse    = errors.New("parse error")
+	ErrLua      = errors.New("lua error")
+	ErrStorage  = errors.New("storage error")
+)
+
+type NotFoundError struct {
+	message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.message
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func MakeNotFoundError(format string, a ...interface{}) error {
+	return &NotFoundError{fmt.Sprintf(format, a...)}
+}
+
+type StorageError struct {
+	err error
+}
+
+func (e *StorageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.err
+}
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrStorage
+}
+
+func isTypedError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrParse) || errors.Is(err, ErrLua) || errors.Is(err, ErrStorage)
+}
+
+// Converts the value of a recovered panic into one of the errors above,
+// anything that isn't already typed is considered a storage error.
+// Runtime errors are bugs and are not converted.
+func panicToError(rerr interface{}) error {
+	switch e := rerr.(type) {
+	case runtime.Error:
+		panic(e)
+	case error:
+		if isTypedError(e) {
+			return e
+		}
+		return &StorageError{e}
+	default:
+		return &StorageError{fmt.Errorf("%v", e)}
+	}
+}
+
+// To be deferred by exported methods, stores the converted panic in *err
+func catchError(err *error) {
+	if rerr := recover(); rerr != nil {
+		*err = panicToError(rerr)
+	}
+}
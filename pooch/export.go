@@ -0,0 +1,318 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+/*
+ Export format (version 1), a single JSON object:
+
+	Format		always "pooch-export"
+	Version		1
+	Entries		list of entries, including the ones in the trash:
+		Id, Title, Text
+		Priority	number, as stored (see Priority)
+		TriggerAt	"2006-01-02 15:04:05" in UTC, empty if not set
+		Sort
+		CreatedAt	"2006-01-02 15:04:05" in UTC
+		ModifiedAt	"2006-01-02 15:04:05" in UTC
+		TrashedAt	unix time when the entry was removed, 0 if it wasn't
+		Columns		object, name -> value, includes the sub/<id>
+				columns that order subitems
+	SavedSearches	object, name -> query
+	Settings	object, name -> value (includes setup and ontology)
+	PrivateSettings	object, name -> value, only secret_salt and
+			secret_check (see secret.go) unless the export was
+			made with private set
+	ColumnTypes	list of Column, Tag, Type (see coltypes.go)
+	Links		list of Id, Type, Target, as stored (see links.go)
+	Attachments	list of Id, Name, ContentType, CreatedAt, Data (base64)
+	TimeLog		list of Id, StartedAt, StoppedAt (see timetrack.go)
+
+ Private settings contain credentials (notify_smtp_password, api_token) and
+ commands (notify_command) that are run by the program, they are only
+ exported and imported when asked for.
+
+ Revision history, reminder deliveries and the error log are not exported.
+ Fields added by later versions must be optional, so that older exports
+ can still be imported.
+*/
+
+const (
+	EXPORT_FORMAT  = "pooch-export"
+	EXPORT_VERSION = 1
+)
+
+type ExportEntry struct {
+	Id         string
+	Title      string
+	Text       string
+	Priority   int
+	TriggerAt  string
+	Sort       string
+	CreatedAt  string
+	ModifiedAt string
+	TrashedAt  int64
+	Columns    map[string]string
+}
+
+type ExportColumnType struct {
+	Column string
+	Tag    string
+	Type   string
+}
+
+type ExportLink struct {
+	Id     string
+	Type   string
+	Target string
+}
+
+type ExportAttachment struct {
+	Id          string
+	Name        string
+	ContentType string
+	CreatedAt   string
+	Data        []byte
+}
+
+type ExportTimeInterval struct {
+	Id        string
+	StartedAt string
+	StoppedAt string
+}
+
+type Export struct {
+	Format          string
+	Version         int
+	Entries         []*ExportEntry
+	SavedSearches   map[string]string
+	Settings        map[string]string
+	PrivateSettings map[string]string
+	ColumnTypes     []*ExportColumnType
+	Links           []*ExportLink
+	Attachments     []*ExportAttachment
+	TimeLog         []*ExportTimeInterval
+}
+
+// Calls fn for every row returned by query, scan should be passed to stmt.Scan
+func (tl *Tasklist) forRows(query string, fn func(scan func(dst ...interface{}))) {
+	stmt, serr := tl.conn.Prepare(query)
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec())
+	for stmt.Next() {
+		fn(func(dst ...interface{}) { Must(stmt.Scan(dst...)) })
+	}
+}
+
+func (tl *Tasklist) stringMap(query string) map[string]string {
+	r := map[string]string{}
+	tl.forRows(query, func(scan func(dst ...interface{})) {
+		var k, v string
+		scan(&k, &v)
+		r[k] = v
+	})
+	return r
+}
+
+// Private settings that are always exported, they don't contain the passphrase and are needed to decrypt secret entries
+var portablePrivateSettings = map[string]bool{"secret_salt": true, "secret_check": true}
+
+// Exports the tasklist, private settings other than portablePrivateSettings are only included if private is true
+func (tl *Tasklist) Export(private bool) (ex *Export, err error) {
+	defer catchError(&err)
+
+	ex = &Export{Format: EXPORT_FORMAT, Version: EXPORT_VERSION}
+
+	entries := map[string]*ExportEntry{}
+	ex.Entries = []*ExportEntry{}
+	tl.forRows("SELECT id, title_field, text_field, priority, trigger_at_field, sort, created_at, modified_at, trashed_at FROM tasks ORDER BY id", func(scan func(dst ...interface{})) {
+		e := &ExportEntry{Columns: map[string]string{}}
+		scan(&e.Id, &e.Title, &e.Text, &e.Priority, &e.TriggerAt, &e.Sort, &e.CreatedAt, &e.ModifiedAt, &e.TrashedAt)
+		entries[e.Id] = e
+		ex.Entries = append(ex.Entries, e)
+	})
+	tl.forRows("SELECT id, name, value FROM columns", func(scan func(dst ...interface{})) {
+		var id, name, value string
+		scan(&id, &name, &value)
+		if e, ok := entries[id]; ok {
+			e.Columns[name] = value
+		}
+	})
+
+	ex.SavedSearches = tl.stringMap("SELECT name, value FROM saved_searches")
+	ex.Settings = tl.stringMap("SELECT name, value FROM settings")
+	ex.PrivateSettings = tl.stringMap("SELECT name, value FROM private_settings")
+	for k := range ex.PrivateSettings {
+		if !private && !portablePrivateSettings[k] {
+			delete(ex.PrivateSettings, k)
+		}
+	}
+
+	ex.ColumnTypes = []*ExportColumnType{}
+	tl.forRows("SELECT name, tag, type FROM coltypes ORDER BY name, tag", func(scan func(dst ...interface{})) {
+		ct := &ExportColumnType{}
+		scan(&ct.Column, &ct.Tag, &ct.Type)
+		ex.ColumnTypes = append(ex.ColumnTypes, ct)
+	})
+
+	ex.Links = []*ExportLink{}
+	tl.forRows("SELECT id, type, target FROM links ORDER BY id, type, target", func(scan func(dst ...interface{})) {
+		link := &ExportLink{}
+		scan(&link.Id, &link.Type, &link.Target)
+		ex.Links = append(ex.Links, link)
+	})
+
+	ex.Attachments = []*ExportAttachment{}
+	tl.forRows("SELECT id, name, content_type, created_at, data FROM attachments ORDER BY id, name", func(scan func(dst ...interface{})) {
+		a := &ExportAttachment{}
+		var data []byte
+		scan(&a.Id, &a.Name, &a.ContentType, &a.CreatedAt, &data)
+		// data points to memory owned by sqlite
+		a.Data = append([]byte{}, data...)
+		ex.Attachments = append(ex.Attachments, a)
+	})
+
+	ex.TimeLog = []*ExportTimeInterval{}
+	tl.forRows("SELECT id, started_at, stopped_at FROM timelog ORDER BY started_at", func(scan func(dst ...interface{})) {
+		ti := &ExportTimeInterval{}
+		scan(&ti.Id, &ti.StartedAt, &ti.StoppedAt)
+		ex.TimeLog = append(ex.TimeLog, ti)
+	})
+
+	return ex, nil
+}
+
+// Exports the tasklist in filename without opening it, see openSnapshot and Export
+func ExportFile(filename string, private bool) (ex *Export, err error) {
+	defer catchError(&err)
+	tl := openSnapshot(filename)
+	defer tl.close()
+	return tl.Export(private)
+}
+
+func (tl *Tasklist) ExportTo(w io.Writer, private bool) (err error) {
+	defer catchError(&err)
+	ex, err := tl.Export(private)
+	Must(err)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	Must(enc.Encode(ex))
+	return nil
+}
+
+func ReadExport(r io.Reader) (ex *Export, err error) {
+	ex = &Export{}
+	if err := json.NewDecoder(r).Decode(ex); err != nil {
+		return nil, MakeParseError(fmt.Sprintf("Couldn't read export: %s", err))
+	}
+	if ex.Format != EXPORT_FORMAT {
+		return nil, MakeParseError("Not a pooch export")
+	}
+	if ex.Version < 1 || ex.Version > EXPORT_VERSION {
+		return nil, MakeParseError(fmt.Sprintf("Unsupported export version %d", ex.Version))
+	}
+	return ex, nil
+}
+
+/*
+ Imports ex into the tasklist. If replace is true the contents of the
+ tasklist are deleted first, otherwise entries of ex replace the entries
+ with the same id and everything else is added to what's already there.
+ The private settings of ex, except portablePrivateSettings, are ignored
+ (and the ones of the tasklist kept) unless private is true.
+*/
+func (tl *Tasklist) Import(ex *Export, replace, private bool) (err error) {
+	defer catchError(&err)
+
+	for k, v := range ex.Settings {
+		checkSetting(k, v)
+	}
+
+	tl.WithTransaction(func() {
+		if replace {
+			for _, table := range []string{"columns", "tasks", "saved_searches", "settings", "history", "reminders", "attachments", "links", "coltypes", "timelog"} {
+				tl.MustExec("DELETE FROM " + table)
+			}
+			if private {
+				tl.MustExec("DELETE FROM private_settings")
+			}
+		}
+
+		for k, v := range ex.Settings {
+			tl.MustExec("INSERT OR REPLACE INTO settings(name, value) VALUES (?, ?)", k, v)
+		}
+		for k, v := range ex.PrivateSettings {
+			switch {
+			case private || (replace && portablePrivateSettings[k]):
+				tl.MustExec("INSERT OR REPLACE INTO private_settings(name, value) VALUES (?, ?)", k, v)
+			case portablePrivateSettings[k]:
+				// entries encrypted with a different passphrase can't be decrypted after the import
+				if cur := tl.GetPrivateSetting(k); cur != "" && cur != v {
+					Logf(WARN, "Keeping %s of the tasklist, secret entries of the import can not be decrypted\n", k)
+				}
+				tl.MustExec("INSERT OR IGNORE INTO private_settings(name, value) VALUES (?, ?)", k, v)
+			}
+		}
+		for k, v := range ex.SavedSearches {
+			tl.MustExec("DELETE FROM saved_searches WHERE name = ?", k)
+			tl.MustExec("INSERT INTO saved_searches(name, value) VALUES (?, ?)", k, v)
+		}
+
+		// column types first, so that typed values of the entries are computed with them
+		for _, ct := range ex.ColumnTypes {
+			_, err := ParseColumnType(ct.Column, ct.Tag, ct.Type)
+			Must(err)
+			tl.MustExec("INSERT OR REPLACE INTO coltypes(name, tag, type) VALUES (?, ?, ?)", ct.Column, ct.Tag, ct.Type)
+		}
+
+		for _, e := range ex.Entries {
+			tl.importEntry(e)
+		}
+
+		if !replace {
+			for _, ct := range ex.ColumnTypes {
+				tl.retypeColumn(ct.Column)
+			}
+		}
+
+		for _, link := range ex.Links {
+			tl.MustExec("INSERT OR IGNORE INTO links(id, type, target) VALUES (?, ?, ?)", link.Id, link.Type, link.Target)
+		}
+		for _, a := range ex.Attachments {
+			tl.MustExec("INSERT OR REPLACE INTO attachments(id, name, content_type, size, created_at, data) VALUES (?, ?, ?, ?, ?, ?)", a.Id, a.Name, a.ContentType, len(a.Data), a.CreatedAt, a.Data)
+		}
+		for _, ti := range ex.TimeLog {
+			tl.MustExec("INSERT INTO timelog(id, started_at, stopped_at) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM timelog WHERE id = ? AND started_at = ?)", ti.Id, ti.StartedAt, ti.StoppedAt, ti.Id, ti.StartedAt)
+		}
+	})
+
+	return nil
+}
+
+func (tl *Tasklist) importEntry(e *ExportEntry) {
+	if e.Id == "" {
+		panic(MakeParseError("Entry without id in export"))
+	}
+
+	if len(tl.queryIds("SELECT id FROM tasks WHERE id = ?", e.Id)) > 0 {
+		tl.MustExec("UPDATE tasks SET title_field = ?, text_field = ?, priority = ?, trigger_at_field = ?, sort = ?, created_at = ?, modified_at = ?, trashed_at = ? WHERE id = ?", e.Title, e.Text, e.Priority, e.TriggerAt, e.Sort, e.CreatedAt, e.ModifiedAt, e.TrashedAt, e.Id)
+		tl.MustExec("DELETE FROM columns WHERE id = ?", e.Id)
+	} else {
+		tl.MustExec("INSERT INTO tasks(id, title_field, text_field, priority, trigger_at_field, sort, created_at, modified_at, trashed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", e.Id, e.Title, e.Text, e.Priority, e.TriggerAt, e.Sort, e.CreatedAt, e.ModifiedAt, e.TrashedAt)
+	}
+
+	cols := Columns{}
+	for k, v := range e.Columns {
+		cols[k] = v
+	}
+	tl.addColumns(MakeEntry(e.Id, e.Title, e.Text, Priority(e.Priority), nil, e.Sort, cols))
+}
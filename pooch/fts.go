@@ -0,0 +1,109 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+/*
+ Full text search uses the ridx table, a fts5 table with a stemming
+ tokenizer that is kept in sync with tasks by triggers (see migrateFTS5).
+
+ The text of a search is converted to a fts5 query by FTSQuery: words are
+ matched by their stem, words ending with * are prefix queries, text
+ between double quotes is a phrase and AND, OR, NOT work as operators.
+*/
+
+func ftsQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+}
+
+func isFTSOperator(word string) bool {
+	return word == "AND" || word == "OR" || word == "NOT"
+}
+
+// Converts the text of a search into a fts5 query, punctuation that fts5 would interpret is quoted
+func FTSQuery(text string) string {
+	terms := []string{}
+	operator := []bool{}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		switch {
+		case unicode.IsSpace(runes[i]):
+			i++
+
+		case runes[i] == '"':
+			start := i + 1
+			for i = start; i < len(runes) && runes[i] != '"'; i++ {
+			}
+			term := ftsQuote(string(runes[start:i]))
+			i++
+			if i < len(runes) && runes[i] == '*' {
+				term += "*"
+				i++
+			}
+			terms = append(terms, term)
+			operator = append(operator, false)
+
+		default:
+			start := i
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '"'; i++ {
+			}
+			word := string(runes[start:i])
+			switch {
+			case isFTSOperator(word):
+				terms = append(terms, word)
+				operator = append(operator, true)
+			case len(word) > 1 && strings.HasSuffix(word, "*"):
+				terms = append(terms, ftsQuote(word[:len(word)-1])+"*")
+				operator = append(operator, false)
+			default:
+				terms = append(terms, ftsQuote(word))
+				operator = append(operator, false)
+			}
+		}
+	}
+
+	// operators need something on both sides, otherwise they are just words
+	for i := range terms {
+		if operator[i] && (i == 0 || i == len(terms)-1 || operator[i-1]) {
+			terms[i] = ftsQuote(terms[i])
+			operator[i] = false
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// Returns highlighted snippets of the entries matching the text of queryText, as HTML
+func (tl *Tasklist) Snippets(queryText string) (r map[string]string, err error) {
+	defer catchError(&err)
+
+	r = make(map[string]string)
+	pr := tl.ParseEx(queryText)
+	if pr.text == "" {
+		return r, nil
+	}
+
+	stmt, serr := tl.conn.Prepare("SELECT id, snippet(ridx, -1, char(2), char(3), '...', 12) FROM ridx WHERE ridx MATCH ?")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(FTSQuery(pr.text)))
+
+	for stmt.Next() {
+		var id, snippet string
+		Must(stmt.Scan(&id, &snippet))
+		snippet = html.EscapeString(snippet)
+		snippet = strings.Replace(snippet, "\x02", "<mark>", -1)
+		snippet = strings.Replace(snippet, "\x03", "</mark>", -1)
+		r[id] = snippet
+	}
+	return r, nil
+}
@@ -0,0 +1,97 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"time"
+)
+
+/*
+ The history table is append-only: before an entry is modified or removed
+ its current state (including columns) is copied there as a new revision.
+*/
+
+type Revision struct {
+	Rev    int
+	Time   time.Time
+	Action string
+	Title  string
+}
+
+func (r *Revision) TimeString() string {
+	return r.Time.Format("2006-01-02 15:04:05")
+}
+
+func (tl *Tasklist) saveRevision(id string, action string) {
+	tl.MustExec("INSERT INTO history(id, timestamp, action, title_field, text_field, priority, trigger_at_field, sort, columns) SELECT tasks.id, ?, ?, title_field, text_field, priority, trigger_at_field, sort, group_concat(columns.name||'\u001f'||columns.value, '\u001f') FROM tasks NATURAL JOIN columns WHERE tasks.id = ? GROUP BY tasks.id", time.Now().Unix(), action, id)
+}
+
+// Returns the revisions of id, most recent first
+func (tl *Tasklist) GetHistory(id string) (r []*Revision, err error) {
+	defer catchError(&err)
+	return tl.getHistory(id), nil
+}
+
+func (tl *Tasklist) getHistory(id string) []*Revision {
+	stmt, serr := tl.conn.Prepare("SELECT rev, timestamp, action, title_field FROM history WHERE id = ? ORDER BY rev DESC")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+
+	r := []*Revision{}
+	for stmt.Next() {
+		var timestamp int64
+		rev := &Revision{}
+		Must(stmt.Scan(&rev.Rev, &timestamp, &rev.Action, &rev.Title))
+		rev.Time = time.Unix(timestamp, 0)
+		r = append(r, rev)
+	}
+
+	return r
+}
+
+func (tl *Tasklist) GetRevision(id string, rev int) (entry *Entry, err error) {
+	defer catchError(&err)
+	return tl.getRevision(id, rev), nil
+}
+
+func (tl *Tasklist) getRevision(id string, rev int) *Entry {
+	stmt, serr := tl.conn.Prepare("SELECT id, title_field, text_field, priority, trigger_at_field, sort, '', '', columns FROM history WHERE id = ? AND rev = ?")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id, rev))
+
+	if !stmt.Next() {
+		panic(MakeNotFoundError("Couldn't find revision %d of %s", rev, id))
+	}
+
+	entry, err := StatementScan(stmt, true)
+	Must(err)
+	tl.openSecret(entry)
+
+	return entry
+}
+
+// Restores id to the state it had in revision rev, the current state is saved as a new revision
+func (tl *Tasklist) Revert(id string, rev int) (err error) {
+	defer catchError(&err)
+
+	entry := tl.getRevision(id, rev)
+
+	if tl.isTrashed(id) {
+		tl.WithTransaction(func() {
+			tl.restore(id, tl.trashedAt(id))
+		})
+	}
+
+	if tl.Exists(id) {
+		tl.updateEx(entry, false, "revert")
+	} else {
+		tl.add(entry)
+	}
+
+	return nil
+}
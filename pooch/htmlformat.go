@@ -178,6 +178,26 @@ var EntryListPriorityChangeHTML ExecutableTemplate = MakeExecutableTemplate("Ent
     </tr>
 `)
 
+var EntryListGroupHTML ExecutableTemplate = MakeExecutableTemplate("EntryListGroup", `
+    <tr>
+      <td class='prchange' colspan='{{.PrioritySize|html}}'>{{.group|html}}</td>
+      {{range .colNames}}
+      <td class='colname'>{{.|html}}</td>
+      {{else}}
+      {{end}}
+    </tr>
+`)
+
+var EntryListAggregateHTML ExecutableTemplate = MakeExecutableTemplate("EntryListAggregate", `
+    <tr class='aggregate'>
+      <td class='aggregate' colspan='{{.colspan|html}}'>{{.label|html}}:
+      {{range .values}}
+        <span class='aggvalue'>{{index . 0|html}} <b>{{index . 1|html}}</b></span>
+      {{end}}
+      </td>
+    </tr>
+`)
+
 var EntryListEntryHTML ExecutableTemplate = MakeExecutableTemplate("EntryListEntry", `
    {{if .heading}}
     <tr class='{{.htmlClass}}'>
@@ -186,6 +206,10 @@ var EntryListEntryHTML ExecutableTemplate = MakeExecutableTemplate("EntryListEnt
       <td class='eid'>{{.Id|html}}</td>
 
       <td class='etitle' onclick='javascript:toggle_editor("{{.Id|html}}", event, null)'><a href='javascript:toggle_editor("{{.Id|html}}", event, null)'>{{.Title|html}}</a>
+
+      {{if $.snippet}}
+      <div class='esnippet'>{{$.snippet}}</div>
+      {{end}}
       
       {{if .Text}}
       <pre>{{.Text|html}}</pre>
@@ -242,6 +266,7 @@ var EntryListEntryEditorHTML ExecutableTemplate = MakeExecutableTemplate("EntryL
           <p><input type='button' style='float: right' value='remove' onclick='javascript:remove_entry("{{.Id|html}}", event)'/>
           <input type='button' name='savebtn' value='save' onclick='javascript:save_editor_by_id("{{.Id|html}}", event)' disabled='disabled'/>
           <input type='button' value='reload' onclick='javascript:fill_editor("{{.Id|html}}", null)'/>
+          <input type='button' value='undo last change' onclick='javascript:undo_last_change("{{.Id|html}}")'/>
           <input type='button' value='explode body' onclick='javascript:explode_body("{{.Id|html}}")'/></p>
         </form>
         <div id='subs_{{.Id|html}}_container' style='display: none;'>
@@ -347,6 +372,32 @@ var StatEntryHTML ExecutableTemplate = MakeExecutableTemplate("StatEntry", `
   </tr>
 `)
 
+var TimeReportHeaderHTML ExecutableTemplate = MakeExecutableTemplate("TimeReportHeader", `
+  {{if .from}}<p>From {{.from|html}}</p>{{end}}
+  {{if .to}}<p>To {{.to|html}}</p>{{end}}
+  <table class='maintable statstable' id='maintable'>
+`)
+
+var TimeReportSectionHTML ExecutableTemplate = MakeExecutableTemplate("TimeReportSection", `
+    <tr class='entry'>
+      <td class='prchange'>{{.name|html}}</td>
+      <td class='prchange'>Time</td>
+    </tr>
+`)
+
+var TimeReportLineHTML ExecutableTemplate = MakeExecutableTemplate("TimeReportLine", `
+  <tr class='{{.htmlClass}}'>
+    {{with .line}}
+      {{if $.link}}
+        <td class='stat_tag'><a href='/list?q={{$.link|url}}'>{{.Name|html}}</a> {{.Title|html}}</td>
+      {{else}}
+        <td class='stat_tag'>{{.Name|html}}</td>
+      {{end}}
+      <td class='stat_total'>{{.DurationString|html}}</td>
+    {{end}}
+  </tr>
+`)
+
 var ExplainEntryHTML ExecutableTemplate = MakeExecutableTemplate("ExplainEntry", `
   <tr class='{{.htmlClass}}'>
     {{with .explain}}
@@ -453,6 +504,33 @@ var WhoAmIHTML ExecutableTemplate = MakeExecutableTemplate("WhoAmI", `
 </html>
 `)
 
+var UnlockHTML ExecutableTemplate = MakeExecutableTemplate("Unlock", `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Unlock encrypted entries</title>
+    <link type='image/png' rel='icon' href='animals-dog.png'>
+  </head>
+  <body>
+    {{if .unlocked}}
+    <p>Encrypted entries are unlocked: <a href="/lock">lock</a></p>
+    {{else if not .hasPassphrase}}
+    <p>This tasklist doesn't have a passphrase yet, it can not be changed once set.</p>
+    <form method="post" action="/set-passphrase">
+      Passphrase:&nbsp;<input type='password' name='passphrase'/><br/>
+      Confirm passphrase:&nbsp;<input type='password' name='confirm'/><br/>
+      <input type='submit' value='set passphrase'/>
+    </form>
+    {{else}}
+    <form method="post" action="/unlock">
+      Passphrase:&nbsp;<input type='password' name='passphrase'/><br/>
+      <input type='submit' value='unlock'/>
+    </form>
+    {{end}}
+  </body>
+</html>
+`)
+
 var MustLogInHTML ExecutableTemplate = MakeExecutableTemplate("MustLogIn", `
 <!DOCTYPE html>
 <html>
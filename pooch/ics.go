@@ -0,0 +1,271 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ Search results are exported as iCalendar (RFC 5545) feeds:
+
+	NOW, LATER	VTODO, due at the time of the entry if it has one
+	with a time	VEVENT, all-day if the time is midnight
+	others		not exported
+
+ Recurring timed entries are exported once, with a RRULE, rules that recur
+ after completion are exported as single events. Times are written in UTC,
+ all-day entries as dates in the timezone of the tasklist. The name of the
+ timezone is only given as X-WR-TIMEZONE, for display: a TZID would need a
+ VTIMEZONE definition. Because of this recurring timed entries follow UTC
+ across daylight saving time changes, and monthly ones falling on a
+ different day in UTC are exported as single events.
+*/
+
+func icsEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, ";", "\\;", -1)
+	s = strings.Replace(s, ",", "\\,", -1)
+	s = strings.Replace(s, "\r\n", "\\n", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return s
+}
+
+// Splits line in lines of at most 75 bytes, continuation lines start with a space
+func icsFold(line string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+type icsWriter struct {
+	w        io.Writer
+	timezone *time.Location
+}
+
+func (iw *icsWriter) line(name, value string) {
+	_, err := io.WriteString(iw.w, icsFold(name+":"+value))
+	Must(err)
+}
+
+func icsUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func icsAllDay(t *time.Time, timezone *time.Location) bool {
+	return t.In(timezone).Format("15:04:05") == "00:00:00"
+}
+
+// Writes property name (DTSTART, DUE...) for t
+func (iw *icsWriter) time(name string, t *time.Time) {
+	if icsAllDay(t, iw.timezone) {
+		iw.line(name+";VALUE=DATE", t.In(iw.timezone).Format("20060102"))
+	} else {
+		iw.line(name, icsUTC(*t))
+	}
+}
+
+var icsWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+/*
+ Returns the RRULE of the series of a timed entry starting from the entry,
+ an empty string if it can't be expressed as a RRULE
+*/
+func icsRRule(r *Recurrence, e *Entry, timezone *time.Location) string {
+	if r == nil || r.AfterCompletion || e.TriggerAt() == nil {
+		return ""
+	}
+
+	start := e.TriggerAt().In(timezone)
+	if v, ok := e.ColumnOk("recur-start"); ok {
+		if t, err := ParseDateTime(v, time.UTC); err == nil {
+			start = t.In(timezone)
+		}
+	}
+
+	// DTSTART of timed entries is in UTC, so are the days of the rule
+	shift := 0
+	if !icsAllDay(e.TriggerAt(), timezone) {
+		utc := start.UTC()
+		shift = int(time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, time.UTC).Sub(time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+		if shift != 0 && r.Unit == RECUR_MONTHLY {
+			// days of the month can't be moved across the end of the month
+			return ""
+		}
+		start = utc
+	}
+
+	parts := []string{"FREQ=" + []string{"DAILY", "WEEKLY", "MONTHLY", "YEARLY"}[r.Unit]}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+
+	switch r.Unit {
+	case RECUR_WEEKLY:
+		if len(r.Weekdays) > 0 {
+			days := []string{}
+			for _, weekday := range r.Weekdays {
+				days = append(days, icsWeekdays[(int(weekday)+shift+7)%7])
+			}
+			parts = append(parts, "BYDAY="+strings.Join(days, ","), "WKST=MO")
+		}
+
+	case RECUR_MONTHLY:
+		switch {
+		case r.WorkingDay:
+			parts = append(parts, "BYDAY=MO,TU,WE,TH,FR", fmt.Sprintf("BYSETPOS=%d", r.Nth))
+		case r.Nth != 0:
+			parts = append(parts, fmt.Sprintf("BYDAY=%d%s", r.Nth, icsWeekdays[r.Weekday]))
+		default:
+			day := r.MonthDay
+			if day == 0 {
+				day = start.Day()
+			}
+			if day > 28 {
+				// days past the end of the month are moved to the last day of the month
+				days := []string{}
+				for d := 28; d <= day; d++ {
+					days = append(days, strconv.Itoa(d))
+				}
+				parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","), "BYSETPOS=-1")
+			} else {
+				parts = append(parts, fmt.Sprintf("BYMONTHDAY=%d", day))
+			}
+		}
+
+	case RECUR_YEARLY:
+		parts = append(parts, fmt.Sprintf("BYMONTH=%d", start.Month()), fmt.Sprintf("BYMONTHDAY=%d", start.Day()))
+	}
+
+	if r.Until != nil {
+		if icsAllDay(e.TriggerAt(), timezone) {
+			parts = append(parts, "UNTIL="+r.Until.In(timezone).Format("20060102"))
+		} else {
+			parts = append(parts, "UNTIL="+icsUTC(*r.Until))
+		}
+	}
+
+	if r.Count > 0 {
+		// the entry is occurrence number recur-count of the series
+		index := 1
+		if n, err := strconv.Atoi(e.Column("recur-count")); err == nil {
+			index = n
+		}
+		remaining := r.Count - index + 1
+		if remaining < 1 {
+			remaining = 1
+		}
+		parts = append(parts, fmt.Sprintf("COUNT=%d", remaining))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func (iw *icsWriter) entry(e *Entry, uidSuffix string) {
+	component := ""
+	switch {
+	case e.Priority() == NOW || e.Priority() == LATER:
+		component = "VTODO"
+	case e.TriggerAt() != nil:
+		component = "VEVENT"
+	default:
+		return
+	}
+
+	iw.line("BEGIN", component)
+	iw.line("UID", e.Id()+uidSuffix)
+	iw.line("DTSTAMP", icsUTC(time.Now()))
+	if e.CreatedAt() != nil {
+		iw.line("CREATED", icsUTC(*e.CreatedAt()))
+	}
+	if e.ModifiedAt() != nil {
+		iw.line("LAST-MODIFIED", icsUTC(*e.ModifiedAt()))
+	}
+	iw.line("SUMMARY", icsEscape(e.Title()))
+	if e.Text() != "" {
+		iw.line("DESCRIPTION", icsEscape(e.Text()))
+	}
+
+	tags := []string{}
+	for name, value := range e.Columns() {
+		if value == "" {
+			tags = append(tags, icsEscape(name))
+		}
+	}
+	if len(tags) > 0 {
+		sort.Strings(tags)
+		iw.line("CATEGORIES", strings.Join(tags, ","))
+	}
+
+	if component == "VTODO" {
+		if e.Priority() == NOW {
+			iw.line("PRIORITY", "1")
+		} else {
+			iw.line("PRIORITY", "5")
+		}
+		iw.line("STATUS", "NEEDS-ACTION")
+		if e.TriggerAt() != nil {
+			iw.time("DUE", e.TriggerAt())
+		}
+	} else {
+		iw.time("DTSTART", e.TriggerAt())
+		if e.Priority() == TIMED {
+			if rrule := icsRRule(e.Recurrence(iw.timezone), e, iw.timezone); rrule != "" {
+				iw.line("RRULE", rrule)
+			}
+		}
+	}
+
+	iw.line("END", component)
+}
+
+// Writes the entries matching queryText (or the saved search it names) as an iCalendar feed
+func (tl *Tasklist) WriteICS(w io.Writer, queryText string) (err error) {
+	defer catchError(&err)
+
+	pr := tl.ParseEx(queryText)
+	pr = pr.ResolveSavedSearch(tl)
+	pr.options["w/done"] = "w/done"
+	theselect, _, serr := pr.IntoSelect(tl, nil)
+	Must(serr)
+	entries, rerr := tl.Retrieve(theselect, pr.command, false, nil)
+	Must(rerr)
+
+	iw := &icsWriter{w: w, timezone: tl.GetTimezone()}
+
+	// ids are only unique inside a tasklist
+	uidSuffix := "@" + Base(tl.filename)
+
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//pooch//pooch//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("X-WR-CALNAME", icsEscape(Base(tl.filename)))
+	if name := iw.timezone.String(); name != "Local" && !strings.HasPrefix(name, "UTC") {
+		iw.line("X-WR-TIMEZONE", name)
+	}
+	for _, e := range entries {
+		iw.entry(e, uidSuffix)
+	}
+	iw.line("END", "VCALENDAR")
+
+	return nil
+}
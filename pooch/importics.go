@@ -0,0 +1,525 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ VEVENTs and VTODOs of iCalendar files are imported as entries:
+
+	SUMMARY		title
+	DESCRIPTION	text
+	DTSTART		time of the entry, TIMED (DUE for VTODOs)
+	CATEGORIES	tags
+	LOCATION	location column
+	RRULE		recur column, if it can be written as a recurrence rule
+	UID		ics-uid column
+
+ Entries are matched to the components of later imports by ics-uid and
+ updated instead of being added again. Times with a TZID that isn't an IANA
+ time zone name are read in the timezone of the tasklist. Modified
+ occurrences of a series (RECURRENCE-ID) are not imported.
+
+ Every component is checked before the tasklist is changed, if one is
+ wrong nothing is imported. The entries are written in a single transaction.
+*/
+
+type icsProperty struct {
+	Params map[string]string
+	Value  string
+}
+
+type icsComponent struct {
+	Kind  string
+	Props map[string][]*icsProperty
+}
+
+func (c *icsComponent) get(name string) *icsProperty {
+	if v := c.Props[name]; len(v) > 0 {
+		return v[0]
+	}
+	return nil
+}
+
+func (c *icsComponent) value(name string) string {
+	if p := c.get(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+// Reads the contents of an iCalendar file as unfolded lines
+func icsLines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Splits a content line in name, parameters and value
+func icsParseLine(line string) (string, *icsProperty, bool) {
+	quoted := false
+	colon := -1
+	for i, ch := range line {
+		if ch == '"' {
+			quoted = !quoted
+		} else if ch == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, false
+	}
+
+	prop := &icsProperty{Params: map[string]string{}, Value: line[colon+1:]}
+	v := strings.Split(line[:colon], ";")
+	for _, param := range v[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			prop.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+		}
+	}
+	return strings.ToUpper(v[0]), prop, true
+}
+
+// Returns the VEVENTs and VTODOs of an iCalendar file
+func parseICS(in io.Reader) ([]*icsComponent, error) {
+	lines, err := icsLines(in)
+	if err != nil {
+		return nil, err
+	}
+
+	r := []*icsComponent{}
+	stack := []*icsComponent{}
+	for _, line := range lines {
+		name, prop, ok := icsParseLine(line)
+		if !ok {
+			return nil, MakeParseError(fmt.Sprintf("Malformed iCalendar line: %s", line))
+		}
+		switch name {
+		case "BEGIN":
+			stack = append(stack, &icsComponent{Kind: strings.ToUpper(prop.Value), Props: map[string][]*icsProperty{}})
+		case "END":
+			if len(stack) == 0 {
+				return nil, MakeParseError(fmt.Sprintf("Unexpected END:%s", prop.Value))
+			}
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if c.Kind == "VEVENT" || c.Kind == "VTODO" {
+				r = append(r, c)
+			}
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.Props[name] = append(c.Props[name], prop)
+			}
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, MakeParseError(fmt.Sprintf("Missing END:%s", stack[len(stack)-1].Kind))
+	}
+	return r, nil
+}
+
+func icsUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Splits a list of values on the commas that aren't escaped
+func icsSplitList(s string) []string {
+	r := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ',':
+			r = append(r, icsUnescape(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(r, icsUnescape(s[start:]))
+}
+
+// Parses a DATE or DATE-TIME property, dates are midnight in timezone
+func icsParseTime(prop *icsProperty, timezone *time.Location) (*time.Time, error) {
+	value := strings.TrimSpace(prop.Value)
+
+	loc := timezone
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	var t time.Time
+	var err error
+	switch {
+	case prop.Params["VALUE"] == "DATE" || len(value) == 8:
+		t, err = time.ParseInLocation("20060102", value, timezone)
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse("20060102T150405Z", value)
+	default:
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+	}
+	if err != nil {
+		return nil, MakeParseError(fmt.Sprintf("Unparsable iCalendar date: %s", value))
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+var icsRecurWeekdays = map[string]string{
+	"SU": "sunday", "MO": "monday", "TU": "tuesday", "WE": "wednesday", "TH": "thursday", "FR": "friday", "SA": "saturday",
+}
+
+func icsOrdinal(n int) string {
+	if n == -1 {
+		return "last"
+	}
+	switch n {
+	case 1:
+		return "1st"
+	case 2:
+		return "2nd"
+	case 3:
+		return "3rd"
+	}
+	return fmt.Sprintf("%dth", n)
+}
+
+// Parses a BYDAY value like 2TU or -1FR
+func icsParseByDay(s string) (int, string, bool) {
+	if len(s) < 2 {
+		return 0, "", false
+	}
+	weekday, ok := icsRecurWeekdays[s[len(s)-2:]]
+	if !ok {
+		return 0, "", false
+	}
+	n := 0
+	if s[:len(s)-2] != "" {
+		var err error
+		if n, err = strconv.Atoi(strings.TrimPrefix(s[:len(s)-2], "+")); err != nil {
+			return 0, "", false
+		}
+	}
+	return n, weekday, true
+}
+
+/*
+ Converts a RRULE to a recurrence rule (see recur.go), returns false if the
+ RRULE uses something that recurrence rules can't express
+*/
+func recurFromRRule(rrule string, start time.Time, timezone *time.Location) (string, bool) {
+	parts := map[string]string{}
+	for _, part := range strings.Split(rrule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return "", false
+		}
+		switch name := strings.ToUpper(kv[0]); name {
+		case "FREQ", "INTERVAL", "BYDAY", "BYMONTHDAY", "BYMONTH", "BYSETPOS", "UNTIL", "COUNT", "WKST":
+			parts[name] = strings.ToUpper(kv[1])
+		default:
+			return "", false
+		}
+	}
+
+	interval := 1
+	if v, ok := parts["INTERVAL"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return "", false
+		}
+		interval = n
+	}
+
+	units := map[string][2]string{"DAILY": {"daily", "days"}, "WEEKLY": {"weekly", "weeks"}, "MONTHLY": {"monthly", "months"}, "YEARLY": {"yearly", "years"}}
+	unit, ok := units[parts["FREQ"]]
+	if !ok {
+		return "", false
+	}
+	words := []string{unit[0]}
+	if interval > 1 {
+		words = []string{"every", strconv.Itoa(interval), unit[1]}
+	}
+
+	start = start.In(timezone)
+	byday, bymonthday, bysetpos := parts["BYDAY"], parts["BYMONTHDAY"], parts["BYSETPOS"]
+
+	switch parts["FREQ"] {
+	case "DAILY":
+		if byday != "" || bymonthday != "" || bysetpos != "" {
+			return "", false
+		}
+
+	case "WEEKLY":
+		if bymonthday != "" || bysetpos != "" {
+			return "", false
+		}
+		if byday != "" {
+			days := []string{}
+			for _, d := range strings.Split(byday, ",") {
+				n, weekday, ok := icsParseByDay(d)
+				if !ok || n != 0 {
+					return "", false
+				}
+				days = append(days, weekday)
+			}
+			words = append(words, "on", strings.Join(days, ","))
+		}
+
+	case "MONTHLY":
+		switch {
+		case byday == "MO,TU,WE,TH,FR" && bysetpos != "" && bymonthday == "":
+			n, err := strconv.Atoi(bysetpos)
+			if err != nil || n < -1 || n == 0 || n > 5 {
+				return "", false
+			}
+			words = append(words, "on", "the", icsOrdinal(n), "weekday")
+		case byday != "":
+			n, weekday, ok := icsParseByDay(byday)
+			if !ok || n < -1 || n == 0 || n > 5 || bymonthday != "" || bysetpos != "" {
+				return "", false
+			}
+			words = append(words, "on", "the", icsOrdinal(n), weekday)
+		case bymonthday != "":
+			days := strings.Split(bymonthday, ",")
+			if len(days) > 1 && bysetpos != "-1" {
+				return "", false
+			}
+			// with BYSETPOS=-1 the last of the listed days in the month
+			n, err := strconv.Atoi(days[len(days)-1])
+			if err != nil || n < -1 || n == 0 || n > 31 {
+				return "", false
+			}
+			if n == -1 {
+				words = append(words, "on", "the", "last", "day")
+			} else {
+				words = append(words, "on", "day", strconv.Itoa(n))
+			}
+		case bysetpos != "":
+			return "", false
+		}
+
+	case "YEARLY":
+		if byday != "" || bysetpos != "" {
+			return "", false
+		}
+		if bymonthday != "" && bymonthday != strconv.Itoa(start.Day()) {
+			return "", false
+		}
+		if bymonth := parts["BYMONTH"]; bymonth != "" && bymonth != strconv.Itoa(int(start.Month())) {
+			return "", false
+		}
+	}
+
+	if _, ok := parts["BYMONTH"]; ok && parts["FREQ"] != "YEARLY" {
+		return "", false
+	}
+
+	if until := parts["UNTIL"]; until != "" {
+		t, err := icsParseTime(&icsProperty{Params: map[string]string{}, Value: until}, timezone)
+		if err != nil {
+			return "", false
+		}
+		words = append(words, "until", t.In(timezone).Format("2006-01-02"))
+	}
+
+	if count := parts["COUNT"]; count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return "", false
+		}
+		words = append(words, "for", strconv.Itoa(n), "times")
+	}
+
+	rule := strings.Join(words, " ")
+	if _, err := ParseRecurrence(rule, timezone); err != nil {
+		return "", false
+	}
+	return rule, true
+}
+
+// Converts a category to a tag name
+func icsTagName(category string) string {
+	return strings.Trim(strings.Map(func(ch rune) rune {
+		if isTagChar(ch) && ch != ',' {
+			return ch
+		}
+		return '-'
+	}, strings.ToLower(strings.TrimSpace(category))), "-")
+}
+
+// Id of the entry imported from the component with uid, empty if there isn't one
+func (tl *Tasklist) icsEntryId(uid string) string {
+	// later occurrences of a series have the same uid, the first one that isn't done is updated
+	ids := tl.queryIds("SELECT tasks.id FROM tasks, columns WHERE tasks.id = columns.id AND columns.name = 'ics-uid' AND columns.value = ? AND tasks.trashed_at = 0 ORDER BY tasks.priority = ?, tasks.trigger_at_field", uid, int(DONE))
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+func (tl *Tasklist) icsEntry(c *icsComponent, extraCols Columns, timezone *time.Location) *Entry {
+	var triggerAt *time.Time
+	for _, name := range []string{"DUE", "DTSTART"} {
+		if c.Kind == "VEVENT" && name == "DUE" {
+			continue
+		}
+		if prop := c.get(name); prop != nil {
+			t, err := icsParseTime(prop, timezone)
+			Must(err)
+			triggerAt = t
+			break
+		}
+	}
+
+	cols := Columns{}
+	for _, prop := range c.Props["CATEGORIES"] {
+		for _, category := range icsSplitList(prop.Value) {
+			if tag := icsTagName(category); tag != "" {
+				cols[tag] = ""
+			}
+		}
+	}
+	for k, v := range extraCols {
+		cols[k] = v
+	}
+	if location := icsUnescape(c.value("LOCATION")); location != "" {
+		cols["location"] = location
+	}
+	if uid := c.value("UID"); uid != "" {
+		cols["ics-uid"] = uid
+	}
+	if rrule := c.value("RRULE"); rrule != "" && triggerAt != nil {
+		if rule, ok := recurFromRRule(rrule, *triggerAt, timezone); ok {
+			cols["recur"] = rule
+		} else {
+			Logf(WARN, "Ignoring recurrence of %s: %s\n", c.value("UID"), rrule)
+		}
+	}
+
+	priority := NOW
+	switch {
+	case c.Kind == "VTODO" && strings.ToUpper(c.value("STATUS")) == "COMPLETED":
+		priority = DONE
+	case triggerAt != nil:
+		priority = TIMED
+	}
+
+	setUncat(cols)
+
+	title := icsUnescape(c.value("SUMMARY"))
+	if title == "" {
+		title = "(no title)"
+	}
+
+	return MakeEntry("", title, icsUnescape(c.value("DESCRIPTION")), priority, triggerAt, SortFromTriggerAt(triggerAt, false), cols)
+}
+
+/*
+ Imports the events and to-dos of an iCalendar file, the columns of
+ queryText (see importColumns) are added to all of them. Returns the number
+ of entries added and updated.
+*/
+func (tl *Tasklist) ImportICS(r io.Reader, queryText string) (added, updated int, err error) {
+	defer catchError(&err)
+
+	components, err := parseICS(r)
+	Must(err)
+
+	timezone := tl.GetTimezone()
+	extraCols := tl.importColumns(queryText)
+
+	entries := []*Entry{}
+	for _, c := range components {
+		if c.get("RECURRENCE-ID") != nil {
+			Logf(WARN, "Ignoring modified occurrence of %s\n", c.value("UID"))
+			continue
+		}
+		e := tl.icsEntry(c, extraCols, timezone)
+		tl.ExpandColumnsFromOntology(e.Columns())
+		checkRecurrence(e, timezone)
+		tl.checkColumnTypes(e)
+		entries = append(entries, e)
+	}
+
+	completed := map[*Entry]bool{}
+	tl.WithTransaction(func() {
+		for _, e := range entries {
+			id := ""
+			if uid, ok := e.ColumnOk("ics-uid"); ok {
+				id = tl.icsEntryId(uid)
+			}
+
+			if id == "" {
+				e.SetId(tl.MakeRandomId())
+				tl.insert(e)
+				added++
+				continue
+			}
+
+			old := tl.get(id)
+			e.SetId(id)
+			// columns added after the import are kept
+			for k, v := range old.Columns() {
+				if _, ok := e.ColumnOk(k); !ok && k != "recur" && k != "location" && k != "uncat" {
+					e.SetColumn(k, v)
+				}
+			}
+			if old.Priority() == DONE {
+				e.SetPriority(DONE)
+			}
+			// the entry is a later occurrence of the same series
+			if start, ok := old.ColumnOk("recur-start"); ok && e.TriggerAt() != nil && start == e.TriggerAt().Format("2006-01-02 15:04:05") {
+				e.SetTriggerAt(old.TriggerAt())
+				e.SetSort(old.Sort())
+			}
+			completed[e] = tl.rewrite(e, false, "update")
+			updated++
+		}
+	})
+
+	for _, e := range entries {
+		tl.afterUpdate(e, completed[e])
+	}
+
+	return added, updated, nil
+}
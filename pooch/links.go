@@ -0,0 +1,172 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+ Typed links between entries, stored in the links table:
+
+	A depends-on B	A can't be done before B, A is blocked until B is done
+	A blocks B	the same as B depends-on A, stored that way
+	A relates-to B	symmetric, stored once
+
+ Dependencies can not form cycles. When the last blocker of an entry is done
+ the entry is moved from LATER to NOW.
+*/
+
+const (
+	LINK_DEPENDS_ON = "depends-on"
+	LINK_BLOCKS     = "blocks"
+	LINK_RELATES_TO = "relates-to"
+)
+
+type Link struct {
+	Type     string
+	Id       string
+	Title    string
+	Priority Priority
+}
+
+// Converts a link to the way it is stored
+func normalizeLink(id, linkType, target string) (string, string, string) {
+	switch linkType {
+	case LINK_DEPENDS_ON, LINK_RELATES_TO:
+		return id, linkType, target
+	case LINK_BLOCKS:
+		return target, LINK_DEPENDS_ON, id
+	}
+	panic(MakeParseError(fmt.Sprintf("Unknown link type %s (must be one of %s, %s, %s)", linkType, LINK_DEPENDS_ON, LINK_BLOCKS, LINK_RELATES_TO)))
+}
+
+func (tl *Tasklist) Link(id, linkType, target string) (err error) {
+	defer catchError(&err)
+
+	id, linkType, target = normalizeLink(id, linkType, target)
+
+	for _, x := range []string{id, target} {
+		if !tl.Exists(x) {
+			panic(MakeNotFoundError("Couldn't find entry %s", x))
+		}
+	}
+	if id == target {
+		panic(MakeParseError("Can not link an entry to itself"))
+	}
+
+	tl.WithTransaction(func() {
+		switch linkType {
+		case LINK_DEPENDS_ON:
+			if tl.dependsOn(target, id) {
+				panic(MakeParseError(fmt.Sprintf("Link would create a cycle: %s already depends on %s", target, id)))
+			}
+		case LINK_RELATES_TO:
+			tl.MustExec("DELETE FROM links WHERE id = ? AND type = ? AND target = ?", target, linkType, id)
+		}
+		tl.MustExec("INSERT OR IGNORE INTO links(id, type, target) VALUES (?, ?, ?)", id, linkType, target)
+	})
+	return nil
+}
+
+func (tl *Tasklist) Unlink(id, linkType, target string) (err error) {
+	defer catchError(&err)
+	id, linkType, target = normalizeLink(id, linkType, target)
+	tl.MustExec("DELETE FROM links WHERE id = ? AND type = ? AND target = ?", id, linkType, target)
+	if linkType == LINK_RELATES_TO {
+		tl.MustExec("DELETE FROM links WHERE id = ? AND type = ? AND target = ?", target, linkType, id)
+	}
+	return nil
+}
+
+// Returns the links of id, seen from id (if B depends-on id the link is returned as blocks B)
+func (tl *Tasklist) Links(id string) (r []*Link, err error) {
+	defer catchError(&err)
+
+	stmt, serr := tl.conn.Prepare(`SELECT links.type, links.target, tasks.title_field, tasks.priority, 0 FROM links, tasks WHERE links.id = ? AND tasks.id = links.target AND tasks.trashed_at = 0
+UNION ALL
+SELECT links.type, links.id, tasks.title_field, tasks.priority, 1 FROM links, tasks WHERE links.target = ? AND tasks.id = links.id AND tasks.trashed_at = 0`)
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id, id))
+
+	r = []*Link{}
+	for stmt.Next() {
+		link := &Link{}
+		var priority, reverse int
+		Must(stmt.Scan(&link.Type, &link.Id, &link.Title, &priority, &reverse))
+		link.Priority = Priority(priority)
+		if reverse != 0 && link.Type == LINK_DEPENDS_ON {
+			link.Type = LINK_BLOCKS
+		}
+		r = append(r, link)
+	}
+	return r, nil
+}
+
+func (tl *Tasklist) queryIds(query string, v ...interface{}) []string {
+	stmt, serr := tl.conn.Prepare(query)
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(v...))
+
+	r := []string{}
+	for stmt.Next() {
+		var id string
+		Must(stmt.Scan(&id))
+		r = append(r, id)
+	}
+	return r
+}
+
+// Returns true if id depends, directly or indirectly, on target
+func (tl *Tasklist) dependsOn(id, target string) bool {
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, dep := range tl.queryIds("SELECT target FROM links WHERE id = ? AND type = ?", cur, LINK_DEPENDS_ON) {
+			if dep == target {
+				return true
+			}
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return false
+}
+
+// SQL condition that is true for entries with dependencies that aren't done
+func blockedClause() string {
+	return fmt.Sprintf("id IN (SELECT links.id FROM links, tasks AS blockers WHERE links.type = '%s' AND blockers.id = links.target AND blockers.priority <> %d AND blockers.trashed_at = 0)", LINK_DEPENDS_ON, DONE)
+}
+
+func (tl *Tasklist) isBlocked(id string) bool {
+	return len(tl.queryIds("SELECT id FROM tasks WHERE id = ? AND "+blockedClause(), id)) > 0
+}
+
+// Returns the LATER entries that depend on id
+func (tl *Tasklist) laterDependents(id string) []string {
+	return tl.queryIds("SELECT links.id FROM links, tasks WHERE links.target = ? AND links.type = ? AND tasks.id = links.id AND tasks.priority = ? AND tasks.trashed_at = 0", id, LINK_DEPENDS_ON, LATER)
+}
+
+// Moves the entries in dependents that aren't blocked anymore to NOW, must
+// be called inside a transaction, after their blocker was completed,
+// trashed or purged
+func (tl *Tasklist) unblock(dependents []string) {
+	for _, dependent := range dependents {
+		if tl.isBlocked(dependent) {
+			continue
+		}
+		Logf(INFO, "Unblocked %s\n", dependent)
+		tl.saveRevision(dependent, "update")
+		tl.MustExec("UPDATE tasks SET priority = ?, modified_at = ? WHERE id = ?", NOW, time.Now().UTC().Format("2006-01-02 15:04:05"), dependent)
+	}
+}
@@ -29,6 +29,10 @@ func (le *LuaIntError) Error() string {
 	return le.message
 }
 
+func (le *LuaIntError) Is(target error) bool {
+	return target == ErrLua
+}
+
 type LuaFlags struct {
 	cursorEdited bool // the original, introduced cursor, was modified
 	cursorCloned bool // the cursor was cloned, creating a new entry
@@ -273,7 +277,7 @@ func LuaIntWriteCursor(L *lua.State) int {
 	tl := GetTasklistFromLua(L)
 	luaAssertNotFreeCursor(tl, "writecursor()")
 	cursor := GetEntryFromLua(L, CURSOR, "writecursor()")
-	tl.Update(cursor, false)
+	tl.update(cursor, false)
 	return 0
 }
 
@@ -291,7 +295,7 @@ func LuaIntVisit(L *lua.State) int {
 				error = rerr
 			}
 		}()
-		cursor := tl.Get(id)
+		cursor := tl.get(id)
 		tl.SetEntryInLua(CURSOR, cursor)
 	}
 
@@ -360,7 +364,7 @@ func LuaIntLocalTime(L *lua.State) int {
 	timezone := tl.GetTimezone()
 	timestamp := L.ToInteger(1)
 
-	t := time.Unix(int64(timestamp)+(int64(timezone)*60*60), 0)
+	t := time.Unix(int64(timestamp), 0).In(timezone)
 
 	PushTime(L, t)
 
@@ -402,6 +406,49 @@ func LuaIntParseDateTime(L *lua.State) int {
 	return 1
 }
 
+// nextoccurrence(rule, timestamp) returns the first occurrence of the recurrence rule after timestamp, 0 if there isn't one
+func LuaIntNextOccurrence(L *lua.State) int {
+	luaAssertArgnum(L, 2, "nextoccurrence()")
+
+	L.CheckStack(1)
+
+	tl := GetTasklistFromLua(L)
+	timezone := tl.GetTimezone()
+	r, err := ParseRecurrence(L.ToString(1), timezone)
+	Must(err)
+
+	cur := time.Unix(int64(L.ToInteger(2)), 0)
+	if next, ok := r.Next(cur, cur, 1, timezone); ok {
+		L.PushInteger(next.Unix())
+	} else {
+		L.PushInteger(0)
+	}
+
+	return 1
+}
+
+// trackedtime(id) returns the seconds tracked on id, without arguments uses the cursor
+func LuaIntTrackedTime(L *lua.State) int {
+	var id string
+	switch L.GetTop() {
+	case 0:
+		id = GetEntryFromLua(L, CURSOR, "trackedtime()").Id()
+	case 1:
+		id = L.ToString(1)
+	default:
+		panic(errors.New("Wrong number of arguments to trackedtime()"))
+	}
+
+	L.CheckStack(1)
+
+	tl := GetTasklistFromLua(L)
+	d, err := tl.TrackedTime(id)
+	Must(err)
+	L.PushInteger(int64(d.Seconds()))
+
+	return 1
+}
+
 func LuaIntSplit(L *lua.State) int {
 	if L.GetTop() < 2 {
 		panic(errors.New("Wrong number of arguments to split()"))
@@ -735,7 +782,7 @@ func (tl *Tasklist) DoStringNoLock(code string, cursor *Entry, freeCursor bool)
 
 	if err := tl.luaState.DoString(code); err != nil {
 		tl.LogError(fmt.Sprintf("Error while executing lua code: %v", err))
-		return err
+		return &LuaIntError{err.Error()}
 	}
 
 	return nil
@@ -833,6 +880,8 @@ func MakeLuaState() *lua.State {
 	L.Register("localtime", LuaIntLocalTime)
 	L.Register("timestamp", LuaIntTimestamp)
 	L.Register("parsedatetime", LuaIntParseDateTime)
+	L.Register("nextoccurrence", LuaIntNextOccurrence)
+	L.Register("trackedtime", LuaIntTrackedTime)
 
 	// string utility functions
 	L.Register("split", LuaIntSplit)
@@ -0,0 +1,347 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ Three-way merge of two copies (ours and theirs) of a tasklist, both derived
+ from base. The result is written to ours.
+
+ Entries are matched by id and merged field by field (title, text,
+ priority, time, sort, trash status and each column): a field changed on
+ only one side takes the changed value. When both sides changed a field to
+ different values the entry keeps our values for the conflicting fields and
+ their version is added as a copy, with a new id, tagged #conflict and with
+ a conflict-of column pointing to the original entry. An entry deleted on
+ one side and changed on the other is kept.
+
+ Saved searches, settings and column types are merged by name in the same
+ way, on conflict our value is kept. Private settings are never taken from
+ theirs. Links, attachments and tracked time added by theirs are copied,
+ removals are not.
+*/
+
+type MergeConflict struct {
+	Id     string
+	Title  string
+	Fields []string // conflicting fields, or the setting
+	CopyId string   // id of the conflict copy, empty if there isn't one
+}
+
+type MergeReport struct {
+	Added, Updated, Removed int
+	Conflicts               []*MergeConflict
+}
+
+func exportEntryMap(ex *Export) map[string]*ExportEntry {
+	r := map[string]*ExportEntry{}
+	for _, e := range ex.Entries {
+		r[e.Id] = e
+	}
+	return r
+}
+
+func columnTypeMap(ex *Export) map[string]string {
+	r := map[string]string{}
+	for _, ct := range ex.ColumnTypes {
+		r[ct.Column+"\x00"+ct.Tag] = ct.Type
+	}
+	return r
+}
+
+func keySet(maps ...map[string]string) map[string]bool {
+	r := map[string]bool{}
+	for _, m := range maps {
+		for k := range m {
+			r[k] = true
+		}
+	}
+	return r
+}
+
+// Merges a single value, conflict is true if ours and theirs changed it differently
+func merge3(base, ours, theirs string, baseOk, oursOk, theirsOk bool) (value string, ok bool, conflict bool) {
+	switch {
+	case ours == theirs && oursOk == theirsOk:
+		return ours, oursOk, false
+	case ours == base && oursOk == baseOk:
+		return theirs, theirsOk, false
+	case theirs == base && theirsOk == baseOk:
+		return ours, oursOk, false
+	}
+	return ours, oursOk, true
+}
+
+/*
+ Merges a map (saved searches, settings...), returns the merged map and
+ the keys with conflicts
+*/
+func mergeMaps(base, ours, theirs map[string]string) (map[string]string, []string) {
+	r := map[string]string{}
+	conflicts := []string{}
+	for k := range keySet(base, ours, theirs) {
+		b, bok := base[k]
+		o, ook := ours[k]
+		t, tok := theirs[k]
+		v, ok, conflict := merge3(b, o, t, bok, ook, tok)
+		if conflict {
+			conflicts = append(conflicts, k)
+		}
+		if ok {
+			r[k] = v
+		}
+	}
+	sort.Strings(conflicts)
+	return r, conflicts
+}
+
+func exportEntryFields(e *ExportEntry) map[string]string {
+	return map[string]string{
+		"title":    e.Title,
+		"text":     e.Text,
+		"priority": fmt.Sprintf("%d", e.Priority),
+		"when":     e.TriggerAt,
+		"sort":     e.Sort,
+		"trashed":  fmt.Sprintf("%d", e.TrashedAt),
+	}
+}
+
+func sameExportEntry(a, b *ExportEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	fa, fb := exportEntryFields(a), exportEntryFields(b)
+	for k := range fa {
+		if fa[k] != fb[k] {
+			return false
+		}
+	}
+	if len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	for k, v := range a.Columns {
+		if w, ok := b.Columns[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ Merges an entry present in all three copies, returns the merged entry and
+ the conflicting fields
+*/
+func mergeExportEntry(base, ours, theirs *ExportEntry) (*ExportEntry, []string) {
+	r := &ExportEntry{Id: ours.Id, CreatedAt: ours.CreatedAt, ModifiedAt: ours.ModifiedAt}
+	if theirs.ModifiedAt > r.ModifiedAt {
+		r.ModifiedAt = theirs.ModifiedAt
+	}
+
+	fb, fo, ft := exportEntryFields(base), exportEntryFields(ours), exportEntryFields(theirs)
+	if ours.TrashedAt != 0 && theirs.TrashedAt != 0 {
+		// removed by both
+		ft["trashed"] = fo["trashed"]
+	}
+	fields, conflicts := mergeMaps(fb, fo, ft)
+	r.Title, r.Text, r.TriggerAt, r.Sort = fields["title"], fields["text"], fields["when"], fields["sort"]
+	fmt.Sscanf(fields["priority"], "%d", &r.Priority)
+	fmt.Sscanf(fields["trashed"], "%d", &r.TrashedAt)
+
+	// entries removed on one side and changed on the other are kept
+	if base.TrashedAt == 0 && (ours.TrashedAt != 0 && theirs.TrashedAt == 0 && !sameExportEntry(base, theirs) || theirs.TrashedAt != 0 && ours.TrashedAt == 0 && !sameExportEntry(base, ours)) {
+		r.TrashedAt = 0
+	}
+
+	columns, columnConflicts := mergeMaps(base.Columns, ours.Columns, theirs.Columns)
+	r.Columns = columns
+	for _, k := range columnConflicts {
+		conflicts = append(conflicts, "#"+k)
+	}
+
+	// an entry left without tags, or tagged on both sides
+	setUncat(r.Columns)
+
+	return r, conflicts
+}
+
+// Returns a copy of e with id, tagged #conflict
+func conflictCopy(e *ExportEntry, id string) *ExportEntry {
+	r := *e
+	r.Id = id
+	r.TrashedAt = 0
+	r.Columns = map[string]string{}
+	for k, v := range e.Columns {
+		r.Columns[k] = v
+	}
+	delete(r.Columns, "uncat")
+	r.Columns["conflict"] = ""
+	r.Columns["conflict-of"] = e.Id
+	return &r
+}
+
+// Merges the changes made to theirs since base into tl, see above
+func (tl *Tasklist) Merge(base, theirs *Export) (report *MergeReport, err error) {
+	defer catchError(&err)
+
+	ours, err := tl.Export(false)
+	Must(err)
+
+	report = &MergeReport{Conflicts: []*MergeConflict{}}
+
+	be, oe, te := exportEntryMap(base), exportEntryMap(ours), exportEntryMap(theirs)
+	idSet := map[string]bool{}
+	for _, m := range []map[string]*ExportEntry{be, oe, te} {
+		for id := range m {
+			idSet[id] = true
+		}
+	}
+	ids := []string{}
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// MakeRandomId only knows the ids in the database, the ids of theirs and
+	// of the copies made by this merge are not there yet
+	makeCopyId := func() string {
+		for {
+			id := tl.MakeRandomId()
+			if !idSet[id] {
+				idSet[id] = true
+				return id
+			}
+		}
+	}
+
+	save := []*ExportEntry{}
+	remove := []string{}
+	for _, id := range ids {
+		b, o, t := be[id], oe[id], te[id]
+
+		switch {
+		case sameExportEntry(o, t):
+			// nothing to do
+
+		case t == nil:
+			if b != nil && sameExportEntry(b, o) {
+				remove = append(remove, id)
+				report.Removed++
+			} else if b != nil {
+				report.Conflicts = append(report.Conflicts, &MergeConflict{Id: id, Title: o.Title, Fields: []string{"removed by theirs"}})
+			}
+
+		case o == nil:
+			if b == nil {
+				save = append(save, t)
+				report.Added++
+			} else if !sameExportEntry(b, t) {
+				save = append(save, t)
+				report.Added++
+				report.Conflicts = append(report.Conflicts, &MergeConflict{Id: id, Title: t.Title, Fields: []string{"removed by ours"}})
+			}
+
+		case b == nil:
+			// added on both sides with the same id
+			copyId := makeCopyId()
+			save = append(save, conflictCopy(t, copyId))
+			report.Added++
+			report.Conflicts = append(report.Conflicts, &MergeConflict{Id: id, Title: o.Title, Fields: []string{"added by both"}, CopyId: copyId})
+
+		default:
+			merged, conflicts := mergeExportEntry(b, o, t)
+			if !sameExportEntry(merged, o) {
+				save = append(save, merged)
+				report.Updated++
+			}
+			if len(conflicts) > 0 {
+				copyId := makeCopyId()
+				save = append(save, conflictCopy(t, copyId))
+				report.Added++
+				report.Conflicts = append(report.Conflicts, &MergeConflict{Id: id, Title: o.Title, Fields: conflicts, CopyId: copyId})
+			}
+		}
+	}
+
+	savedSearches, ssConflicts := mergeMaps(base.SavedSearches, ours.SavedSearches, theirs.SavedSearches)
+	settings, setConflicts := mergeMaps(base.Settings, ours.Settings, theirs.Settings)
+	columnTypes, ctConflicts := mergeMaps(columnTypeMap(base), columnTypeMap(ours), columnTypeMap(theirs))
+	for _, c := range []struct {
+		kind string
+		keys []string
+	}{{"saved search", ssConflicts}, {"setting", setConflicts}, {"column type", ctConflicts}} {
+		for _, k := range c.keys {
+			report.Conflicts = append(report.Conflicts, &MergeConflict{Title: strings.Replace(k, "\x00", " #", 1), Fields: []string{c.kind}})
+		}
+	}
+
+	for k, v := range settings {
+		checkSetting(k, v)
+	}
+
+	tl.WithTransaction(func() {
+		for _, e := range save {
+			tl.importEntry(e)
+		}
+		for _, id := range remove {
+			tl.purge(id)
+		}
+
+		for _, table := range []string{"saved_searches", "settings", "coltypes"} {
+			tl.MustExec("DELETE FROM " + table)
+		}
+		for k, v := range savedSearches {
+			tl.MustExec("INSERT INTO saved_searches(name, value) VALUES (?, ?)", k, v)
+		}
+		for k, v := range settings {
+			tl.MustExec("INSERT INTO settings(name, value) VALUES (?, ?)", k, v)
+		}
+		for k, v := range columnTypes {
+			ct := strings.SplitN(k, "\x00", 2)
+			tl.MustExec("INSERT INTO coltypes(name, tag, type) VALUES (?, ?, ?)", ct[0], ct[1], v)
+		}
+		oursColumnTypes := columnTypeMap(ours)
+		for k := range keySet(columnTypes, oursColumnTypes) {
+			if columnTypes[k] != oursColumnTypes[k] {
+				tl.retypeColumn(strings.SplitN(k, "\x00", 2)[0])
+			}
+		}
+
+		// only what theirs added, for entries that still exist
+		baseRows := map[string]bool{}
+		for _, link := range base.Links {
+			baseRows[link.Id+"\x00"+link.Type+"\x00"+link.Target] = true
+		}
+		for _, a := range base.Attachments {
+			baseRows[a.Id+"\x00"+a.Name] = true
+		}
+		for _, ti := range base.TimeLog {
+			baseRows[ti.Id+"\x00"+ti.StartedAt] = true
+		}
+
+		for _, link := range theirs.Links {
+			if !baseRows[link.Id+"\x00"+link.Type+"\x00"+link.Target] && tl.Exists(link.Id) {
+				tl.MustExec("INSERT OR IGNORE INTO links(id, type, target) VALUES (?, ?, ?)", link.Id, link.Type, link.Target)
+			}
+		}
+		for _, a := range theirs.Attachments {
+			if !baseRows[a.Id+"\x00"+a.Name] && tl.Exists(a.Id) {
+				tl.MustExec("INSERT OR IGNORE INTO attachments(id, name, content_type, size, created_at, data) VALUES (?, ?, ?, ?, ?, ?)", a.Id, a.Name, a.ContentType, len(a.Data), a.CreatedAt, a.Data)
+			}
+		}
+		for _, ti := range theirs.TimeLog {
+			if !baseRows[ti.Id+"\x00"+ti.StartedAt] && tl.Exists(ti.Id) {
+				tl.MustExec("INSERT INTO timelog(id, started_at, stopped_at) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM timelog WHERE id = ? AND started_at = ?)", ti.Id, ti.StartedAt, ti.StoppedAt, ti.Id, ti.StartedAt)
+			}
+		}
+	})
+
+	return report, nil
+}
@@ -0,0 +1,218 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ Searches can run on several tasklists with the in option:
+
+	#:in=work,home		the tasklists named work and home in POOCHPATH
+	#:in=all		every tasklist in POOCHPATH
+
+ A saved search with the in option is a search across tasklists: the saved
+ search is read from the current tasklist and the rest of its query is run
+ in each tasklist, with that tasklist's ontology and saved searches.
+ Entries found this way have a tasklist column with the name of the
+ tasklist they come from and are ordered by priority, time and sort, like
+ the results of a normal search. The other tasklists are only read (see
+ openReadOnly). The multi user server doesn't allow searches across
+ tasklists.
+*/
+
+const TASKLIST_COLUMN = "tasklist"
+
+// Name of the tasklist in filename, like Base but also for files without the .pooch extension
+func TasklistName(filename string) string {
+	return strings.TrimSuffix(path.Base(filename), ".pooch")
+}
+
+// Returns the files of all the tasklists in POOCHPATH
+func AllTasklists() []string {
+	r := []string{}
+	seen := map[string]bool{}
+	for _, curpath := range strings.Split(os.Getenv("POOCHPATH"), ":") {
+		if curpath == "" {
+			continue
+		}
+		matches, _ := filepath.Glob(path.Join(curpath, "*.pooch"))
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				r = append(r, match)
+			}
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Returns the files of the tasklists in names, separated by commas, or all of them if names is "all". Only tasklists in POOCHPATH can be named
+func ResolveTasklists(names string) []string {
+	all := AllTasklists()
+	if names == "all" {
+		return all
+	}
+
+	byName := map[string]string{}
+	for _, filename := range all {
+		if _, ok := byName[TasklistName(filename)]; !ok {
+			byName[TasklistName(filename)] = filename
+		}
+	}
+
+	r := []string{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		filename, ok := byName[strings.TrimSuffix(name, ".pooch")]
+		if !ok {
+			panic(MakeNotFoundError("Tasklist %s not found in POOCHPATH", name))
+		}
+		r = append(r, filename)
+	}
+	return r
+}
+
+/*
+ Returns the query to run and the tasklists to run it in, for queryText
+ (resolving the saved search it names). The tasklists are the ones in the
+ in option, or in if it isn't empty. Returns no tasklists if the search
+ only concerns the current tasklist.
+*/
+func (tl *Tasklist) SearchScope(queryText, in string) (query string, filenames []string, err error) {
+	defer catchError(&err)
+
+	query, in = tl.searchIn(queryText, in)
+	if in == "" {
+		return queryText, nil, nil
+	}
+
+	return query, ResolveTasklists(in), nil
+}
+
+// Returns the query to run and the names of the tasklists to run it in (empty for the current tasklist), see SearchScope
+func (tl *Tasklist) searchIn(queryText, in string) (string, string) {
+	query := queryText
+	pr := tl.ParseEx(queryText)
+	if pr.savedSearch != "" {
+		query = tl.GetSavedSearch(pr.savedSearch)
+		pr = tl.ParseEx(query)
+	}
+
+	if in == "" {
+		in = pr.options["in"]
+	}
+	return query, in
+}
+
+/*
+ Runs queryText in each of the tasklists in filenames (tl is the current
+ tasklist, so that it isn't opened again), see above. Returns the entries
+ and the columns to show.
+*/
+func (tl *Tasklist) SearchTasklists(queryText string, filenames []string) (entries []*Entry, showCols []string, err error) {
+	defer catchError(&err)
+
+	entries = []*Entry{}
+	showCols = []string{TASKLIST_COLUMN}
+
+	for i, filename := range filenames {
+		search := func(other *Tasklist) {
+			theselect, code, _, _, _, cols, options, sortCols, perr := other.ParseSearch(queryText, nil)
+			Must(perr)
+			_, incsub := options["sub"]
+			v, rerr := other.Retrieve(theselect, code, incsub, sortCols)
+			Must(rerr)
+
+			name := TasklistName(filename)
+			for _, e := range v {
+				e.SetColumn(TASKLIST_COLUMN, name)
+			}
+			entries = append(entries, v...)
+
+			if i == 0 {
+				showCols = append(showCols, cols...)
+			}
+		}
+
+		if filename == tl.filename {
+			search(tl)
+			continue
+		}
+
+		other, err := openReadOnly(filename)
+		Must(err)
+		func() {
+			defer other.Close()
+			other.withLock(func() { search(other) })
+		}()
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Priority() != b.Priority() {
+			return a.Priority() < b.Priority()
+		}
+		if ta, tb := FormatTriggerAtForAdd(a), FormatTriggerAtForAdd(b); ta != tb {
+			return ta < tb
+		}
+		return a.Sort() > b.Sort()
+	})
+
+	return entries, showCols, nil
+}
+
+/*
+ Returns the entry with id from each of the tasklists in filenames that has
+ it, with TASKLIST_COLUMN set, the other tasklists are opened read-only like
+ in SearchTasklists. If unlock isn't nil it's called on each tasklist that
+ has the entry before reading it (the other tasklists are locked again
+ afterwards).
+*/
+func (tl *Tasklist) GetTasklists(id string, filenames []string, unlock func(*Tasklist)) (entries []*Entry, err error) {
+	defer catchError(&err)
+
+	entries = []*Entry{}
+
+	for _, filename := range filenames {
+		get := func(other *Tasklist) {
+			if !other.Exists(id) {
+				return
+			}
+			if unlock != nil {
+				unlock(other)
+			}
+			e := other.get(id)
+			e.SetColumn(TASKLIST_COLUMN, TasklistName(filename))
+			entries = append(entries, e)
+		}
+
+		if filename == tl.filename {
+			get(tl)
+			continue
+		}
+
+		other, err := openReadOnly(filename)
+		Must(err)
+		func() {
+			defer other.Close()
+			secretKey := other.secretKey
+			defer func() { other.secretKey = secretKey }()
+			other.withLock(func() { get(other) })
+		}()
+	}
+
+	return entries, nil
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net/http"
 	"path"
+	"path/filepath"
 	"regexp"
 	"time"
 
@@ -176,7 +177,12 @@ func (mdb *MultiuserDb) OpenOrCreateUserDb(username string) *Tasklist {
 		return nil
 	}
 	file := path.Join(mdb.directory, username+".pooch")
-	return OpenOrCreate(file)
+	tl, err := OpenOrCreate(file)
+	Must(err)
+	if scheduler != nil {
+		scheduler.Watch(file)
+	}
+	return tl
 }
 
 func (mdb *MultiuserDb) WithOpenUser(req *http.Request, fn func(tl *Tasklist)) bool {
@@ -184,9 +190,7 @@ func (mdb *MultiuserDb) WithOpenUser(req *http.Request, fn func(tl *Tasklist)) b
 	if username != "" {
 		tl := mdb.OpenOrCreateUserDb(username)
 		defer tl.Close()
-		tl.mutex.Lock()
-		defer tl.mutex.Unlock()
-		fn(tl)
+		tl.withLock(func() { fn(tl) })
 		return true
 	}
 	return false
@@ -195,7 +199,7 @@ func (mdb *MultiuserDb) WithOpenUser(req *http.Request, fn func(tl *Tasklist)) b
 func MultiWrapperTasklistServer(fn TasklistServer) http.HandlerFunc {
 	return func(c http.ResponseWriter, req *http.Request) {
 		if !multiuserDb.WithOpenUser(req, func(tl *Tasklist) {
-			fn(c, req, tl)
+			withSessionKey(req, tl, func() { fn(c, req, tl) })
 		}) {
 			MustLogInHTML(nil, c)
 		}
@@ -207,9 +211,9 @@ func MultiWrapperTasklistWithIdServer(fn TasklistWithIdServer) http.HandlerFunc
 		if !multiuserDb.WithOpenUser(req, func(tl *Tasklist) {
 			id := req.FormValue("id")
 			if !tl.Exists(id) {
-				panic(fmt.Sprintf("Non-existent id specified"))
+				panic(MakeNotFoundError("Non-existent id specified"))
 			}
-			fn(c, req, tl, id)
+			withSessionKey(req, tl, func() { fn(c, req, tl, id) })
 		}) {
 			MustLogInHTML(nil, c)
 		}
@@ -317,6 +321,10 @@ func APITokensServer(c http.ResponseWriter, req *http.Request) {
 func MultiServe(port string, directory string) {
 	multiuserDb = OpenMultiuserDb(directory)
 
+	userDbs, err := filepath.Glob(path.Join(directory, "*.pooch"))
+	Must(err)
+	StartScheduler(userDbs)
+
 	http.HandleFunc("/login", WrapperServer(LoginServer))
 	http.HandleFunc("/register", WrapperServer(RegisterServer))
 	http.HandleFunc("/whoami", WrapperServer(WhoAmIServer))
@@ -6,9 +6,15 @@
 package pooch
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/carmark/gosqlite/sqlite"
 )
 
 func mms(z *testing.T, a string, b string, explanation string) {
@@ -104,7 +110,7 @@ func TestTokRewind(z *testing.T) {
 
 func tse(z *testing.T, in string, name string, op string, value string) {
 	t := NewTokenizer(in)
-	p := NewParser(t, 0)
+	p := NewParser(t, time.UTC)
 	expr := &SimpleExpr{}
 
 	if !p.ParseSimpleExpression(expr) {
@@ -118,7 +124,7 @@ func tse(z *testing.T, in string, name string, op string, value string) {
 
 func tae_ex(in string) (*Parser, *ParseResult) {
 	t := NewTokenizer(in)
-	p := NewParser(t, 0)
+	p := NewParser(t, time.UTC)
 
 	r := p.ParseEx()
 
@@ -190,7 +196,7 @@ func tae_options(z *testing.T, in string, expected []string, options []string, o
 
 func tae2(z *testing.T, in string, includeExpected []string, excludeExpected []string, query string) {
 	t := NewTokenizer(in)
-	p := NewParser(t, 0)
+	p := NewParser(t, time.UTC)
 
 	r := p.ParseEx()
 
@@ -235,6 +241,8 @@ func TestParseSimpleExpr(z *testing.T) {
 	tse(z, "#blip!>0", "blip", ">", "0")
 	tse(z, "#blip?", "blip", "", "")
 	tse(z, "#:when>2023-04-02", ":when", ">", "2023-04-02")
+	tse(z, "#:created>2023-04-02", ":created", ">", "2023-04-02")
+	tse(z, "#:modified<=2023-04-02", ":modified", "<=", "2023-04-02")
 }
 
 func TestParseAnd(z *testing.T) {
@@ -271,19 +279,19 @@ func TestParsePriority(z *testing.T) {
 
 func TestParseTimetag(z *testing.T) {
 	fmt.Println("TestParseTimetag")
-	tentwo_dt, _ := ParseDateTime("10/2", 0)
+	tentwo_dt, _ := ParseDateTime("10/2", time.UTC)
 	tentwo := tentwo_dt.Format(TRIGGER_AT_FORMAT)
 	tae_wval(z, "#10/2 prova", []string{":when"}, []string{tentwo}, []string{""})
 	tae_wval(z, "#10/2 #2010-09-21", []string{":when", ":when"}, []string{tentwo, "2010-09-21 00:00"}, []string{"", ""})
 	tae_wval(z, "#10/2+weekly #2010-09-21", []string{":when", ":when"}, []string{tentwo, "2010-09-21 00:00"}, []string{"weekly", ""})
 
-	datetime, err := ParseDateTime("13:40", 0)
+	datetime, err := ParseDateTime("13:40", time.UTC)
 	Must(err)
 	if (datetime.Hour() != 13) || (datetime.Minute() != 40) || (datetime.Year() < 2012) {
 		z.Error("Error parsing hour only time expression")
 	}
 
-	datetime, err = ParseDateTime("Thu", 0)
+	datetime, err = ParseDateTime("Thu", time.UTC)
 	Must(err)
 	if (datetime.Year() < 2010) || (datetime.Weekday() != 4) {
 		z.Errorf("Error parsing day of the week time expression: %s, weekday: %d", datetime.Format(TRIGGER_AT_FORMAT), datetime.Weekday())
@@ -317,7 +325,7 @@ func TestEscaping(z *testing.T) {
 
 func textra(z *testing.T, input string, normal string, extra string, command string) {
 	t := NewTokenizer(input)
-	p := NewParser(t, 0)
+	p := NewParser(t, time.UTC)
 
 	r := p.ParseEx()
 
@@ -368,20 +376,21 @@ func tpn(z *testing.T, tl *Tasklist, entryText string, queryText string, entry *
 }
 
 func SetupSearchStuff(tl *Tasklist) {
-	tl.Add(tl.ParseNew("#id=10#bla questa è una prova #blo", ""))
-	tl.Add(tl.ParseNew("#id=11#bib=10 ging bong un #bla", ""))
-	tl.Add(tl.ParseNew("#id=12#bib=20#bla questa è una prova", ""))
+	Must(tl.Add(tl.ParseNew("#id=10#bla questa è una prova #blo", "")))
+	Must(tl.Add(tl.ParseNew("#id=11#bib=10 ging bong un #bla", "")))
+	Must(tl.Add(tl.ParseNew("#id=12#bib=20#bla questa è una prova", "")))
 
-	tl.Add(tl.ParseNew("#id=13#2010-01-01 bang", ""))
-	tl.Add(tl.ParseNew("#id=14#2010-10-10 bang", ""))
+	Must(tl.Add(tl.ParseNew("#id=13#2010-01-01 bang", "")))
+	Must(tl.Add(tl.ParseNew("#id=14#2010-10-10 bang", "")))
 
-	tl.Add(tl.ParseNew("#id=15#bza bung", ""))
-	tl.Add(tl.ParseNew("#id=16#bzo bung", ""))
-	tl.Add(tl.ParseNew("#id=17#bzi bung", ""))
+	Must(tl.Add(tl.ParseNew("#id=15#bza bung", "")))
+	Must(tl.Add(tl.ParseNew("#id=16#bzo bung", "")))
+	Must(tl.Add(tl.ParseNew("#id=17#bzi bung", "")))
 }
 
 func ooc() *Tasklist {
-	tl := OpenOrCreate("/tmp/testing.pooch")
+	tl, err := OpenOrCreate("/tmp/testing.pooch")
+	Must(err)
 	tl.Truncate()
 	SetupSearchStuff(tl)
 
@@ -434,7 +443,7 @@ func TestSpecialEntry(z *testing.T) {
 		MakeEntry("", "prova prova", "", LATER, nil, "",
 			map[string]string{"blap": ""}))
 
-	t, _ := ParseDateTime("2010-10-01", 0)
+	t, _ := ParseDateTime("2010-10-01", time.UTC)
 	tpn(z, tl, "#2010-10-01 #blap prova prova", "",
 		MakeEntry("", "prova prova", "", TIMED, t, "",
 			map[string]string{"blap": ""}))
@@ -455,7 +464,7 @@ func TestEntryWithSearch(z *testing.T) {
 }
 
 func tis(z *testing.T, tl *Tasklist, input string, expectedOutput string) {
-	output, _, _, _, _, _, _, err := tl.ParseSearch(input, nil)
+	output, _, _, _, _, _, _, _, err := tl.ParseSearch(input, nil)
 	Must(err)
 	mms_large(z, output, SELECT_HEADER+expectedOutput+"\nGROUP BY tasks.id\nORDER BY priority, trigger_at_field ASC, sort DESC", "")
 	stmt, err := tl.conn.Prepare("EXPLAIN " + output)
@@ -469,20 +478,26 @@ func TestNoQuerySelect(z *testing.T) {
 	tl := ooc()
 	defer tl.Close()
 
-	tis(z, tl, "", "\nWHERE\n   priority <> 5")
+	tis(z, tl, "", "\nWHERE\n   priority <> 5\nAND\n   trashed_at = 0")
 
-	tis(z, tl, "#bib", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5")
+	tis(z, tl, "#bib", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
 
-	tis(z, tl, "#l", "\nWHERE\n   priority = 2")
-	tis(z, tl, "#2010-10-2", "\nWHERE\n   trigger_at_field = '2010-10-02 00:00'\nAND\n   priority <> 5")
+	tis(z, tl, "#l", "\nWHERE\n   priority = 2\nAND\n   trashed_at = 0")
+	tis(z, tl, "#2010-10-2", "\nWHERE\n   trigger_at_field = '2010-10-02 00:00'\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
 
-	tis(z, tl, "#bib#l", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority = 2")
+	tis(z, tl, "#bib#l", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority = 2\nAND\n   trashed_at = 0")
 
-	tis(z, tl, "#bib#bab#bob", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bob')\nAND\n   priority <> 5")
+	tis(z, tl, "#bib#bab#bob", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bob')\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
 
-	tis(z, tl, "#bib#bab#2010-10-02", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   trigger_at_field = '2010-10-02 00:00'\nAND\n   priority <> 5")
+	tis(z, tl, "#bib#bab#2010-10-02", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   trigger_at_field = '2010-10-02 00:00'\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
 	
-	tis(z, tl, "#:when>2023-03-01", "\nWHERE\n   trigger_at_field > '2023-03-01'\nAND\n   priority <> 5")
+	tis(z, tl, "#:when>2023-03-01", "\nWHERE\n   trigger_at_field > '2023-03-01'\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
+	tis(z, tl, "#:created>2023-03-01", "\nWHERE\n   (created_at <> '' AND created_at > '2023-03-01 00:00:00')\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
+	tis(z, tl, "#:modified<2023-03-01", "\nWHERE\n   (modified_at <> '' AND modified_at < '2023-03-01 00:00:00')\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
+
+	Must(tl.SetSetting("timezone", "2"))
+	defer tl.SetSetting("timezone", "")
+	tis(z, tl, "#:created>2023-03-01", "\nWHERE\n   (created_at <> '' AND created_at > '2023-02-28 22:00:00')\nAND\n   priority <> 5\nAND\n   trashed_at = 0")
 }
 
 func TestExclusionSelect(z *testing.T) {
@@ -490,11 +505,11 @@ func TestExclusionSelect(z *testing.T) {
 	tl := ooc()
 	defer tl.Close()
 
-	tis(z, tl, "-#bib", "\nWHERE\n   priority <> 5\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bib')")
+	tis(z, tl, "-#bib", "\nWHERE\n   priority <> 5\nAND\n   trashed_at = 0\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bib')")
 
-	tis(z, tl, "#bib -#bab", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bab')")
+	tis(z, tl, "#bib -#bab", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5\nAND\n   trashed_at = 0\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bab')")
 
-	tis(z, tl, "#bib -#bab -#bob", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bob')")
+	tis(z, tl, "#bib -#bab -#bob", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5\nAND\n   trashed_at = 0\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bab')\nAND\n   id NOT IN (SELECT id FROM columns WHERE name = 'bob')")
 }
 
 func TestOptionsSelect(z *testing.T) {
@@ -502,7 +517,8 @@ func TestOptionsSelect(z *testing.T) {
 	tl := ooc()
 	defer tl.Close()
 
-	tis(z, tl, "#bib#:w/done", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')")
+	tis(z, tl, "#bib#:w/done", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   trashed_at = 0")
+	tis(z, tl, "#bib#:w/trash", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bib')\nAND\n   priority <> 5")
 }
 
 func TestSavedSearchSelect(z *testing.T) {
@@ -510,7 +526,7 @@ func TestSavedSearchSelect(z *testing.T) {
 	tl := ooc()
 	defer tl.Close()
 
-	tis(z, tl, "#%idontexist", "\nWHERE\n   priority <> 5")
+	tis(z, tl, "#%idontexist", "\nWHERE\n   priority <> 5\nAND\n   trashed_at = 0")
 }
 
 func TestQuerySelect(z *testing.T) {
@@ -518,7 +534,7 @@ func TestQuerySelect(z *testing.T) {
 	tl := ooc()
 	defer tl.Close()
 
-	tis(z, tl, "prova prova #bla#blo", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bla')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'blo')\nAND\n   priority <> 5\nAND\n   id IN (\n      SELECT id FROM ridx WHERE title_field MATCH 'prova prova'\n   UNION\n      SELECT id FROM ridx WHERE text_field MATCH 'prova prova')")
+	tis(z, tl, "prova prova #bla#blo", "\nWHERE\n   id IN (SELECT id FROM columns WHERE name = 'bla')\nAND\n   id IN (SELECT id FROM columns WHERE name = 'blo')\nAND\n   priority <> 5\nAND\n   trashed_at = 0\nAND\n   id IN (SELECT id FROM ridx WHERE ridx MATCH '\"prova\" \"prova\"')")
 }
 
 func tsearch(z *testing.T, tl *Tasklist, queryText string, expectedIds []string) {
@@ -528,9 +544,9 @@ func tsearch(z *testing.T, tl *Tasklist, queryText string, expectedIds []string)
 		ids[id] = ""
 	}
 
-	theselect, code, _, _, _, _, _, err := tl.ParseSearch(queryText, nil)
+	theselect, code, _, _, _, _, _, _, err := tl.ParseSearch(queryText, nil)
 	Must(err)
-	entries, err := tl.Retrieve(theselect, code, false)
+	entries, err := tl.Retrieve(theselect, code, false, nil)
 	Must(err)
 
 	if len(entries) != len(ids) {
@@ -581,7 +597,888 @@ func TestLuaSelect(z *testing.T) {
 
 	tsearch(z, tl, "bung #+ notq(orq(columnq('bza'), columnq('bzo')))", []string{"17"})
 
-	theselect, _, _, _, _, _, _, err := tl.ParseSearch("prova #+ orq(columnq('blap', '>', 'burp'), whenq('>', 1275775200))", nil)
+	theselect, _, _, _, _, _, _, _, err := tl.ParseSearch("prova #+ orq(columnq('blap', '>', 'burp'), whenq('>', 1275775200))", nil)
 	Must(err)
 	fmt.Printf("%s \n", theselect)
 }
+
+func trecur(z *testing.T, rule string, start string, expected []string) {
+	r, err := ParseRecurrence(rule, time.UTC)
+	if err != nil {
+		z.Errorf("Error parsing recurrence %s: %s\n", rule, err)
+		return
+	}
+	cur, _ := ParseDateTime(start, time.UTC)
+	first := *cur
+	for i, e := range expected {
+		next, ok := r.Next(*cur, first, i+1, time.UTC)
+		if !ok {
+			z.Errorf("Recurrence %s ended early, expected %s\n", rule, e)
+			return
+		}
+		mms(z, next.Format("2006-01-02"), e, "recurrence "+rule)
+		cur = &next
+	}
+	if _, ok := r.Next(*cur, first, len(expected)+1, time.UTC); ok && (r.Count > 0 || r.Until != nil) {
+		z.Errorf("Recurrence %s didn't end\n", rule)
+	}
+}
+
+func TestRecurrence(z *testing.T) {
+	trecur(z, "weekly", "2013-01-31", []string{"2013-02-07", "2013-02-14"})
+	trecur(z, "every 3 days", "2013-01-31", []string{"2013-02-03", "2013-02-06"})
+	trecur(z, "monthly", "2013-01-31", []string{"2013-02-28", "2013-03-31", "2013-04-30"})
+	trecur(z, "monthly on day 15", "2013-01-31", []string{"2013-02-15", "2013-03-15"})
+	trecur(z, "every 2nd tuesday", "2013-01-01", []string{"2013-01-08", "2013-02-12", "2013-03-12"})
+	trecur(z, "last weekday of month", "2013-01-01", []string{"2013-01-31", "2013-02-28", "2013-03-29"})
+	trecur(z, "every 3 weeks on mon,thu", "2013-01-07", []string{"2013-01-10", "2013-01-28", "2013-01-31"})
+	trecur(z, "daily for 3 times", "2013-01-01", []string{"2013-01-02", "2013-01-03"})
+	trecur(z, "weekly until 2013-01-15", "2013-01-01", []string{"2013-01-08", "2013-01-15"})
+	trecur(z, "yearly", "2012-02-29", []string{"2013-02-28", "2014-02-28"})
+
+	for _, rule := range []string{"", "every bla", "day 40", "0 days", "after tomorrow"} {
+		if _, err := ParseRecurrence(rule, time.UTC); err == nil {
+			z.Errorf("Recurrence %s should not parse\n", rule)
+		}
+	}
+}
+
+func TestPool(z *testing.T) {
+	SetPoolLimits(time.Hour, 1)
+	defer SetPoolLimits(30*time.Minute, 64)
+
+	a, err := OpenOrCreate("/tmp/testing-pool-a.pooch")
+	Must(err)
+	b, err := OpenOrCreate("/tmp/testing-pool-b.pooch")
+	Must(err)
+	if len(pool.open) != 2 {
+		z.Errorf("Both tasklists should be open while in use, open: %d\n", len(pool.open))
+	}
+
+	a.Close()
+	if _, ok := pool.open["/tmp/testing-pool-a.pooch"]; ok {
+		z.Errorf("Tasklist over the limit wasn't closed when released\n")
+	}
+	b.Close()
+	if _, ok := pool.open["/tmp/testing-pool-b.pooch"]; !ok {
+		z.Errorf("Idle tasklist closed before the idle timeout\n")
+	}
+
+	func() {
+		defer func() { recover() }()
+		b, err = OpenOrCreate("/tmp/testing-pool-b.pooch")
+		Must(err)
+		defer b.Close()
+		b.withLock(func() { panic("something bad") })
+	}()
+	if _, ok := pool.open["/tmp/testing-pool-b.pooch"]; ok {
+		z.Errorf("Tasklist wasn't discarded after a panic\n")
+	}
+}
+
+func TestReminders(z *testing.T) {
+	triggerAt := time.Date(2013, 3, 10, 15, 30, 0, 0, time.UTC)
+	r, err := ParseReminders("30m before, 2 hours before, 1 day before, at 09:00", triggerAt, time.UTC)
+	Must(err)
+	expected := []string{"2013-03-10 15:00", "2013-03-10 13:30", "2013-03-09 15:30", "2013-03-10 09:00"}
+	if len(r) != len(expected) {
+		z.Fatalf("Wrong number of reminders: %v\n", r)
+	}
+	for i := range expected {
+		mms(z, r[i].Format("2006-01-02 15:04"), expected[i], "reminder")
+	}
+
+	for _, remind := range []string{"tomorrow", "30 before", "at 25:00"} {
+		if _, err := ParseReminders(remind, triggerAt, time.UTC); err == nil {
+			z.Errorf("Reminder %s should not parse\n", remind)
+		}
+	}
+}
+
+func TestAttachments(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Attach("10", "notes.txt", "", []byte("some notes")))
+	a, err := tl.GetAttachment("10", "notes.txt")
+	Must(err)
+	mms(z, string(a.Data), "some notes", "attachment data")
+	mms(z, a.ContentType, "text/plain; charset=utf-8", "attachment content type")
+
+	tsearch(z, tl, "#:has-attachment", []string{"10"})
+
+	Must(tl.Remove("10"))
+	if _, err := tl.Attachments("10"); !errors.Is(err, ErrNotFound) {
+		z.Errorf("Attachments of a trashed entry should not be accessible: %v\n", err)
+	}
+	Must(tl.Restore("10"))
+	Must(tl.Detach("10", "notes.txt"))
+	tsearch(z, tl, "#:has-attachment", []string{})
+}
+
+func TestLinks(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Link("11", "depends-on", "10"))
+	Must(tl.Link("10", "blocks", "12"))
+	if err := tl.Link("10", "depends-on", "12"); !errors.Is(err, ErrParse) {
+		z.Errorf("Cycle not detected: %v\n", err)
+	}
+
+	tsearch(z, tl, "#:blocked", []string{"11", "12"})
+
+	for _, id := range []string{"11", "12"} {
+		entry, err := tl.Get(id)
+		Must(err)
+		entry.SetPriority(LATER)
+		Must(tl.Update(entry, false))
+	}
+
+	entry, err := tl.Get("10")
+	Must(err)
+	entry.SetPriority(DONE)
+	Must(tl.Update(entry, false))
+
+	tsearch(z, tl, "#:blocked", []string{})
+	entry, err = tl.Get("11")
+	Must(err)
+	if p := entry.Priority(); p != NOW {
+		z.Errorf("Unblocked entry wasn't moved to NOW: %s\n", p.String())
+	}
+}
+
+func TestFTSQuery(z *testing.T) {
+	for _, x := range [][2]string{
+		{"prova", `"prova"`},
+		{"prov* \"due parole\"", `"prov"* "due parole"`},
+		{"bang OR bung", `"bang" OR "bung"`},
+		{"OR bang NOT", `"OR" "bang" "NOT"`},
+		{"a-b:c", `"a-b:c"`},
+	} {
+		if out := FTSQuery(x[0]); out != x[1] {
+			z.Errorf("FTSQuery(%q): expected %q got %q\n", x[0], x[1], out)
+		}
+	}
+
+	tl := ooc()
+	defer tl.Close()
+
+	tsearch(z, tl, "prov*", []string{"10", "12"})
+}
+
+func TestColumnTypes(z *testing.T) {
+	d, err := ParseColumnDuration("1h 30m")
+	Must(err)
+	if d != 5400 {
+		z.Errorf("Wrong duration: %g\n", d)
+	}
+
+	tl := ooc()
+	defer tl.Close()
+
+	// as text "10" < "9"
+	Must(tl.Add(tl.ParseNew("#id=20#estimate=9 short", "")))
+	Must(tl.Add(tl.ParseNew("#id=21#estimate=10 long", "")))
+	Must(tl.DeclareColumnType("estimate", "number", ""))
+	tsearch(z, tl, "#estimate>9", []string{"21"})
+
+	if err := tl.Add(tl.ParseNew("#id=22#estimate=soon bad", "")); !errors.Is(err, ErrParse) {
+		z.Errorf("Invalid number accepted: %v\n", err)
+	}
+
+	Must(tl.DeclareColumnType("state", "enum:todo,doing,done", "bla"))
+	Must(tl.Add(tl.ParseNew("#id=23#bla#state=doing a", "")))
+	Must(tl.Add(tl.ParseNew("#id=24#state=whatever b", "")))
+	tsearch(z, tl, "#state<done", []string{"23"})
+
+	// only the enum declaration can convert high
+	Must(tl.DeclareColumnType("estimate", "enum:low,high,huge", "blo"))
+	Must(tl.Add(tl.ParseNew("#id=25#blo#estimate=huge c", "")))
+	tsearch(z, tl, "#estimate>high", []string{"25"})
+	if _, _, _, _, _, _, _, _, err := tl.ParseSearch("#estimate>whatever", nil); !errors.Is(err, ErrParse) {
+		z.Errorf("Value not convertible to any declared type accepted: %v\n", err)
+	}
+}
+
+func TestAggregates(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Add(tl.ParseNew("#id=20#project=a#estimate=2 one", "")))
+	Must(tl.Add(tl.ParseNew("#id=21#project=a#estimate=3 two", "")))
+	Must(tl.Add(tl.ParseNew("#id=22#project=b#estimate=4 three", "")))
+
+	pr := tl.ParseEx("#:group=project #:sum=estimate #:avg=estimate #:count #estimate")
+	spec := AggregateSpecFromOptions(pr.options)
+	if spec == nil {
+		z.Fatalf("No aggregates in %v\n", pr.options)
+	}
+
+	entries := []*Entry{}
+	for _, id := range []string{"20", "21", "22", "10"} {
+		entry, err := tl.Get(id)
+		Must(err)
+		entries = append(entries, entry)
+	}
+
+	agg, err := tl.Aggregate(entries, spec)
+	Must(err)
+	if len(agg.Groups) != 3 {
+		z.Fatalf("Wrong number of groups: %d\n", len(agg.Groups))
+	}
+	mms(z, agg.Groups[0].String(), "count 2, sum(estimate) 5, avg(estimate) 2.5", "group a")
+	mms(z, agg.Groups[2].Group, "", "entries without the column")
+	mms(z, agg.Total.String(), "count 4, sum(estimate) 9, avg(estimate) 3", "total")
+}
+
+func TestTimeTracking(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	_, err := tl.StartTimer("10")
+	Must(err)
+	stopped, err := tl.StartTimer("11")
+	Must(err)
+	if stopped == nil || stopped.Id != "10" {
+		z.Errorf("Starting a timer didn't stop the running one: %v\n", stopped)
+	}
+	stopped, err = tl.StopTimer()
+	Must(err)
+	mms(z, stopped.Id, "11", "stopped timer")
+	if _, err := tl.StopTimer(); !errors.Is(err, ErrNotFound) {
+		z.Errorf("Stopped a timer that wasn't running: %v\n", err)
+	}
+
+	tl.MustExec("DELETE FROM timelog")
+	tl.MustExec("INSERT INTO timelog(id, started_at, stopped_at) VALUES ('10', '2013-03-10 09:00:00', '2013-03-10 10:00:00')")
+	tl.MustExec("INSERT INTO timelog(id, started_at, stopped_at) VALUES ('12', '2013-03-11 09:00:00', '2013-03-11 09:30:00')")
+
+	report, err := tl.TimeReport("#bla", nil, nil)
+	Must(err)
+	mms(z, report.Total.DurationString(), "1h30m", "total")
+	if len(report.Entries) != 2 || report.Entries[0].Name != "10" {
+		z.Errorf("Wrong entries in report: %v\n", report.Entries)
+	}
+
+	from := time.Date(2013, 3, 10, 9, 30, 0, 0, time.UTC)
+	to := time.Date(2013, 3, 11, 0, 0, 0, 0, time.UTC)
+	report, err = tl.TimeReport("", &from, &to)
+	Must(err)
+	mms(z, report.Total.DurationString(), "30m", "clipped total")
+}
+
+func TestExportImport(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.SaveSearch("provas", "prova"))
+	Must(tl.Link("11", "depends-on", "10"))
+	Must(tl.Remove("17"))
+
+	var first bytes.Buffer
+	Must(tl.ExportTo(&first, true))
+
+	other, err := OpenOrCreate("/tmp/testing-import.pooch")
+	Must(err)
+	defer other.Close()
+
+	ex, err := ReadExport(bytes.NewReader(first.Bytes()))
+	Must(err)
+	Must(other.Import(ex, true, true))
+
+	var second bytes.Buffer
+	Must(other.ExportTo(&second, true))
+
+	if first.String() != second.String() {
+		z.Errorf("Export didn't round-trip:\n%s\n%s\n", first.String(), second.String())
+	}
+}
+
+func TestExportPrivateSettings(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.SetPrivateSetting("notify_command", "echo"))
+	defer tl.SetPrivateSetting("notify_command", "")
+
+	ex, err := tl.Export(false)
+	Must(err)
+	if _, ok := ex.PrivateSettings["notify_command"]; ok {
+		z.Errorf("Private setting exported without private\n")
+	}
+
+	ex, err = tl.Export(true)
+	Must(err)
+	mms(z, ex.PrivateSettings["notify_command"], "echo", "exported private setting")
+
+	other, err := OpenOrCreate("/tmp/testing-import.pooch")
+	Must(err)
+	defer other.Close()
+	Must(other.SetPrivateSetting("notify_command", ""))
+
+	Must(other.Import(ex, true, false))
+	mms(z, other.GetPrivateSetting("notify_command"), "", "private setting imported without private")
+	Must(other.Import(ex, true, true))
+	mms(z, other.GetPrivateSetting("notify_command"), "echo", "imported private setting")
+	Must(other.SetPrivateSetting("notify_command", ""))
+}
+
+func tics(z *testing.T, rule string, start string, count string, expected string) {
+	t, _ := ParseDateTime(start, time.UTC)
+	e := MakeEntry("1", "test", "", TIMED, t, "", Columns{"recur": rule})
+	if count != "" {
+		e.SetColumn("recur-count", count)
+	}
+	mms(z, icsRRule(e.Recurrence(time.UTC), e, time.UTC), expected, "rrule of "+rule)
+}
+
+func TestICS(z *testing.T) {
+	tics(z, "weekly", "2013-01-31", "", "FREQ=WEEKLY")
+	tics(z, "every 3 weeks on mon,thu", "2013-01-07 10:00", "", "FREQ=WEEKLY;INTERVAL=3;BYDAY=MO,TH;WKST=MO")
+	tics(z, "monthly", "2013-01-31", "", "FREQ=MONTHLY;BYMONTHDAY=28,29,30,31;BYSETPOS=-1")
+	tics(z, "every 2nd tuesday", "2013-01-08", "", "FREQ=MONTHLY;BYDAY=2TU")
+	tics(z, "last weekday of month", "2013-01-31", "", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1")
+	tics(z, "daily for 3 times", "2013-01-02", "2", "FREQ=DAILY;COUNT=2")
+	tics(z, "weekly until 2013-01-15", "2013-01-01 09:00", "", "FREQ=WEEKLY;UNTIL=20130115T235959Z")
+	tics(z, "7 days after completion", "2013-01-01", "", "")
+
+	// the days of the rule follow DTSTART, which is in UTC
+	tz := time.FixedZone("UTC+2", 2*60*60)
+	t, _ := ParseDateTime("2013-01-07 01:00", tz)
+	e := MakeEntry("1", "test", "", TIMED, t, "", Columns{"recur": "every 3 weeks on mon,thu"})
+	mms(z, icsRRule(e.Recurrence(tz), e, tz), "FREQ=WEEKLY;INTERVAL=3;BYDAY=SU,WE;WKST=MO", "rrule shifted to UTC")
+	e.SetColumn("recur", "every 2nd tuesday")
+	mms(z, icsRRule(e.Recurrence(tz), e, tz), "", "monthly rrule shifted to UTC")
+
+	mms(z, icsEscape("a, b; c\nd"), "a\\, b\\; c\\nd", "escape")
+	if folded := icsFold(strings.Repeat("x", 100)); folded != strings.Repeat("x", 75)+"\r\n "+strings.Repeat("x", 25)+"\r\n" {
+		z.Errorf("Wrong folding: %q\n", folded)
+	}
+
+	tl := ooc()
+	defer tl.Close()
+
+	var buf bytes.Buffer
+	Must(tl.WriteICS(&buf, "bang"))
+	out := buf.String()
+	if !strings.Contains(out, "\r\nDTSTART;VALUE=DATE:20100101\r\n") || strings.Count(out, "BEGIN:VEVENT") != 2 {
+		z.Errorf("Wrong events in feed:\n%s\n", out)
+	}
+
+	buf.Reset()
+	Must(tl.WriteICS(&buf, "#bla"))
+	if strings.Count(buf.String(), "BEGIN:VTODO") != 3 {
+		z.Errorf("Wrong todos in feed:\n%s\n", buf.String())
+	}
+}
+
+func TestImportICS(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:meeting-1\r\nSUMMARY:Weekly\\, meeting\r\nDESCRIPTION:first line\\nsecond line\r\nDTSTART:20130107T100000Z\r\nRRULE:FREQ=WEEKLY;BYDAY=MO,TH\r\nCATEGORIES:Work,Big Things\r\nEND:VEVENT\r\nBEGIN:VTODO\r\nUID:todo-1\r\nSUMMARY:call\r\n  back\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+
+	added, updated, err := tl.ImportICS(strings.NewReader(ics), "#imported")
+	Must(err)
+	if added != 2 || updated != 0 {
+		z.Errorf("Wrong import counts: %d %d\n", added, updated)
+	}
+
+	id := tl.icsEntryId("meeting-1")
+	e, err := tl.Get(id)
+	Must(err)
+	mms(z, e.Title(), "Weekly, meeting", "title")
+	mms(z, e.Text(), "first line\nsecond line", "text")
+	mms(z, e.Column("recur"), "weekly on monday,thursday", "recurrence")
+	mms(z, e.TriggerAt().Format("2006-01-02 15:04"), "2013-01-07 10:00", "time")
+	if e.Priority() != TIMED {
+		z.Errorf("Wrong priority: %v\n", e.Priority())
+	}
+	for _, tag := range []string{"work", "big-things", "imported"} {
+		if _, ok := e.ColumnOk(tag); !ok {
+			z.Errorf("Missing tag %s: %v\n", tag, e.Columns())
+		}
+	}
+
+	todo, err := tl.Get(tl.icsEntryId("todo-1"))
+	Must(err)
+	mms(z, todo.Title(), "call back", "todo title")
+
+	added, updated, err = tl.ImportICS(strings.NewReader(strings.Replace(ics, "Weekly\\, meeting", "Moved", 1)), "")
+	Must(err)
+	if added != 0 || updated != 2 {
+		z.Errorf("Reimport didn't update: %d %d\n", added, updated)
+	}
+	e, err = tl.Get(id)
+	Must(err)
+	mms(z, e.Title(), "Moved", "updated title")
+
+	rule, _ := recurFromRRule("FREQ=MONTHLY;BYDAY=-1FR", *e.TriggerAt(), time.UTC)
+	mms(z, rule, "monthly on the last friday", "monthly rrule")
+	if _, ok := recurFromRRule("FREQ=WEEKLY;BYHOUR=10", *e.TriggerAt(), time.UTC); ok {
+		z.Errorf("Converted an unsupported RRULE\n")
+	}
+}
+
+func TestTodoTxt(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	e, err := parseTodoTxtLine("x 2013-03-10 2013-03-01 buy milk +shopping @home est:1h id:x1", time.UTC)
+	Must(err)
+	mms(z, e.Title(), "buy milk", "title")
+	mms(z, e.Column("done-at"), "2013-03-10_00:00:00", "done-at")
+	mms(z, todoTxtLine(e, time.UTC), "x 2013-03-10 2013-03-01 buy milk +home +shopping est:1h id:x1", "line")
+
+	// title words that look like tags, columns or a date are escaped
+	e = MakeEntry("x2", "2013-03-01 meet at 10:30 re:x +1 @home \\x", "", NOW, nil, "", Columns{"home": ""})
+	line := todoTxtLine(e, time.UTC)
+	mms(z, line, "(B) \\2013-03-01 meet at \\10:30 \\re:x \\+1 \\@home \\\\x +home id:x2", "escaped line")
+	e, err = parseTodoTxtLine(line, time.UTC)
+	Must(err)
+	mms(z, e.Title(), "2013-03-01 meet at 10:30 re:x +1 @home \\x", "escaped title")
+	if len(e.Columns()) != 1 || e.Column("home") != "" {
+		z.Errorf("Wrong columns from escaped title: %v\n", e.Columns())
+	}
+
+	e, err = parseTodoTxtLine("(A) call +family due:2013-03-12 at:10:30", time.UTC)
+	Must(err)
+	if e.Priority() != STICKY || e.TriggerAt().Format("2006-01-02 15:04") != "2013-03-12 10:30" {
+		z.Errorf("Wrong priority or time: %v %v\n", e.Priority(), e.TriggerAt())
+	}
+
+	var buf bytes.Buffer
+	Must(tl.TodoTxtExport(&buf, "#bib"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " id:11") && !strings.HasSuffix(lines[1], " id:11") {
+		z.Errorf("Wrong export:\n%s\n", buf.String())
+	}
+
+	// an unchanged file doesn't update anything
+	added, updated, err := tl.TodoTxtImport(strings.NewReader(buf.String()))
+	Must(err)
+	if added != 0 || updated != 0 {
+		z.Errorf("Unchanged file imported: %d %d\n", added, updated)
+	}
+
+	edited := strings.Replace(buf.String(), "ging bong un", "ding dong", 1) + "(C) new thing +bla\n"
+	added, updated, err = tl.TodoTxtImport(strings.NewReader(edited))
+	Must(err)
+	if added != 1 || updated != 1 {
+		z.Errorf("Wrong import counts: %d %d\n", added, updated)
+	}
+	e, err = tl.Get("11")
+	Must(err)
+	mms(z, e.Title(), "ding dong", "updated title")
+	mms(z, e.Column("bib"), "10", "kept column")
+}
+
+func TestOutline(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	nodes := explodeBody("-first\n  some text\n  - nested\n    - deeper\n-second")
+	if len(nodes) != 2 || len(nodes[0].Children) != 1 || len(nodes[0].Children[0].Children) != 1 {
+		z.Fatalf("Wrong explode tree: %v\n", nodes)
+	}
+	mms(z, nodes[0].Entry.Text(), "some text", "exploded text")
+	mms(z, nodes[0].Children[0].Children[0].Entry.Title(), "deeper", "exploded subitem")
+
+	org := "preamble\n* TODO Project :work:\n  :PROPERTIES:\n  :who: bob\n  :END:\n  notes\n** DONE Step one\n   CLOSED: [2013-03-10 Sun 10:00]\n** TODO [#C] Step two\n*** Detail\n"
+	added, updated, err := tl.ImportOrg(strings.NewReader(org), "#bla")
+	Must(err)
+	if added != 4 || updated != 0 {
+		z.Errorf("Wrong import counts: %d %d\n", added, updated)
+	}
+
+	var buf bytes.Buffer
+	Must(tl.ExportOrg(&buf, "#work"))
+	out := buf.String()
+	for _, s := range []string{"* TODO Project :bla:work:\n", "  :who: bob\n", "** DONE Step one\n   CLOSED: [2013-03-10 Sun 10:00]\n", "** TODO [#C] Step two\n", "*** Detail\n"} {
+		if !strings.Contains(out, s) {
+			z.Errorf("Missing %q in export:\n%s\n", s, out)
+		}
+	}
+
+	// exporting and importing again doesn't change anything
+	added, updated, err = tl.ImportOrg(strings.NewReader(out), "")
+	Must(err)
+	if added != 0 || updated != 0 {
+		z.Errorf("Unchanged file imported: %d %d\n", added, updated)
+	}
+
+	// columns the file can't hold are kept when a heading is edited
+	Must(tl.Add(MakeEntry("o2", "keep columns", "", NOW, nil, "", Columns{"orgkeep": "", "a:b": "", "sub/10": "3", "note": "two\nlines"})))
+	buf.Reset()
+	Must(tl.ExportOrg(&buf, "#orgkeep"))
+	if out := buf.String(); strings.Contains(out, "a:b") || strings.Contains(out, "two") {
+		z.Errorf("Unrepresentable columns in export:\n%s\n", out)
+	}
+	added, updated, err = tl.ImportOrg(strings.NewReader(strings.Replace(buf.String(), "keep columns", "kept columns", 1)), "")
+	Must(err)
+	if added != 0 || updated != 1 {
+		z.Errorf("Wrong import counts: %d %d\n", added, updated)
+	}
+	e, err := tl.Get("o2")
+	Must(err)
+	mms(z, e.Title(), "kept columns", "updated title")
+	mms(z, e.Column("sub/10"), "3", "foreign sub column")
+	mms(z, e.Column("note"), "two\nlines", "multi-line column")
+	if _, ok := e.ColumnOk("a:b"); !ok {
+		z.Errorf("Lost tag a:b: %v\n", e.Columns())
+	}
+	if _, ok := e.ColumnOk("uncat"); ok {
+		z.Errorf("Tagged entry is uncat: %v\n", e.Columns())
+	}
+
+	// duplicate ids are rejected
+	if _, _, err := tl.ImportOrg(strings.NewReader("* one\n  :PROPERTIES:\n  :ID: d1\n  :END:\n* two\n  :PROPERTIES:\n  :ID: d1\n  :END:\n"), ""); err == nil {
+		z.Errorf("Duplicate id imported\n")
+	}
+}
+
+func TestCsvImport(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	mapping, err := ParseCsvMapping([]string{"Name=title", "Due=when", "Kind=priority", "Labels=tag", "Estimate=est"})
+	Must(err)
+
+	csvText := "Name,Due,Kind,Labels,Estimate\nbuy milk,,later,\"shopping, home\",\ncall bob,2013-03-12,,,1h\n"
+	entries, err := tl.ImportCSV(strings.NewReader(csvText), ',', mapping, "#csv", true)
+	Must(err)
+	if len(entries) != 2 || entries[0].Priority() != LATER || entries[1].Priority() != TIMED {
+		z.Fatalf("Wrong entries: %v\n", entries)
+	}
+	mms(z, entries[1].Column("est"), "1h", "named column")
+	if _, ok := entries[0].ColumnOk("shopping"); !ok {
+		z.Errorf("Missing tag: %v\n", entries[0].Columns())
+	}
+	if len(tl.queryIds("SELECT id FROM columns WHERE name = 'csv'")) != 0 {
+		z.Errorf("Dry run changed the tasklist\n")
+	}
+
+	// a bad row leaves the tasklist untouched
+	_, err = tl.ImportCSV(strings.NewReader(csvText+"bad,tomorrowish,,,\n"), ',', mapping, "#csv", false)
+	if err == nil || !strings.Contains(err.Error(), "line 4:") {
+		z.Errorf("Wrong error: %v\n", err)
+	}
+	if len(tl.queryIds("SELECT id FROM columns WHERE name = 'csv'")) != 0 {
+		z.Errorf("Bad file changed the tasklist\n")
+	}
+
+	_, err = tl.ImportCSV(strings.NewReader(csvText), ',', mapping, "#csv", false)
+	Must(err)
+	if len(tl.queryIds("SELECT id FROM columns WHERE name = 'csv'")) != 2 {
+		z.Errorf("Entries not added\n")
+	}
+}
+
+func TestMerge(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	base, err := tl.Export(false)
+	Must(err)
+	// the file is read without going through OpenOrCreate
+	theirs, err := ExportFile("/tmp/testing.pooch", false)
+	Must(err)
+	if len(theirs.Entries) != len(base.Entries) {
+		z.Fatalf("Wrong export of file: %d %d\n", len(theirs.Entries), len(base.Entries))
+	}
+	for _, e := range theirs.Entries {
+		if e.Id == "11" {
+			e.Text = "their text"
+			e.Columns["bib"] = "20"
+		}
+	}
+	theirs.SavedSearches["merged"] = "#bib"
+
+	e, err := tl.Get("11")
+	Must(err)
+	e.SetTitle("our title")
+	e.SetColumn("bib", "30")
+	Must(tl.Update(e, false))
+
+	report, err := tl.Merge(base, theirs)
+	Must(err)
+	if report.Updated != 1 || len(report.Conflicts) != 1 || report.Conflicts[0].CopyId == "" {
+		z.Fatalf("Wrong report: %v\n", report)
+	}
+
+	e, err = tl.Get("11")
+	Must(err)
+	mms(z, e.Title(), "our title", "our change")
+	mms(z, e.Text(), "their text", "their change")
+	mms(z, e.Column("bib"), "30", "conflicting column")
+
+	c, err := tl.Get(report.Conflicts[0].CopyId)
+	Must(err)
+	mms(z, c.Column("bib"), "20", "conflict copy")
+	mms(z, c.Column("conflict-of"), "11", "conflict-of")
+	if _, ok := c.ColumnOk("conflict"); !ok {
+		z.Errorf("Conflict copy not tagged: %v\n", c.Columns())
+	}
+
+	mms(z, tl.GetSavedSearch("merged"), "#bib", "merged saved search")
+}
+
+func TestSearchTasklists(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	other, err := OpenOrCreate("/tmp/testing2.pooch")
+	Must(err)
+	defer other.Close()
+	other.Truncate()
+	Must(other.Add(other.ParseNew("#id=20#bla other tasklist", "")))
+
+	os.Setenv("POOCHPATH", "/tmp")
+	Must(tl.SaveSearch("agenda", "#bla #:in=testing,testing2"))
+
+	query, filenames, err := tl.SearchScope("#%agenda", "")
+	Must(err)
+	if len(filenames) != 2 {
+		z.Fatalf("Wrong tasklists: %v\n", filenames)
+	}
+
+	entries, showCols, err := tl.SearchTasklists(query, filenames)
+	Must(err)
+	mms(z, showCols[0], TASKLIST_COLUMN, "tasklist column")
+	found := map[string]string{}
+	for _, e := range entries {
+		found[e.Id()] = e.Column(TASKLIST_COLUMN)
+	}
+	mms(z, found["10"], "testing", "entry of the current tasklist")
+	mms(z, found["20"], "testing2", "entry of the other tasklist")
+
+	_, filenames, err = tl.SearchScope("#bla", "")
+	Must(err)
+	if filenames != nil {
+		z.Errorf("Search without in option in other tasklists: %v\n", filenames)
+	}
+
+	// only names of tasklists in POOCHPATH
+	if _, _, err := tl.SearchScope("#bla", "/tmp/testing2.pooch"); !errors.Is(err, ErrNotFound) {
+		z.Errorf("Searched a tasklist by path: %v\n", err)
+	}
+}
+
+func TestSecret(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.SetSetting("secrettag", "secret"))
+
+	e := tl.ParseNew("router password #secret", "")
+	e.SetText("hunter2 swordfish")
+	if err := tl.Add(e); err == nil {
+		z.Fatalf("Secret entry added without unlocking\n")
+	}
+
+	tl.MustExec("DELETE FROM private_settings WHERE name IN ('secret_salt', 'secret_check')")
+	if _, err := tl.SecretKey("correct horse"); err == nil {
+		z.Fatalf("Unlocked without a passphrase\n")
+	}
+	Must(tl.SetPassphrase("correct horse"))
+	if err := tl.SetPassphrase("other horse"); err == nil {
+		z.Fatalf("Passphrase changed\n")
+	}
+
+	key, err := tl.SecretKey("correct horse")
+	Must(err)
+	if _, err := tl.SecretKey("wrong horse"); err == nil {
+		z.Fatalf("Wrong passphrase accepted\n")
+	}
+
+	tl.Unlock(key)
+	e.SetId(tl.MakeRandomId())
+	Must(tl.Add(e))
+
+	stmt, err := tl.conn.Prepare("SELECT text_field FROM tasks WHERE id = ?")
+	Must(err)
+	Must(stmt.Exec(e.Id()))
+	stored := ""
+	if stmt.Next() {
+		Must(stmt.Scan(&stored))
+	}
+	stmt.Finalize()
+	if !IsEncrypted(stored) || strings.Contains(stored, "hunter2") {
+		z.Fatalf("Text not encrypted: %s\n", stored)
+	}
+
+	found := false
+	tl.forRows("SELECT id FROM ridx WHERE ridx MATCH 'swordfish'", func(scan func(dst ...interface{})) { found = true })
+	if found {
+		z.Fatalf("Encrypted text indexed\n")
+	}
+
+	got, err := tl.Get(e.Id())
+	Must(err)
+	mms(z, got.Text(), "hunter2 swordfish", "unlocked text")
+
+	tl.Unlock(nil)
+	got, err = tl.Get(e.Id())
+	Must(err)
+	mms(z, got.Text(), stored, "locked text")
+
+	// the tag can't be added to an entry with text while locked
+	plain := tl.ParseNew("#id=30#pin plain note", "")
+	plain.SetText("pin 1234")
+	Must(tl.Add(plain))
+	tagged := tl.ParseNew("#id=30#pin#secret plain note", "")
+	tagged.SetText("pin 1234")
+	if err := tl.Update(tagged, false); err == nil {
+		z.Errorf("Secret tag added while locked\n")
+	}
+
+	// entries that have the tag when secrettag is set
+	changed := tl.ParseNew("#id=30#pin changed note", "")
+	changed.SetText("pin 1234")
+	Must(tl.Update(changed, false))
+	Must(tl.SetSetting("secrettag", "pin"))
+	defer tl.SetSetting("secrettag", "secret")
+	found = false
+	tl.forRows("SELECT id FROM ridx WHERE ridx MATCH '1234'", func(scan func(dst ...interface{})) { found = true })
+	tl.forRows("SELECT id FROM history WHERE id = '30' AND text_field <> ''", func(scan func(dst ...interface{})) { found = true })
+	if found {
+		z.Errorf("Text of tagged entry left in ridx or history\n")
+	}
+}
+
+func TestRestore(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Add(tl.ParseNew("#id=20#sub/10=1 first child", "")))
+	Must(tl.Add(tl.ParseNew("#id=21#sub/10=2 second child", "")))
+
+	tl.WithTransaction(func() { tl.trash("20", 1000) })
+	tl.WithTransaction(func() { tl.trash("10", 2000) })
+	if !tl.isTrashed("21") {
+		z.Fatalf("Child not trashed with its parent\n")
+	}
+
+	Must(tl.Restore("10"))
+	if tl.isTrashed("10") || tl.isTrashed("21") {
+		z.Errorf("Parent or child trashed with it not restored\n")
+	}
+	if !tl.isTrashed("20") {
+		z.Errorf("Child trashed before its parent was restored\n")
+	}
+}
+
+func TestRenameEntry(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Add(tl.ParseNew("#id=20#sub/10=1 child", "")))
+	Must(tl.Attach("10", "notes.txt", "", []byte("some notes")))
+	Must(tl.Link("11", "depends-on", "10"))
+
+	Must(tl.RenameEntry("10", "30"))
+	if tl.Exists("10") || !tl.Exists("30") {
+		z.Fatalf("Entry not renamed\n")
+	}
+	if err := tl.RenameEntry("30", "11"); !errors.Is(err, ErrParse) {
+		z.Errorf("Rename over an existing entry not refused: %v\n", err)
+	}
+
+	a, err := tl.GetAttachment("30", "notes.txt")
+	Must(err)
+	mms(z, string(a.Data), "some notes", "attachment of renamed entry")
+	tsearch(z, tl, "#:blocked", []string{"11"})
+	children := tl.GetChildren("30")
+	if len(children) != 1 || children[0] != "20" {
+		z.Errorf("Subitems not moved: %v\n", children)
+	}
+}
+
+func TestUnblockOnRemove(z *testing.T) {
+	tl := ooc()
+	defer tl.Close()
+
+	Must(tl.Link("11", "depends-on", "10"))
+	Must(tl.Link("12", "depends-on", "13"))
+	for _, id := range []string{"11", "12"} {
+		entry, err := tl.Get(id)
+		Must(err)
+		entry.SetPriority(LATER)
+		Must(tl.Update(entry, false))
+	}
+
+	Must(tl.Remove("10"))
+	Must(tl.Purge("13"))
+
+	for _, id := range []string{"11", "12"} {
+		entry, err := tl.Get(id)
+		Must(err)
+		if p := entry.Priority(); p != NOW {
+			z.Errorf("Entry %s wasn't unblocked: %s\n", id, p.String())
+		}
+	}
+}
+
+func countRows(conn *sqlite.Conn, query string) int {
+	stmt, err := conn.Prepare(query)
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec())
+	n := 0
+	if stmt.Next() {
+		Must(stmt.Scan(&n))
+	}
+	return n
+}
+
+func TestMigrateSchema(z *testing.T) {
+	const filename = "/tmp/testing-schema.pooch"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	// a database from before schema_version, with one entry
+	conn, err := sqlite.Open(filename)
+	Must(err)
+	MustExec(conn, "CREATE TABLE tasks(id TEXT PRIMARY KEY, title_field TEXT, text_field TEXT, priority INTEGER, trigger_at_field DATE, sort TEXT);")
+	MustExec(conn, "INSERT INTO tasks(id, title_field, text_field, priority, trigger_at_field, sort) VALUES ('m1', 'old entry', '', 1, NULL, 'a');")
+	if v := SchemaVersion(conn); v != 0 {
+		z.Fatalf("Wrong initial schema version: %d\n", v)
+	}
+
+	MigrateSchema(filename, conn)
+	if v := SchemaVersion(conn); v != SchemaVersionLatest() {
+		z.Errorf("Wrong schema version after migration: %d\n", v)
+	}
+	for _, table := range []string{"history", "timelog", "coltypes", "ridx"} {
+		if !HasTable(conn, table) {
+			z.Errorf("Missing table %s after migration\n", table)
+		}
+	}
+	if n := countRows(conn, "SELECT count(*) FROM ridx WHERE id = 'm1'"); n != 1 {
+		z.Errorf("Wrong number of indexed rows: %d\n", n)
+	}
+	conn.Close()
+
+	// reopening a migrated database doesn't run any step again
+	conn, err = sqlite.Open(filename)
+	Must(err)
+	defer conn.Close()
+	MigrateSchema(filename, conn)
+	if migrateSchemaStep(conn, 7) {
+		z.Errorf("Step ran on a migrated database\n")
+	}
+	if v := SchemaVersion(conn); v != SchemaVersionLatest() {
+		z.Errorf("Wrong schema version after reopening: %d\n", v)
+	}
+	if n := countRows(conn, "SELECT count(*) FROM ridx WHERE id = 'm1'"); n != 1 {
+		z.Errorf("Wrong number of indexed rows after reopening: %d\n", n)
+	}
+
+	tl, err := OpenOrCreate(filename)
+	Must(err)
+	defer tl.Close()
+	e, err := tl.Get("m1")
+	Must(err)
+	mms(z, e.Title(), "old entry", "migrated entry")
+}
@@ -80,11 +80,12 @@ func nfUpdateHandler(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 		returnJson(c, "Not allowed on non-tasks", nil)
 		return
 	}
-	entry := tl.Get(realId)
+	entry, err := tl.Get(realId)
+	Must(err)
 	title, text, _ := parseUpdateBody(body)
 	entry.SetTitle(title)
 	entry.SetText(text)
-	tl.Update(entry, false)
+	Must(tl.Update(entry, false))
 	returnJson(c, "", []*Object{entryToObject(entry)})
 }
 
@@ -111,7 +112,8 @@ func panicToErrors(w http.ResponseWriter) {
 		return
 	}
 	WriteStackTrace(rerr, os.Stderr)
-	b, _ := json.Marshal(&JsonResult{Error: rerr.(error).Error()})
+	b, _ := json.Marshal(&JsonResult{Error: fmt.Sprint(rerr)})
+	w.WriteHeader(errorStatus(rerr))
 	w.Write(b)
 }
 
@@ -0,0 +1,183 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+ Notifiers deliver reminders. They are configured with private settings
+ (which can only be changed from the command line, see setopt):
+
+	notify_command		shell command, the reminder is passed in the
+				POOCH_* environment variables
+	notify_smtp_server	host:port of the SMTP relay, also needs
+				notify_smtp_from and notify_smtp_to (comma
+				separated), notify_smtp_user and
+				notify_smtp_password are optional
+	notify_url		URL where the reminder is POSTed as JSON
+
+ Every configured notifier is used.
+*/
+
+const NOTIFY_TIMEOUT = time.Minute
+
+type Notifier interface {
+	// Name used to record delivery attempts
+	Name() string
+	Notify(r *Reminder) error
+}
+
+func (tl *Tasklist) notifiers() []Notifier {
+	r := []Notifier{}
+	if command := tl.GetPrivateSetting("notify_command"); command != "" {
+		r = append(r, &CommandNotifier{command})
+	}
+	if server := tl.GetPrivateSetting("notify_smtp_server"); server != "" {
+		to := []string{}
+		for _, addr := range strings.Split(tl.GetPrivateSetting("notify_smtp_to"), ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		r = append(r, &SMTPNotifier{server, tl.GetPrivateSetting("notify_smtp_from"), to, tl.GetPrivateSetting("notify_smtp_user"), tl.GetPrivateSetting("notify_smtp_password")})
+	}
+	if url := tl.GetPrivateSetting("notify_url"); url != "" {
+		r = append(r, &URLNotifier{url})
+	}
+	return r
+}
+
+func (r *Reminder) TriggerAtString() string {
+	return r.Entry.TriggerAtString(r.Timezone)
+}
+
+func (r *Reminder) Subject() string {
+	return fmt.Sprintf("Reminder: %s (%s)", r.Entry.Title(), r.TriggerAtString())
+}
+
+type CommandNotifier struct {
+	command string
+}
+
+func (n *CommandNotifier) Name() string {
+	return "command"
+}
+
+func (n *CommandNotifier) Notify(r *Reminder) error {
+	cmd := exec.Command("/bin/sh", "-c", n.command)
+	cmd.Env = append(os.Environ(),
+		"POOCH_TASKLIST="+r.Tasklist,
+		"POOCH_ID="+r.Entry.Id(),
+		"POOCH_TITLE="+r.Entry.Title(),
+		"POOCH_TEXT="+r.Entry.Text(),
+		"POOCH_WHEN="+r.TriggerAtString(),
+		"POOCH_REMIND_AT="+r.RemindAt.In(r.Timezone).Format(TRIGGER_AT_FORMAT))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	case <-time.After(NOTIFY_TIMEOUT):
+		cmd.Process.Kill()
+		return fmt.Errorf("Command timed out")
+	}
+}
+
+type SMTPNotifier struct {
+	server   string
+	from     string
+	to       []string
+	user     string
+	password string
+}
+
+func (n *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *SMTPNotifier) Notify(r *Reminder) error {
+	if n.from == "" || len(n.to) == 0 {
+		return fmt.Errorf("notify_smtp_from and notify_smtp_to must be set")
+	}
+
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, err := net.SplitHostPort(n.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	subject := strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(r.Subject())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nWhen: %s\r\n\r\n%s\r\n", r.Entry.Title(), r.TriggerAtString(), r.Entry.Text())
+
+	return smtp.SendMail(n.server, auth, n.from, n.to, msg.Bytes())
+}
+
+type URLNotifier struct {
+	url string
+}
+
+func (n *URLNotifier) Name() string {
+	return "url"
+}
+
+func (n *URLNotifier) Notify(r *Reminder) error {
+	body, err := json.Marshal(map[string]string{
+		"tasklist": r.Tasklist,
+		"id":       r.Entry.Id(),
+		"title":    r.Entry.Title(),
+		"text":     r.Entry.Text(),
+		"when":     r.Entry.TriggerAt().In(r.Timezone).Format(time.RFC3339),
+		"remindAt": r.RemindAt.In(r.Timezone).Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: NOTIFY_TIMEOUT}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,542 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ Search results can be exported as Markdown lists or Org-mode outlines,
+ subitems (see GetChildren) are nested under their parent. In Org-mode:
+
+	TODO		now, later ([#C]) and timed entries
+	DONE		done entries, CLOSED is the date of done-at
+	no keyword	notes and sticky ([#A]) entries
+	SCHEDULED	time of the entry
+	:tag:		tags
+	:PROPERTIES:	columns, ID is the id of the entry
+
+ Org-mode files are imported back with the same conventions, nested
+ headings become subitems. Headings with the ID of an existing entry update
+ it instead of adding a new entry, keeping the columns the file can't hold
+ (see keepOrgColumns). An ID can only appear once. Every heading is checked
+ before the tasklist is changed and the entries are written in a single
+ transaction.
+*/
+
+type outlineNode struct {
+	Entry    *Entry
+	Children []*outlineNode
+}
+
+// Returns the entries matching queryText with their subitems
+func (tl *Tasklist) outline(queryText string) []*outlineNode {
+	theselect, code, _, _, _, _, _, sortCols, perr := tl.ParseSearch(queryText, nil)
+	Must(perr)
+	entries, rerr := tl.Retrieve(theselect, code, false, sortCols)
+	Must(rerr)
+
+	seen := map[string]bool{}
+	var children func(id string) []*outlineNode
+	children = func(id string) []*outlineNode {
+		r := []*outlineNode{}
+		for _, child := range tl.GetChildren(id) {
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			r = append(r, &outlineNode{tl.get(child), children(child)})
+		}
+		return r
+	}
+
+	r := []*outlineNode{}
+	for _, e := range entries {
+		seen[e.Id()] = true
+		r = append(r, &outlineNode{e, children(e.Id())})
+	}
+	return r
+}
+
+// Tags and columns of an outline entry, without the ones that describe the hierarchy
+func outlineColumns(e *Entry) (tags []string, cols []string) {
+	for name, value := range e.Columns() {
+		switch {
+		case strings.HasPrefix(name, "sub/") || name == "uncat" || name == "done-at":
+		case value == "":
+			tags = append(tags, name)
+		default:
+			cols = append(cols, name)
+		}
+	}
+	sort.Strings(tags)
+	sort.Strings(cols)
+	return tags, cols
+}
+
+// False for the columns that can't be written in an Org-mode heading or property drawer
+func orgExportable(name, value string) bool {
+	switch {
+	case strings.HasPrefix(name, "sub/") || name == "uncat" || name == "done-at":
+		return false
+	case strings.ContainsAny(name, ": \t\n"):
+		return false
+	case strings.ContainsAny(value, "\r\n"):
+		return false
+	}
+	return true
+}
+
+func outlineTime(t *time.Time, timezone *time.Location) string {
+	local := t.In(timezone)
+	if local.Format("15:04:05") == "00:00:00" {
+		return local.Format("2006-01-02")
+	}
+	return local.Format("2006-01-02 15:04")
+}
+
+func writeMarkdown(w io.Writer, nodes []*outlineNode, depth int, timezone *time.Location) {
+	indent := strings.Repeat("  ", depth)
+	for _, node := range nodes {
+		e := node.Entry
+		line := indent + "- "
+		switch e.Priority() {
+		case DONE:
+			line += "[x] "
+		case NOW, LATER, TIMED:
+			line += "[ ] "
+		}
+		line += e.Title()
+
+		tags, cols := outlineColumns(e)
+		for _, tag := range tags {
+			line += " #" + tag
+		}
+		if e.TriggerAt() != nil {
+			line += " _@ " + outlineTime(e.TriggerAt(), timezone) + "_"
+		}
+		if len(cols) > 0 {
+			v := []string{}
+			for _, col := range cols {
+				v = append(v, col+": "+e.Column(col))
+			}
+			line += " (" + strings.Join(v, ", ") + ")"
+		}
+		_, err := io.WriteString(w, line+"\n")
+		Must(err)
+
+		if text := strings.TrimSpace(e.Text()); text != "" {
+			_, err := io.WriteString(w, "\n"+indentLines(text, indent+"  ")+"\n\n")
+			Must(err)
+		}
+
+		writeMarkdown(w, node.Children, depth+1, timezone)
+	}
+}
+
+func indentLines(text, indent string) string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		if strings.TrimSpace(lines[i]) != "" {
+			lines[i] = indent + lines[i]
+		} else {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Writes the entries matching queryText, with their subitems, as a Markdown list
+func (tl *Tasklist) ExportMarkdown(w io.Writer, queryText string) (err error) {
+	defer catchError(&err)
+	writeMarkdown(w, tl.outline(queryText), 0, tl.GetTimezone())
+	return nil
+}
+
+func orgTimestamp(t *time.Time, timezone *time.Location) string {
+	local := t.In(timezone)
+	if local.Format("15:04:05") == "00:00:00" {
+		return local.Format("2006-01-02 Mon")
+	}
+	return local.Format("2006-01-02 Mon 15:04")
+}
+
+// Org-mode heading of e at level, without its subitems
+func orgEntry(e *Entry, level int, timezone *time.Location) string {
+	indent := strings.Repeat(" ", level+1)
+	heading := []string{strings.Repeat("*", level)}
+
+	switch e.Priority() {
+	case NOW, TIMED:
+		heading = append(heading, "TODO")
+	case LATER:
+		heading = append(heading, "TODO", "[#C]")
+	case DONE:
+		heading = append(heading, "DONE")
+	case STICKY:
+		heading = append(heading, "[#A]")
+	}
+	heading = append(heading, e.Title())
+
+	tags, cols := outlineColumns(e)
+	orgTags := []string{}
+	for _, tag := range tags {
+		if orgExportable(tag, "") {
+			orgTags = append(orgTags, tag)
+		}
+	}
+	if len(orgTags) > 0 {
+		heading = append(heading, ":"+strings.Join(orgTags, ":")+":")
+	}
+
+	lines := []string{strings.Join(heading, " ")}
+
+	planning := []string{}
+	if e.Priority() == DONE {
+		if doneAt, err := time.Parse("2006-01-02_15:04:05", e.Column("done-at")); err == nil {
+			planning = append(planning, "CLOSED: ["+orgTimestamp(&doneAt, timezone)+"]")
+		}
+	}
+	if e.TriggerAt() != nil {
+		planning = append(planning, "SCHEDULED: <"+orgTimestamp(e.TriggerAt(), timezone)+">")
+	}
+	if len(planning) > 0 {
+		lines = append(lines, indent+strings.Join(planning, " "))
+	}
+
+	lines = append(lines, indent+":PROPERTIES:", indent+":ID: "+e.Id())
+	for _, col := range cols {
+		if orgExportable(col, e.Column(col)) {
+			lines = append(lines, indent+":"+col+": "+e.Column(col))
+		}
+	}
+	lines = append(lines, indent+":END:")
+
+	if text := strings.TrimRight(e.Text(), " \n"); text != "" {
+		lines = append(lines, indentLines(text, indent))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func writeOrg(w io.Writer, nodes []*outlineNode, level int, timezone *time.Location) {
+	for _, node := range nodes {
+		_, err := io.WriteString(w, orgEntry(node.Entry, level, timezone))
+		Must(err)
+		writeOrg(w, node.Children, level+1, timezone)
+	}
+}
+
+// Writes the entries matching queryText, with their subitems, as an Org-mode outline
+func (tl *Tasklist) ExportOrg(w io.Writer, queryText string) (err error) {
+	defer catchError(&err)
+	writeOrg(w, tl.outline(queryText), 1, tl.GetTimezone())
+	return nil
+}
+
+var orgHeadingRE = regexp.MustCompile(`^(\*+)\s+(?:(TODO|DONE)\s+)?(?:\[#([A-Z])\]\s+)?(.*?)(?:\s+:((?:[^\s:]+:)+))?\s*$`)
+var orgPlanningRE = regexp.MustCompile(`(SCHEDULED|DEADLINE|CLOSED):\s*[<\[](\d{4}-\d{2}-\d{2})(?:\s+[^\s\d>\]]+)?(?:\s+(\d{1,2}:\d{2}))?[^>\]]*[>\]]`)
+var orgPropertyRE = regexp.MustCompile(`^:([^\s:]+):\s*(.*)$`)
+
+// Parses an Org-mode file, ids of the entries are the ones in their ID property
+func parseOrg(in io.Reader, timezone *time.Location) ([]*outlineNode, error) {
+	r := []*outlineNode{}
+
+	type level struct {
+		stars int
+		node  *outlineNode
+	}
+	stack := []level{}
+	seen := map[string]bool{}
+	text := []string{}
+	inDrawer, afterHeading := false, false
+
+	flushText := func() {
+		if len(stack) == 0 {
+			return
+		}
+		// the indentation of the text is removed
+		minIndent := -1
+		for _, line := range text {
+			if trimmed := strings.TrimLeft(line, " "); trimmed != "" && (minIndent < 0 || len(line)-len(trimmed) < minIndent) {
+				minIndent = len(line) - len(trimmed)
+			}
+		}
+		for i := range text {
+			if len(text[i]) >= minIndent && minIndent > 0 {
+				text[i] = text[i][minIndent:]
+			}
+		}
+		stack[len(stack)-1].node.Entry.SetText(strings.Trim(strings.Join(text, "\n"), "\n"))
+		text = []string{}
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if m := orgHeadingRE.FindStringSubmatch(line); m != nil {
+			flushText()
+
+			cols := Columns{}
+			for _, tag := range strings.Split(m[5], ":") {
+				if tag != "" {
+					cols[tag] = ""
+				}
+			}
+
+			priority := NOTES
+			switch {
+			case m[2] == "DONE":
+				priority = DONE
+			case m[2] == "TODO" && m[3] == "C":
+				priority = LATER
+			case m[2] == "TODO":
+				priority = NOW
+			case m[3] == "A":
+				priority = STICKY
+			}
+
+			node := &outlineNode{Entry: MakeEntry("", m[4], "", priority, nil, "", cols)}
+			stars := len(m[1])
+			for len(stack) > 0 && stack[len(stack)-1].stars >= stars {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				r = append(r, node)
+			} else {
+				parent := stack[len(stack)-1].node
+				parent.Children = append(parent.Children, node)
+			}
+			stack = append(stack, level{stars, node})
+			afterHeading = true
+			continue
+		}
+
+		if len(stack) == 0 {
+			// text before the first heading
+			continue
+		}
+		e := stack[len(stack)-1].node.Entry
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case afterHeading && orgPlanningRE.MatchString(trimmed):
+			for _, m := range orgPlanningRE.FindAllStringSubmatch(trimmed, -1) {
+				value := m[2] + " 00:00"
+				if m[3] != "" {
+					value = m[2] + " " + m[3]
+				}
+				t, err := time.ParseInLocation("2006-01-02 15:04", value, timezone)
+				if err != nil {
+					return nil, MakeParseError(fmt.Sprintf("Wrong timestamp in Org-mode file: %s", line))
+				}
+				t = t.UTC()
+				switch m[1] {
+				case "CLOSED":
+					e.SetColumn("done-at", t.Format("2006-01-02_15:04:05"))
+				case "DEADLINE":
+					if e.TriggerAt() == nil {
+						e.SetTriggerAt(&t)
+					}
+				case "SCHEDULED":
+					e.SetTriggerAt(&t)
+				}
+			}
+		case afterHeading && trimmed == ":PROPERTIES:":
+			inDrawer = true
+		case inDrawer && trimmed == ":END:":
+			inDrawer, afterHeading = false, false
+		case inDrawer:
+			if m := orgPropertyRE.FindStringSubmatch(trimmed); m != nil {
+				if m[1] == "ID" {
+					if seen[m[2]] {
+						return nil, MakeParseError(fmt.Sprintf("Id %s appears twice in the Org-mode file", m[2]))
+					}
+					seen[m[2]] = true
+					e.SetId(m[2])
+				} else {
+					e.SetColumn(m[1], m[2])
+				}
+			}
+		default:
+			afterHeading = false
+			text = append(text, line)
+		}
+	}
+	flushText()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fixes the priority and done-at of the entries of nodes and checks them, before anything is written
+func (tl *Tasklist) checkOutline(nodes []*outlineNode) {
+	timezone := tl.GetTimezone()
+	for _, node := range nodes {
+		e := node.Entry
+		if e.Priority() == TIMED && e.TriggerAt() == nil {
+			e.SetPriority(NOW)
+		}
+		if _, ok := e.ColumnOk("done-at"); !ok && e.Priority() == DONE {
+			e.SetColumn("done-at", time.Now().UTC().Format("2006-01-02_15:04:05"))
+		}
+		checkRecurrence(e, timezone)
+		tl.checkColumnTypes(e)
+		tl.checkOutline(node.Children)
+	}
+}
+
+// Adds the ids of the entries of nodes, and of their subitems, to ids
+func orgIds(nodes []*outlineNode, ids map[string]bool) map[string]bool {
+	for _, node := range nodes {
+		if node.Entry.Id() != "" {
+			ids[node.Entry.Id()] = true
+		}
+		orgIds(node.Children, ids)
+	}
+	return ids
+}
+
+/*
+ Copies to the entries of nodes that already exist the columns that the
+ Org-mode file couldn't hold (see orgExportable): tags and columns with
+ ':' in the name, multi-line values and the sub/ columns of parents that
+ aren't in ids.
+*/
+func (tl *Tasklist) keepOrgColumns(nodes []*outlineNode, ids map[string]bool) {
+	for _, node := range nodes {
+		e := node.Entry
+		if e.Id() != "" && tl.Exists(e.Id()) {
+			for k, v := range tl.get(e.Id()).Columns() {
+				switch {
+				case strings.HasPrefix(k, "sub/"):
+					if !ids[k[len("sub/"):]] {
+						e.SetColumn(k, v)
+					}
+				case !orgExportable(k, v) && k != "uncat" && k != "done-at":
+					e.SetColumn(k, v)
+				}
+			}
+		}
+		tl.keepOrgColumns(node.Children, ids)
+	}
+}
+
+/*
+ Adds the entries of nodes as subitems of pid (or as top level entries if
+ pid is empty), numbered from after, with their subitems. Entries that
+ already exist are updated. Must be called inside a transaction, after
+ checkOutline. Every entry written is added to written, with true if the
+ update completed it (see afterUpdate). Returns the number of entries added
+ and updated.
+*/
+func (tl *Tasklist) addOutline(pid string, after int, nodes []*outlineNode, written map[*Entry]bool) (added, updated int) {
+	timezone := tl.GetTimezone()
+	defaultWithTime := tl.GetSetting("defaultsorttime") == "1"
+
+	for i, node := range nodes {
+		e := node.Entry
+		exists := e.Id() != "" && tl.Exists(e.Id())
+
+		if pid != "" {
+			n := strconv.Itoa(after + i + 1)
+			e.SetColumn("sub/"+pid, n)
+			e.SetSort(n)
+		} else {
+			e.SetSort(SortFromTriggerAt(e.TriggerAt(), defaultWithTime))
+		}
+
+		switch {
+		case !exists:
+			if e.Id() == "" {
+				e.SetId(tl.MakeRandomId())
+			}
+			tl.insert(e)
+			written[e] = false
+			added++
+		default:
+			old := tl.get(e.Id())
+			if pid == "" && sameTriggerAt(old.TriggerAt(), e.TriggerAt()) {
+				e.SetSort(old.Sort())
+			}
+			if oldDoneAt, ok := old.ColumnOk("done-at"); ok && orgDoneAtMinute(oldDoneAt) == orgDoneAtMinute(e.Column("done-at")) {
+				// CLOSED only has the minute
+				e.SetColumn("done-at", oldDoneAt)
+			}
+			if orgEntry(old, 1, timezone) != orgEntry(e, 1, timezone) || old.Sort() != e.Sort() || old.Column("sub/"+pid) != e.Column("sub/"+pid) {
+				written[e] = tl.rewrite(e, false, "update")
+				updated++
+			}
+		}
+
+		a, u := tl.addOutline(e.Id(), 0, node.Children, written)
+		added, updated = added+a, updated+u
+	}
+
+	return added, updated
+}
+
+/*
+ Imports an Org-mode file, the columns of queryText (see importColumns) are
+ added to the top level headings. Returns the number of entries added and
+ updated.
+*/
+func (tl *Tasklist) ImportOrg(in io.Reader, queryText string) (added, updated int, err error) {
+	defer catchError(&err)
+
+	nodes, err := parseOrg(in, tl.GetTimezone())
+	Must(err)
+
+	extraCols := tl.importColumns(queryText)
+	for _, node := range nodes {
+		for k, v := range extraCols {
+			node.Entry.SetColumn(k, v)
+		}
+	}
+	tl.keepOrgColumns(nodes, orgIds(nodes, map[string]bool{}))
+
+	var addTimed func(nodes []*outlineNode)
+	addTimed = func(nodes []*outlineNode) {
+		for _, node := range nodes {
+			e := node.Entry
+			if e.Priority() == NOW && e.TriggerAt() != nil {
+				e.SetPriority(TIMED)
+			}
+			setUncat(e.Columns())
+			addTimed(node.Children)
+		}
+	}
+	addTimed(nodes)
+	tl.checkOutline(nodes)
+
+	written := map[*Entry]bool{}
+	tl.WithTransaction(func() {
+		added, updated = tl.addOutline("", 0, nodes, written)
+	})
+	for e, completed := range written {
+		tl.afterUpdate(e, completed)
+	}
+	return added, updated, nil
+}
+
+func orgDoneAtMinute(doneAt string) string {
+	if len(doneAt) < len("2006-01-02_15:04") {
+		return doneAt
+	}
+	return doneAt[:len("2006-01-02_15:04")]
+}
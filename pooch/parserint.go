@@ -10,7 +10,6 @@ import (
 	"io/ioutil"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -35,6 +34,11 @@ func SortFromTriggerAt(triggerAt *time.Time, defaultWithTime bool) string {
 	return time.Now().UTC().Format("2006-01-02")
 }
 
+// Columns added to every imported entry, queryText is parsed like the search string of a new entry
+func (tl *Tasklist) importColumns(queryText string) Columns {
+	return ExtractColumnsFromSearch(tl.ParseEx(queryText))
+}
+
 func ExtractColumnsFromSearch(search *ParseResult) Columns {
 	cols := make(Columns)
 
@@ -126,11 +130,18 @@ func (tl *Tasklist) ParseNew(entryText, queryText string) *Entry {
 		switch sexpr.name {
 		case ":when":
 			triggerAt = sexpr.valueAsTime
+			if sexpr.extra != "" {
+				cols["recur"] = sexpr.extra
+			}
 		case ":priority":
 			priority = sexpr.priority
 			prioritySet = true
 		case "id":
 			id = sexpr.value
+		case ":created", ":modified":
+			// set automatically when the entry is saved
+		case ":blocked":
+			// depends on links, not on the entry
 		default:
 			if sexpr.op == "" {
 				cols[sexpr.name] = ""
@@ -225,31 +236,31 @@ func (expr *SimpleExpr) IntoClauseEx(tl *Tasklist) string {
 		fallthrough
 	case ":text_field":
 		if expr.op == "match" {
-			return fmt.Sprintf("id IN (SELECT id FROM ridx WHERE %s MATCH %s)", expr.name[1:], tl.Quote(expr.value))
+			return fmt.Sprintf("id IN (SELECT id FROM ridx WHERE %s MATCH %s)", expr.name[1:], tl.Quote(FTSQuery(expr.value)))
 		} else if sqlop, ok := OPERATOR_CHECK[expr.op]; ok {
 			return fmt.Sprintf("%s %s %s", expr.name[1:], sqlop, tl.Quote(expr.value))
 		}
 
 	case ":search":
-		return fmt.Sprintf("id IN (SELECT id FROM ridx WHERE title_field MATCH %s UNION SELECT id FROM ridx WHERE text_field MATCH %s)", tl.Quote(expr.value), tl.Quote(expr.value))
+		return fmt.Sprintf("id IN (SELECT id FROM ridx WHERE ridx MATCH %s)", tl.Quote(FTSQuery(expr.value)))
 
 	case ":priority":
 		return fmt.Sprintf("priority = %d", expr.priority)
 
 	case ":when":
-		if expr.op == "notnull" {
-			return "trigger_at_field IS NOT NULL"
-		} else if expr.op == "null" {
-			return "(trigger_at_field IS NULL OR trigger_at_field == \"\")"
-		} else if sqlop, ok := OPERATOR_CHECK[expr.op]; ok {
-			value := expr.value
-			if expr.valueAsTime != nil {
-				value = expr.valueAsTime.Format(TRIGGER_AT_FORMAT)
-			}
-			return fmt.Sprintf("trigger_at_field %s '%s'", sqlop, value)
-		} else {
-			panic(MakeParseError(fmt.Sprintf("Unknown operator %s", expr.op)))
+		return expr.timeFieldClause(tl, "trigger_at_field")
+
+	case ":created":
+		return expr.timestampClause(tl, "created_at")
+
+	case ":modified":
+		return expr.timestampClause(tl, "modified_at")
+
+	case ":blocked":
+		if expr.value == "0" {
+			return "NOT " + blockedClause()
 		}
+		return blockedClause()
 
 	default:
 		if expr.name[0] == ':' {
@@ -259,6 +270,9 @@ func (expr *SimpleExpr) IntoClauseEx(tl *Tasklist) string {
 		if expr.op == "" {
 			return fmt.Sprintf("SELECT id FROM columns WHERE name = %s", tl.Quote(expr.name))
 		} else if sqlop, ok := OPERATOR_CHECK[expr.op]; ok {
+			if clause := tl.typedColumnClause(expr.name, sqlop, expr.value); clause != "" {
+				return clause
+			}
 			return fmt.Sprintf("SELECT id FROM columns WHERE name = %s AND value %s %s", tl.Quote(expr.name), sqlop, tl.Quote(expr.value))
 		} else {
 			panic(MakeParseError(fmt.Sprintf("Unknown operator %s", expr.op)))
@@ -268,6 +282,42 @@ func (expr *SimpleExpr) IntoClauseEx(tl *Tasklist) string {
 	panic(MakeParseError("Something bad happened"))
 }
 
+func (expr *SimpleExpr) timeFieldClause(tl *Tasklist, field string) string {
+	if expr.op == "notnull" {
+		return fmt.Sprintf("%s IS NOT NULL", field)
+	} else if expr.op == "null" {
+		return fmt.Sprintf("(%s IS NULL OR %s == \"\")", field, field)
+	} else if sqlop, ok := OPERATOR_CHECK[expr.op]; ok {
+		value := expr.value
+		if expr.valueAsTime != nil {
+			value = expr.valueAsTime.Format(TRIGGER_AT_FORMAT)
+		}
+		return fmt.Sprintf("%s %s %s", field, sqlop, tl.Quote(value))
+	}
+
+	panic(MakeParseError(fmt.Sprintf("Unknown operator %s", expr.op)))
+}
+
+// Like timeFieldClause for created_at and modified_at, which are saved in
+// UTC and are empty for entries created before they were introduced
+func (expr *SimpleExpr) timestampClause(tl *Tasklist, field string) string {
+	if expr.op == "notnull" {
+		return fmt.Sprintf("%s <> ''", field)
+	} else if expr.op == "null" {
+		return fmt.Sprintf("(%s IS NULL OR %s == \"\")", field, field)
+	} else if sqlop, ok := OPERATOR_CHECK[expr.op]; ok {
+		t := expr.valueAsTime
+		if t == nil {
+			var err error
+			t, err = ParseDateTime(expr.value, tl.GetTimezone())
+			Must(err)
+		}
+		return fmt.Sprintf("(%s <> '' AND %s %s %s)", field, field, sqlop, tl.Quote(t.UTC().Format("2006-01-02 15:04:05")))
+	}
+
+	panic(MakeParseError(fmt.Sprintf("Unknown operator %s", expr.op)))
+}
+
 func (expr *SimpleExpr) IntoSelect(tl *Tasklist, depth string) string {
 	if expr.name[0] == ':' {
 		return fmt.Sprintf("%sSELECT id FROM tasks WHERE %s", depth, expr.IntoClauseEx(tl))
@@ -360,7 +410,7 @@ func (pr *ParseResult) AddIncludeClause(expr *SimpleExpr) {
 	pr.include.subExpr = append(pr.include.subExpr, expr)
 }
 
-var SELECT_HEADER string = "SELECT tasks.id, title_field, text_field, priority, trigger_at_field, sort, group_concat(columns.name||'\u001f'||columns.value, '\u001f')\nFROM tasks NATURAL JOIN columns "
+var SELECT_HEADER string = "SELECT tasks.id, title_field, text_field, priority, trigger_at_field, sort, created_at, modified_at, group_concat(columns.name||'\u001f'||columns.value, '\u001f')\nFROM tasks NATURAL JOIN columns "
 
 func (pr *ParseResult) ResolveSavedSearch(tl *Tasklist) *ParseResult {
 	if pr.savedSearch != "" {
@@ -382,8 +432,16 @@ func (pr *ParseResult) IntoSelect(tl *Tasklist, luaClausable Clausable) (string,
 	where := pr.include.IntoClauses(tl, "", false, addDone)
 	whereNot := pr.exclude.IntoClauses(tl, "", true, false)
 
+	if _, withTrash := pr.options["w/trash"]; !withTrash {
+		where = append(where, "   trashed_at = 0")
+	}
+
+	if _, found := pr.options["has-attachment"]; found {
+		where = append(where, "   id IN (SELECT id FROM attachments)")
+	}
+
 	if pr.text != "" {
-		where = append(where, fmt.Sprintf("   id IN (\n      SELECT id FROM ridx WHERE title_field MATCH %s\n   UNION\n      SELECT id FROM ridx WHERE text_field MATCH %s)", tl.Quote(pr.text), tl.Quote(pr.text)))
+		where = append(where, fmt.Sprintf("   id IN (SELECT id FROM ridx WHERE ridx MATCH %s)", tl.Quote(FTSQuery(pr.text))))
 	}
 
 	for _, v := range whereNot {
@@ -411,6 +469,11 @@ func (pr *ParseResult) IntoSelect(tl *Tasklist, luaClausable Clausable) (string,
 		whereStr = "\nWHERE\n" + strings.Join(where, "\nAND\n")
 	}
 
+	if pr.text != "" && pr.sortsByRank() {
+		ranks := fmt.Sprintf("SELECT id AS rank_id, rank FROM ridx WHERE ridx MATCH %s", tl.Quote(FTSQuery(pr.text)))
+		return "SELECT entries.* FROM (\n" + SELECT_HEADER + whereStr + "\nGROUP BY tasks.id\n) AS entries\nLEFT JOIN (" + ranks + ") AS ranks ON ranks.rank_id = entries.id\nORDER BY ranks.rank", nil, err
+	}
+
 	orderBy := "ORDER BY priority, trigger_at_field ASC, sort DESC"
 	if _, found := pr.options["ssort"]; found {
 		orderBy = "ORDER BY sort ASC"
@@ -462,13 +525,15 @@ func (pr *ParseResult) IsEmpty() bool {
 	return true
 }
 
-func (tl *Tasklist) ParseSearch(queryText string, luaClausable Clausable) (string, string, string, bool, bool, []string, map[string]string, []string, error) {
+func (tl *Tasklist) ParseSearch(queryText string, luaClausable Clausable) (theselect, command, trigger string, isSavedSearch, isEmpty bool, showCols []string, options map[string]string, sortCols []string, err error) {
+	defer catchError(&err)
+
 	pr := tl.ParseEx(queryText)
-	isEmpty := pr.IsEmpty()
+	isEmpty = pr.IsEmpty()
 	theselect, extraOptions, err := pr.IntoSelect(tl, luaClausable)
-	trigger := pr.IntoTrigger()
+	trigger = pr.IntoTrigger()
 
-	options := make(map[string]string)
+	options = make(map[string]string)
 	for k, v := range extraOptions {
 		options[k] = v
 	}
@@ -476,7 +541,23 @@ func (tl *Tasklist) ParseSearch(queryText string, luaClausable Clausable) (strin
 		options[k] = v
 	}
 
-	return theselect, pr.command, trigger, pr.savedSearch != "", isEmpty, pr.showCols, options, pr.sortCols, err
+	// sorting by rank is done by the select
+	for _, col := range pr.sortCols {
+		if col != "rank" {
+			sortCols = append(sortCols, col)
+		}
+	}
+
+	return theselect, pr.command, trigger, pr.savedSearch != "", isEmpty, pr.showCols, options, sortCols, err
+}
+
+func (pr *ParseResult) sortsByRank() bool {
+	for _, col := range pr.sortCols {
+		if col == "rank" {
+			return true
+		}
+	}
+	return false
 }
 
 func (tl *Tasklist) ExtendedAddParse() *Entry {
@@ -499,33 +580,56 @@ func (tl *Tasklist) ExtendedAddParse() *Entry {
 	return e
 }
 
-func explodeBody(body string, pid string) []*Entry {
-	r := []*Entry{}
-	cnt := 1
+/*
+ Splits the body of an entry in a list of items: lines starting at the
+ beginning of the line are items (the first character, usually -, is
+ removed), indented lines starting with - are subitems of the item above
+ them and other indented lines are the text of the item above them.
+*/
+func explodeBody(body string) []*outlineNode {
+	r := []*outlineNode{}
 
-	newChild := func(text string) {
-		c := strconv.Itoa(cnt)
-		entry := &Entry{"", text, "", NOW, nil, c, Columns{"sub/" + pid: c}}
-		r = append(r, entry)
-		cnt++
+	type level struct {
+		indent int
+		node   *outlineNode
+	}
+	stack := []level{}
+
+	newItem := func(indent int, text string) {
+		node := &outlineNode{Entry: MakeEntry("", text, "", NOW, nil, "", Columns{})}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			r = append(r, node)
+		} else {
+			parent := stack[len(stack)-1].node
+			parent.Children = append(parent.Children, node)
+		}
+		stack = append(stack, level{indent, node})
 	}
 
 	lines := strings.Split(body, "\n")
 	for i := range lines {
-		if len(lines[i]) == 0 {
+		trimmed := strings.TrimLeft(lines[i], " \t")
+		if trimmed == "" {
 			continue
 		}
-		if lines[i][0] == '-' {
-			newChild(strings.TrimSpace(lines[i][1:]))
-		} else if lines[i][0] == ' ' && len(r) > 0 {
-			text := strings.TrimSpace(lines[i])
-			last := r[len(r)-1]
+		indent := len(lines[i]) - len(trimmed)
+		switch {
+		case indent == 0:
+			newItem(0, strings.TrimSpace(lines[i][1:]))
+		case len(stack) == 0:
+			newItem(indent, strings.TrimSpace(trimmed))
+		case trimmed[0] == '-':
+			newItem(indent, strings.TrimSpace(trimmed[1:]))
+		default:
+			last := stack[len(stack)-1].node.Entry
+			text := strings.TrimSpace(trimmed)
 			if last.Text() != "" {
 				text = last.Text() + "\n" + text
 			}
 			last.SetText(text)
-		} else {
-			newChild(strings.TrimSpace(lines[i][1:]))
 		}
 	}
 
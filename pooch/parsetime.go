@@ -7,6 +7,7 @@ package pooch
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -36,6 +37,12 @@ func (vt *VarTime) ToTimePtr() *time.Time {
 	return &t
 }
 
+// Interprets vt as a wall clock time in loc and converts it to UTC
+func (vt *VarTime) In(loc *time.Location) *time.Time {
+	t := time.Date(vt.Year, time.Month(vt.Month), vt.Day, vt.Hour, vt.Minute, vt.Second, 0, loc).UTC()
+	return &t
+}
+
 func VarTimeFromTime(t time.Time) *VarTime {
 	return &VarTime{t.Year(), int(t.Month()), t.Day(), int(t.Weekday()), t.Hour(), t.Minute(), t.Second()}
 }
@@ -62,16 +69,16 @@ var TimeOnlyFormats []DateTimeFormat = []DateTimeFormat{
 	{"15:04", false, true},
 }
 
-func FixYear(datetime *VarTime, withTime bool) {
+func FixYear(datetime *VarTime, withTime bool, now time.Time) {
 	format := "01-02"
 	if withTime {
 		format = "01-02 15:04"
 	}
 
-	if datetime.ToTime().Format(format) > time.Now().UTC().Format(format) {
-		datetime.Year = time.Now().UTC().Year()
+	if datetime.ToTime().Format(format) > now.Format(format) {
+		datetime.Year = now.Year()
 	} else {
-		datetime.Year = time.Now().UTC().Year() + 1
+		datetime.Year = now.Year() + 1
 	}
 }
 
@@ -83,20 +90,20 @@ func fixDateEx(datetime *VarTime, ref *VarTime) {
 }
 
 func nextDay(atime time.Time) time.Time {
-	return time.Unix(atime.Unix()+(24*60*60), 0)
+	return atime.AddDate(0, 0, 1)
 }
 
-func FixDate(datetime *VarTime) {
-	ref := time.Now().UTC()
+func FixDate(datetime *VarTime, now time.Time) {
+	ref := now
 	if datetime.ToTime().Format("15:04:05") < ref.Format("15:04:05") {
 		ref = nextDay(ref)
 	}
 	fixDateEx(datetime, VarTimeFromTime(ref))
 }
 
-func SearchDayOfTheWeek(datetime *VarTime) *VarTime {
+func SearchDayOfTheWeek(datetime *VarTime, now time.Time) *VarTime {
 	weekday := datetime.Weekday // thing to search
-	fixDateEx(datetime, VarTimeFromTime(time.Now().UTC()))
+	fixDateEx(datetime, VarTimeFromTime(now))
 	for count := 10; count > 0; count-- {
 		datetime = VarTimeFromTime(nextDay(datetime.ToTime()))
 		if datetime.Weekday == weekday {
@@ -106,20 +113,13 @@ func SearchDayOfTheWeek(datetime *VarTime) *VarTime {
 	return datetime
 }
 
-func TimeParseTimezone(layout, input string, timezone int) (*VarTime, error) {
-	t, err := time.Parse(layout, input)
-	if err != nil {
-		return nil, err
-	}
-	t = time.Unix(t.Unix()-(int64(timezone)*60*60), 0).In(time.FixedZone("fixed-zone", timezone*60))
-	return VarTimeFromTime(t), nil
-}
-
-func timeParseLoop(input string, timezone int, formats []DateTimeFormat) *VarTime {
+// Parses input as a wall clock time, the year and date are filled in relative to now
+func timeParseLoop(input string, now time.Time, formats []DateTimeFormat) *VarTime {
 	for _, dateTimeFormat := range formats {
-		if datetime, err := TimeParseTimezone(dateTimeFormat.format, input, timezone); err == nil {
+		if t, err := time.Parse(dateTimeFormat.format, input); err == nil {
+			datetime := VarTimeFromTime(t)
 			if dateTimeFormat.shouldFixYear {
-				FixYear(datetime, dateTimeFormat.hasTime)
+				FixYear(datetime, dateTimeFormat.hasTime, now)
 			}
 			return datetime
 		}
@@ -138,12 +138,12 @@ var weekdayConversion map[string]int = map[string]int{
 	"Sun": 0, "sun": 0,
 }
 
-func parseNextWeekdayTime(input string, timezone int) *VarTime {
+func parseNextWeekdayTime(input string, now time.Time) *VarTime {
 	var datetime *VarTime = &VarTime{}
 
 	split := strings.SplitN(input, ",", 2)
 	if len(split) > 1 {
-		datetime = timeParseLoop(split[1], timezone, TimeOnlyFormats)
+		datetime = timeParseLoop(split[1], now, TimeOnlyFormats)
 		if datetime == nil {
 			return nil
 		}
@@ -154,35 +154,60 @@ func parseNextWeekdayTime(input string, timezone int) *VarTime {
 		return nil
 	}
 	datetime.Weekday = value
-	return SearchDayOfTheWeek(datetime)
+	return SearchDayOfTheWeek(datetime, now)
 }
 
-func ParseDateTime(input string, timezone int) (*time.Time, error) {
+// Parses input as a time in the given timezone, the result is in UTC
+func ParseDateTime(input string, timezone *time.Location) (*time.Time, error) {
 	input = strings.TrimSpace(input)
 
 	if input == "" {
 		return nil, MakeParseError("Empty input")
 	}
 
-	if datetime := timeParseLoop(input, timezone, DateTimeFormats); datetime != nil {
-		return datetime.ToTimePtr(), nil
+	now := time.Now().In(timezone)
+
+	if datetime := timeParseLoop(input, now, DateTimeFormats); datetime != nil {
+		return datetime.In(timezone), nil
 	}
 
-	if datetime := timeParseLoop(input, timezone, TimeOnlyFormats); datetime != nil {
-		FixDate(datetime)
-		return datetime.ToTimePtr(), nil
+	if datetime := timeParseLoop(input, now, TimeOnlyFormats); datetime != nil {
+		FixDate(datetime, now)
+		return datetime.In(timezone), nil
 	}
 
-	if datetime := parseNextWeekdayTime(input, timezone); datetime != nil {
-		return datetime.ToTimePtr(), nil
+	if datetime := parseNextWeekdayTime(input, now); datetime != nil {
+		return datetime.In(timezone), nil
 	}
 
 	return nil, MakeParseError(fmt.Sprintf("Unparsable date: %s", input))
 }
 
-func TimeFormatTimezone(atime *time.Time, format string, timezone int) string {
-	z := time.Unix(atime.Unix()+(int64(timezone)*60*60), 0).In(time.FixedZone("fixed-zone", timezone*60))
+func TimeFormatTimezone(atime *time.Time, format string, timezone *time.Location) string {
+	return atime.In(timezone).Format(format)
+}
 
-	return z.Format(format)
+/*
+ The timezone setting is either the name of a location in the IANA time zone
+ database (e.g. Europe/Rome) or, for compatibility with older versions, a
+ fixed offset from UTC in hours
+*/
+func ParseTimezone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	if offset, err := strconv.Atoi(name); err == nil {
+		if offset == 0 {
+			return time.UTC, nil
+		}
+		return time.FixedZone(fmt.Sprintf("UTC%+d", offset), offset*60*60), nil
+	}
 
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, MakeParseError(fmt.Sprintf("Unknown timezone %s", name))
+	}
+	return loc, nil
 }
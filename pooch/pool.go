@@ -0,0 +1,266 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ Open tasklists are kept in a pool, so that consecutive requests for the same
+ tasklist reuse its connection and lua state. OpenOrCreate takes a reference
+ to a tasklist and Close releases it.
+
+ A tasklist that isn't referenced is closed by a background goroutine once it
+ has been idle for longer than the idle timeout. When more than the maximum
+ number of tasklists is open the least recently used idle one is closed to
+ make room, if all of them are in use the new tasklist is opened anyway and
+ closed as soon as it is released.
+
+ The defaults can be changed with the POOCHIDLETIMEOUT (a duration, like 30m)
+ and POOCHMAXOPEN environment variables, or with SetPoolLimits.
+*/
+
+var enabledCaching bool = true
+
+type tasklistPool struct {
+	mutex          sync.Mutex
+	open           map[string]*Tasklist
+	idleTimeout    time.Duration
+	maxOpen        int
+	evictorStarted bool
+}
+
+var pool = &tasklistPool{
+	open:        make(map[string]*Tasklist),
+	idleTimeout: 30 * time.Minute,
+	maxOpen:     64,
+}
+
+func init() {
+	if v := os.Getenv("POOCHIDLETIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			pool.idleTimeout = d
+		} else {
+			Logf(WARN, "Ignoring invalid POOCHIDLETIMEOUT %s: %s\n", v, err)
+		}
+	}
+	if v := os.Getenv("POOCHMAXOPEN"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			pool.maxOpen = n
+		} else {
+			Logf(WARN, "Ignoring invalid POOCHMAXOPEN %s\n", v)
+		}
+	}
+}
+
+// Sets how long an unused tasklist stays open and how many tasklists can be open at the same time
+func SetPoolLimits(idleTimeout time.Duration, maxOpen int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.idleTimeout = idleTimeout
+	pool.maxOpen = maxOpen
+	pool.makeRoom(0)
+}
+
+func OpenOrCreate(filename string) (tl *Tasklist, err error) {
+	defer catchError(&err)
+
+	if !enabledCaching {
+		return internalTasklistOpenOrCreate(filename), nil
+	}
+
+	return pool.get(filename), nil
+}
+
+/*
+ Returns the tasklist in filename for reading, it must be used inside
+ withLock and released with Close. If the tasklist isn't already in the pool
+ it is opened with a connection that can't write to it, without upgrading
+ its schema or running timed triggers and trash purging, and it is closed
+ when released instead of being added to the pool.
+*/
+func openReadOnly(filename string) (tl *Tasklist, err error) {
+	defer catchError(&err)
+
+	if !enabledCaching {
+		return internalTasklistOpenReadOnly(filename), nil
+	}
+
+	return pool.getReadOnly(filename), nil
+}
+
+func (tasklist *Tasklist) Close() {
+	if !enabledCaching {
+		tasklist.close()
+		return
+	}
+
+	pool.release(tasklist)
+}
+
+func (tasklist *Tasklist) close() {
+	tasklist.conn.Close()
+	tasklist.luaState.Close()
+}
+
+func (p *tasklistPool) get(filename string) *Tasklist {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.startEvictor()
+
+	if tl, ok := p.open[filename]; ok {
+		tl.refs++
+		tl.lastUsed = time.Now()
+		return tl
+	}
+
+	p.makeRoom(1)
+
+	Logf(INFO, "Opening new connection to: %s\n", filename)
+
+	tl := internalTasklistOpenOrCreate(filename)
+	p.open[filename] = tl
+	return tl
+}
+
+func (p *tasklistPool) getReadOnly(filename string) *Tasklist {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if tl, ok := p.open[filename]; ok {
+		tl.refs++
+		tl.lastUsed = time.Now()
+		return tl
+	}
+
+	Logf(INFO, "Opening read only connection to: %s\n", filename)
+
+	tl := internalTasklistOpenReadOnly(filename)
+	tl.discarded = true
+	return tl
+}
+
+func (p *tasklistPool) release(tl *Tasklist) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tl.refs--
+	tl.lastUsed = time.Now()
+
+	if tl.refs < 0 {
+		Logf(ERROR, "Tasklist %s was closed more times than it was opened\n", tl.filename)
+		tl.refs = 0
+	}
+
+	if tl.refs == 0 && (tl.discarded || p.idleTimeout <= 0 || len(p.open) > p.maxOpen) {
+		p.closeTasklist(tl)
+	}
+}
+
+// Removes tl from the pool, it will be closed when the last reference to it is released
+func (p *tasklistPool) discard(tl *Tasklist) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	Logf(WARN, "Discarding connection to %s\n", tl.filename)
+
+	tl.discarded = true
+	if p.open[tl.filename] == tl {
+		delete(p.open, tl.filename)
+	}
+}
+
+func (p *tasklistPool) closeTasklist(tl *Tasklist) {
+	Logf(INFO, "Closing connection to %s\n", tl.filename)
+
+	if p.open[tl.filename] == tl {
+		delete(p.open, tl.filename)
+	}
+	tl.close()
+}
+
+// Closes the least recently used idle tasklists until n more tasklists can be opened
+func (p *tasklistPool) makeRoom(n int) {
+	for len(p.open)+n > p.maxOpen {
+		var lru *Tasklist
+		for _, tl := range p.open {
+			if tl.refs == 0 && (lru == nil || tl.lastUsed.Before(lru.lastUsed)) {
+				lru = tl
+			}
+		}
+		if lru == nil {
+			Logf(WARN, "All %d open tasklists are in use\n", len(p.open))
+			return
+		}
+		p.closeTasklist(lru)
+	}
+}
+
+func (p *tasklistPool) evictIdle() {
+	now := time.Now()
+	for _, tl := range p.open {
+		if tl.refs == 0 && now.Sub(tl.lastUsed) >= p.idleTimeout {
+			p.closeTasklist(tl)
+		}
+	}
+}
+
+func (p *tasklistPool) startEvictor() {
+	if p.evictorStarted {
+		return
+	}
+	p.evictorStarted = true
+
+	go func() {
+		for {
+			p.mutex.Lock()
+			interval := p.idleTimeout / 2
+			p.mutex.Unlock()
+
+			if interval > time.Minute {
+				interval = time.Minute
+			} else if interval < time.Second {
+				interval = time.Second
+			}
+			time.Sleep(interval)
+
+			p.mutex.Lock()
+			p.evictIdle()
+			p.mutex.Unlock()
+		}
+	}()
+}
+
+/*
+ Runs fn holding the lock of tl. If fn panics with anything other than a not
+ found, parse or lua error tl could be left in an inconsistent state (for
+ example with a dirty lua stack) and is discarded instead of going back to
+ the pool.
+*/
+func (tl *Tasklist) withLock(fn func()) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			err, ok := rerr.(error)
+			if !ok || !(errors.Is(err, ErrNotFound) || errors.Is(err, ErrParse) || errors.Is(err, ErrLua)) {
+				if enabledCaching {
+					pool.discard(tl)
+				}
+			}
+			panic(rerr)
+		}
+	}()
+
+	fn()
+}
@@ -52,7 +52,7 @@ type ParseResult struct {
 	showCols []string
 	sortCols []string
 
-	timezone int
+	timezone *time.Location
 }
 
 func MakeParseResult() *ParseResult {
@@ -70,11 +70,11 @@ func MakeParseResult() *ParseResult {
 
 type Parser struct {
 	tkzer    *Tokenizer
-	timezone int
+	timezone *time.Location
 	result   *ParseResult
 }
 
-func NewParser(tkzer *Tokenizer, timezone int) *Parser {
+func NewParser(tkzer *Tokenizer, timezone *time.Location) *Parser {
 	p := &Parser{tkzer, timezone, MakeParseResult()}
 	p.result.timezone = timezone
 	tkzer.parser = p
@@ -186,13 +186,24 @@ func (p *Parser) ParseOption(r *SimpleExpr) bool {
 			negated = true
 		}
 		r.name = p.tkzer.Next()
-		if r.name == "when" {
+		switch r.name {
+		case "when":
 			if negated {
 				r.op = "null"
 				r.value = "null"
 				return true
 			}
 			return false
+		case "created", "modified":
+			// pseudo-fields, parsed by ParseSimpleExpression
+			return false
+		case "blocked":
+			r.op = "="
+			r.value = "1"
+			if negated {
+				r.value = "0"
+			}
+			return true
 		}
 		if p.ParseToken("=") {
 			r.op = "="
@@ -357,6 +368,14 @@ LOOP:
 				p.result.options[simple.name] = ""
 			} else if simple.name == "sort" {
 				p.result.sortCols = append(p.result.sortCols, simple.value)
+			} else if simple.name == "group" {
+				p.result.options[simple.name] = simple.value
+			} else if simple.name == "sum" || simple.name == "avg" {
+				// can be repeated, see AggregateSpecFromOptions
+				if prev := p.result.options[simple.name]; prev != "" {
+					simple.value = prev + "," + simple.value
+				}
+				p.result.options[simple.name] = simple.value
 			} else {
 				simple.name = ":" + simple.name
 				p.result.include.subExpr = append(p.result.include.subExpr, simple)
@@ -402,7 +421,7 @@ func isNumber(tk string) (n float64, ok bool) {
 	return n, true
 }
 
-func normalizeValue(value string, timezone int) string {
+func normalizeValue(value string, timezone *time.Location) string {
 	Logf(DEBUG, "Normalizing: [%s]\n", value)
 	if t, _ := ParseDateTime(value, timezone); t != nil {
 		value = t.Format(TRIGGER_AT_FORMAT)
@@ -413,7 +432,7 @@ func normalizeValue(value string, timezone int) string {
 	return value
 }
 
-func ParseCols(colStr string, timezone int) (Columns, bool) {
+func ParseCols(colStr string, timezone *time.Location) (Columns, bool) {
 	cols := make(Columns)
 
 	multilineKey := ""
@@ -489,7 +508,26 @@ func ParseCols(colStr string, timezone int) (Columns, bool) {
 	return cols, foundcat
 }
 
-func ParseTsvFormat(in string, tl *Tasklist, timezone int) *Entry {
+// Returns true if cols has a tag other than uncat, subitems count as tagged like in ParseCols
+func hasTag(cols Columns) bool {
+	for k, v := range cols {
+		if (v == "" && k != "uncat") || strings.HasPrefix(k, "sub/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Tags cols with uncat if it has no other tag, removes uncat otherwise
+func setUncat(cols Columns) {
+	if hasTag(cols) {
+		delete(cols, "uncat")
+	} else {
+		cols["uncat"] = ""
+	}
+}
+
+func ParseTsvFormat(in string, tl *Tasklist, timezone *time.Location) *Entry {
 	fields := strings.SplitN(in, "\t", 4)
 
 	entry := tl.ParseNew(fields[1], "")
@@ -0,0 +1,443 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ Recurrence rules, written in the recur column of timed entries (the freq
+ column of older tasklists is read with the same parser). Some examples:
+
+	daily, weekly, biweekly, monthly, yearly, 10 (every 10 days)
+	every 3 days
+	monthly on day 15
+	every 2nd tuesday
+	last weekday of month
+	every 3 weeks on mon,thu
+	weekly until 2014-12-31
+	monthly for 12 times
+	7 days after completion
+
+ Occurrences are calculated in the timezone of the tasklist, so that the time
+ of the day doesn't change across DST transitions. The first occurrence of a
+ series and the number of occurrences created so far are carried from one
+ entry to the next in the recur-start and recur-count columns.
+*/
+
+type RecurUnit int
+
+const (
+	RECUR_DAILY RecurUnit = iota
+	RECUR_WEEKLY
+	RECUR_MONTHLY
+	RECUR_YEARLY
+)
+
+type Recurrence struct {
+	Unit     RecurUnit
+	Interval int
+
+	// weekly: days of the week, if empty the day of the week doesn't change
+	Weekdays []time.Weekday
+
+	// monthly: day of the month (-1 is the last day), if neither MonthDay nor
+	// Nth are set the day of the month of the first occurrence is used
+	MonthDay   int
+	Nth        int // 1 to 5 for the nth Weekday of the month, -1 for the last one
+	Weekday    time.Weekday
+	WorkingDay bool // Nth counts working days (monday to friday) instead of Weekday
+
+	Until           *time.Time
+	Count           int
+	AfterCompletion bool
+}
+
+var recurWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+var recurUnits = map[string]RecurUnit{
+	"day": RECUR_DAILY, "days": RECUR_DAILY,
+	"week": RECUR_WEEKLY, "weeks": RECUR_WEEKLY,
+	"month": RECUR_MONTHLY, "months": RECUR_MONTHLY,
+	"year": RECUR_YEARLY, "years": RECUR_YEARLY,
+}
+
+var recurOrdinals = map[string]int{
+	"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5, "last": -1,
+}
+
+var ordinalRE *regexp.Regexp = regexp.MustCompile("^([0-9]+)(st|nd|rd|th)$")
+
+func parseOrdinal(word string) (int, bool) {
+	if n, ok := recurOrdinals[word]; ok {
+		return n, true
+	}
+	if m := ordinalRE.FindStringSubmatch(word); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n, true
+	}
+	return 0, false
+}
+
+func ParseRecurrence(rule string, timezone *time.Location) (*Recurrence, error) {
+	words := strings.Fields(strings.ToLower(strings.Replace(rule, ",", " ", -1)))
+	if len(words) == 0 {
+		return nil, MakeParseError("Empty recurrence rule")
+	}
+
+	r := &Recurrence{Unit: RECUR_DAILY, Interval: 1}
+
+	if n, err := strconv.Atoi(words[0]); err == nil && len(words) == 1 {
+		// old style frequency, number of days
+		r.Interval = n
+		return r, r.check()
+	}
+
+	unitSet := false
+	setUnit := func(unit RecurUnit, interval int) {
+		r.Unit, r.Interval, unitSet = unit, interval, true
+	}
+
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		next := ""
+		if i+1 < len(words) {
+			next = words[i+1]
+		}
+
+		if weekday, ok := recurWeekdays[word]; ok {
+			r.Weekdays = append(r.Weekdays, weekday)
+			if !unitSet {
+				setUnit(RECUR_WEEKLY, 1)
+			}
+			continue
+		}
+
+		if n, err := strconv.Atoi(next); err == nil && word == "day" {
+			r.MonthDay = n
+			i++
+			continue
+		}
+
+		if unit, ok := recurUnits[word]; ok {
+			if !unitSet {
+				setUnit(unit, 1)
+			}
+			continue
+		}
+
+		if n, ok := parseOrdinal(word); ok {
+			if weekday, ok := recurWeekdays[next]; ok {
+				r.Nth, r.Weekday = n, weekday
+				i++
+			} else if next == "weekday" {
+				r.Nth, r.WorkingDay = n, true
+				i++
+			} else {
+				if next == "day" {
+					i++
+				}
+				r.MonthDay = n
+			}
+			if !unitSet {
+				setUnit(RECUR_MONTHLY, 1)
+			}
+			continue
+		}
+
+		switch word {
+		case "every", "on", "the", "of", "and", "times", "occurrences":
+			// nothing to do
+
+		case "daily":
+			setUnit(RECUR_DAILY, 1)
+		case "weekly":
+			setUnit(RECUR_WEEKLY, 1)
+		case "biweekly":
+			setUnit(RECUR_WEEKLY, 2)
+		case "monthly":
+			setUnit(RECUR_MONTHLY, 1)
+		case "yearly":
+			setUnit(RECUR_YEARLY, 1)
+
+		case "weekday", "weekdays":
+			r.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+			if !unitSet {
+				setUnit(RECUR_WEEKLY, 1)
+			}
+
+		case "until":
+			until, err := ParseDateTime(next, timezone)
+			if err != nil {
+				return nil, MakeParseError(fmt.Sprintf("Expected date after 'until' in recurrence rule: %s", rule))
+			}
+			if until.In(timezone).Format("15:04:05") == "00:00:00" {
+				// the whole day is included
+				t := until.In(timezone).AddDate(0, 0, 1).Add(-time.Second).UTC()
+				until = &t
+			}
+			r.Until = until
+			i++
+
+		case "count", "for":
+			n, err := strconv.Atoi(next)
+			if err != nil {
+				return nil, MakeParseError(fmt.Sprintf("Expected number after '%s' in recurrence rule: %s", word, rule))
+			}
+			r.Count = n
+			i++
+
+		case "after":
+			if next != "completion" {
+				return nil, MakeParseError(fmt.Sprintf("Expected 'completion' after 'after' in recurrence rule: %s", rule))
+			}
+			r.AfterCompletion = true
+			i++
+
+		default:
+			n, err := strconv.Atoi(word)
+			if err != nil {
+				return nil, MakeParseError(fmt.Sprintf("Unknown word '%s' in recurrence rule: %s", word, rule))
+			}
+			if unit, ok := recurUnits[next]; ok {
+				setUnit(unit, n)
+			} else if next == "times" || next == "occurrences" {
+				r.Count = n
+			} else {
+				return nil, MakeParseError(fmt.Sprintf("Expected unit or 'times' after %d in recurrence rule: %s", n, rule))
+			}
+			i++
+		}
+	}
+
+	return r, r.check()
+}
+
+func (r *Recurrence) check() error {
+	switch {
+	case r.Interval <= 0:
+		return MakeParseError("The interval of a recurrence must be positive")
+	case r.MonthDay < -1 || r.MonthDay > 31:
+		return MakeParseError(fmt.Sprintf("Invalid day of the month %d in recurrence rule", r.MonthDay))
+	case r.Nth < -1 || r.Nth > 5:
+		return MakeParseError(fmt.Sprintf("Invalid ordinal %d in recurrence rule", r.Nth))
+	case r.Count < 0:
+		return MakeParseError("The count of a recurrence can not be negative")
+	}
+	return nil
+}
+
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Returns the day of the given month at the same time of the day as t, days
+// past the end of the month are moved to the last day of the month
+func onDay(t time.Time, year int, month time.Month, day int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	year, month = first.Year(), first.Month()
+	last := daysInMonth(year, month)
+	if day < 0 || day > last {
+		day = last
+	}
+	return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+}
+
+func (r *Recurrence) nextWeekly(cur time.Time) time.Time {
+	if len(r.Weekdays) == 0 {
+		return cur.AddDate(0, 0, 7*r.Interval)
+	}
+
+	// days are counted from monday
+	offsets := make([]int, len(r.Weekdays))
+	for i, weekday := range r.Weekdays {
+		offsets[i] = (int(weekday) + 6) % 7
+	}
+	sort.Ints(offsets)
+
+	offset := (int(cur.Weekday()) + 6) % 7
+	weekStart := cur.AddDate(0, 0, -offset)
+	for _, d := range offsets {
+		if d > offset {
+			return weekStart.AddDate(0, 0, d)
+		}
+	}
+	return weekStart.AddDate(0, 0, 7*r.Interval+offsets[0])
+}
+
+// Occurrence of the rule in the month of first, start is the first occurrence of the series
+func (r *Recurrence) inMonth(first time.Time, start time.Time) (time.Time, bool) {
+	year, month := first.Year(), first.Month()
+
+	if r.Nth == 0 {
+		day := r.MonthDay
+		if day == 0 {
+			day = start.Day()
+		}
+		return onDay(first, year, month, day), true
+	}
+
+	matching := []time.Time{}
+	for day := 1; day <= daysInMonth(year, month); day++ {
+		t := onDay(first, year, month, day)
+		if r.WorkingDay {
+			if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday {
+				matching = append(matching, t)
+			}
+		} else if t.Weekday() == r.Weekday {
+			matching = append(matching, t)
+		}
+	}
+
+	if r.Nth < 0 {
+		return matching[len(matching)-1], true
+	}
+	if r.Nth > len(matching) {
+		return time.Time{}, false
+	}
+	return matching[r.Nth-1], true
+}
+
+func (r *Recurrence) nextMonthly(cur time.Time, start time.Time) (time.Time, bool) {
+	// a fifth weekday happens at least once every few months
+	for k := 0; k < 24; k++ {
+		first := time.Date(cur.Year(), cur.Month()+time.Month(k*r.Interval), 1, cur.Hour(), cur.Minute(), cur.Second(), 0, cur.Location())
+		if t, ok := r.inMonth(first, start); ok && t.After(cur) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/*
+ Returns the first occurrence after cur, start is the first occurrence of the
+ series and index the position of cur in the series (starting from 1).
+ Returns false when the series is over.
+*/
+func (r *Recurrence) Next(cur, start time.Time, index int, timezone *time.Location) (time.Time, bool) {
+	if r.Count > 0 && index >= r.Count {
+		return time.Time{}, false
+	}
+
+	cur = cur.In(timezone)
+	start = start.In(timezone)
+
+	var next time.Time
+	ok := true
+	switch r.Unit {
+	case RECUR_DAILY:
+		next = cur.AddDate(0, 0, r.Interval)
+	case RECUR_WEEKLY:
+		next = r.nextWeekly(cur)
+	case RECUR_MONTHLY:
+		next, ok = r.nextMonthly(cur, start)
+	case RECUR_YEARLY:
+		next = onDay(cur, cur.Year()+r.Interval, start.Month(), start.Day())
+	}
+
+	if !ok || (r.Until != nil && next.After(*r.Until)) {
+		return time.Time{}, false
+	}
+
+	return next.UTC(), true
+}
+
+// Returns the recurrence rule of the entry, nil if the entry doesn't recur
+func (e *Entry) Recurrence(timezone *time.Location) *Recurrence {
+	rule, ok := e.ColumnOk("recur")
+	if !ok {
+		rule, ok = e.ColumnOk("freq")
+	}
+	if !ok || strings.TrimSpace(rule) == "" {
+		return nil
+	}
+
+	r, err := ParseRecurrence(rule, timezone)
+	if err != nil {
+		Logf(WARN, "Ignoring recurrence of %s: %s\n", e.Id(), err)
+		return nil
+	}
+	return r
+}
+
+func checkRecurrence(e *Entry, timezone *time.Location) {
+	if rule, ok := e.ColumnOk("recur"); ok {
+		_, err := ParseRecurrence(rule, timezone)
+		Must(err)
+	}
+}
+
+/*
+ Returns the next occurrence of the entry (with id newId) or nil if the
+ entry doesn't recur or the series is over. For rules that recur after
+ completion the next occurrence is calculated from the current day.
+*/
+func (e *Entry) NextEntry(newId string, timezone *time.Location) *Entry {
+	r := e.Recurrence(timezone)
+	if r == nil {
+		return nil
+	}
+
+	index := 1
+	if v, ok := e.ColumnOk("recur-count"); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			index = n
+		}
+	}
+
+	var cur, start time.Time
+	if r.AfterCompletion {
+		now := time.Now().In(timezone)
+		cur = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, timezone)
+		if e.TriggerAt() != nil {
+			t := e.TriggerAt().In(timezone)
+			cur = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, timezone)
+		}
+		start = cur
+	} else {
+		if e.TriggerAt() == nil {
+			return nil
+		}
+		cur = *e.TriggerAt()
+		start = cur
+		if v, ok := e.ColumnOk("recur-start"); ok {
+			if t, err := ParseDateTime(v, time.UTC); err == nil {
+				start = *t
+			}
+		}
+	}
+
+	next, ok := r.Next(cur, start, index, timezone)
+	if !ok {
+		return nil
+	}
+
+	cols := make(Columns)
+	for k, v := range e.Columns() {
+		cols[k] = v
+	}
+	delete(cols, "done-at")
+	if !r.AfterCompletion {
+		cols["recur-start"] = start.UTC().Format("2006-01-02 15:04:05")
+	}
+	cols["recur-count"] = strconv.Itoa(index + 1)
+
+	return MakeEntry(newId, e.Title(), e.Text(), TIMED, &next, e.Sort(), cols)
+}
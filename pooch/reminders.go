@@ -0,0 +1,262 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ The remind column of an entry with a date lists when reminders should be
+ sent, separated by commas, for example:
+
+	30m before
+	2 hours before, 1 day before
+	at 09:00
+
+ "at" sends the reminder at the specified time of the day the entry is due.
+ Reminders are delivered by the scheduler through every notifier configured
+ in the private settings (see notify.go) and each delivery attempt is
+ recorded in the reminders table, so that a reminder isn't sent twice.
+*/
+
+const (
+	REMINDER_MAX_ATTEMPTS = 3
+	REMINDER_RETRY_DELAY  = 5 * time.Minute
+	// reminders that are older than this are not sent
+	REMINDER_MAX_DELAY = 24 * time.Hour
+)
+
+var remindBeforeRE *regexp.Regexp = regexp.MustCompile("^([0-9]+) *(m|min|mins|minutes?|h|hours?|d|days?|w|weeks?) +before$")
+var remindAtRE *regexp.Regexp = regexp.MustCompile("^at +([0-9]{1,2}):([0-9]{2})$")
+
+// Returns the times when reminders for an entry due at triggerAt should be sent
+func ParseReminders(remind string, triggerAt time.Time, timezone *time.Location) ([]time.Time, error) {
+	r := []time.Time{}
+	for _, spec := range strings.Split(remind, ",") {
+		spec = strings.ToLower(strings.TrimSpace(spec))
+		if spec == "" {
+			continue
+		}
+
+		if m := remindBeforeRE.FindStringSubmatch(spec); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			var unit time.Duration
+			switch m[2][0] {
+			case 'm':
+				unit = time.Minute
+			case 'h':
+				unit = time.Hour
+			case 'd':
+				unit = 24 * time.Hour
+			case 'w':
+				unit = 7 * 24 * time.Hour
+			}
+			r = append(r, triggerAt.Add(-time.Duration(n)*unit).UTC())
+			continue
+		}
+
+		if m := remindAtRE.FindStringSubmatch(spec); m != nil {
+			hour, _ := strconv.Atoi(m[1])
+			minute, _ := strconv.Atoi(m[2])
+			if hour > 23 || minute > 59 {
+				return nil, MakeParseError(fmt.Sprintf("Invalid time in reminder: %s", spec))
+			}
+			t := triggerAt.In(timezone)
+			r = append(r, time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, timezone).UTC())
+			continue
+		}
+
+		return nil, MakeParseError(fmt.Sprintf("Can not parse reminder: %s", spec))
+	}
+	return r, nil
+}
+
+func checkReminders(e *Entry, timezone *time.Location) {
+	if remind, ok := e.ColumnOk("remind"); ok {
+		_, err := ParseReminders(remind, time.Now(), timezone)
+		Must(err)
+	}
+}
+
+// Returns the reminder times of the entry, invalid reminders are logged and ignored
+func (e *Entry) Reminders(timezone *time.Location) []time.Time {
+	remind, ok := e.ColumnOk("remind")
+	if !ok || e.TriggerAt() == nil || e.Priority() == DONE {
+		return nil
+	}
+	r, err := ParseReminders(remind, *e.TriggerAt(), timezone)
+	if err != nil {
+		Logf(WARN, "Ignoring reminders of %s: %s\n", e.Id(), err)
+		return nil
+	}
+	return r
+}
+
+type Reminder struct {
+	Tasklist string
+	Entry    *Entry
+	RemindAt time.Time
+	Timezone *time.Location
+}
+
+type reminderDelivery struct {
+	reminder *Reminder
+	notifier Notifier
+	err      error
+}
+
+type reminderRecord struct {
+	attempts    int
+	attemptedAt *time.Time
+	delivered   bool
+}
+
+func (tl *Tasklist) reminderEntries() []*Entry {
+	stmt, serr := tl.conn.Prepare(SELECT_HEADER + "WHERE tasks.id IN (SELECT id FROM columns WHERE name = 'remind') AND tasks.priority <> ? AND tasks.trashed_at = 0 AND tasks.trigger_at_field <> '' GROUP BY id")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(DONE))
+
+	r := []*Entry{}
+	for stmt.Next() {
+		entry, scanerr := StatementScan(stmt, true)
+		Must(scanerr)
+		r = append(r, entry)
+	}
+	return r
+}
+
+func (tl *Tasklist) reminderRecord(id string, remindAt time.Time, notifier string) reminderRecord {
+	stmt, serr := tl.conn.Prepare("SELECT attempts, attempted_at, delivered FROM reminders WHERE id = ? AND remind_at = ? AND notifier = ?")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id, remindAt.Format("2006-01-02 15:04:05"), notifier))
+
+	var r reminderRecord
+	if stmt.Next() {
+		var attemptedAt string
+		var delivered int
+		Must(stmt.Scan(&r.attempts, &attemptedAt, &delivered))
+		r.attemptedAt, _ = ParseDateTime(attemptedAt, time.UTC)
+		r.delivered = delivered != 0
+	}
+	return r
+}
+
+// Returns when the reminder should be sent through notifier, nil if it shouldn't be sent anymore
+func (tl *Tasklist) reminderNextAttempt(id string, remindAt time.Time, notifier string, now time.Time) *time.Time {
+	if now.Sub(remindAt) > REMINDER_MAX_DELAY {
+		return nil
+	}
+	rec := tl.reminderRecord(id, remindAt, notifier)
+	switch {
+	case rec.delivered || rec.attempts >= REMINDER_MAX_ATTEMPTS:
+		return nil
+	case rec.attemptedAt != nil:
+		t := rec.attemptedAt.Add(REMINDER_RETRY_DELAY)
+		return &t
+	default:
+		return &remindAt
+	}
+}
+
+// Returns the reminders that should be sent now and records the delivery attempt
+func (tl *Tasklist) dueReminders() []*reminderDelivery {
+	notifiers := tl.notifiers()
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	timezone := tl.GetTimezone()
+	now := time.Now().UTC()
+	r := []*reminderDelivery{}
+
+	for _, entry := range tl.reminderEntries() {
+		for _, remindAt := range entry.Reminders(timezone) {
+			for _, notifier := range notifiers {
+				next := tl.reminderNextAttempt(entry.Id(), remindAt, notifier.Name(), now)
+				if next == nil || next.After(now) {
+					continue
+				}
+				r = append(r, &reminderDelivery{&Reminder{tl.filename, entry, remindAt, timezone}, notifier, nil})
+			}
+		}
+	}
+
+	tl.WithTransaction(func() {
+		for _, d := range r {
+			tl.MustExec("INSERT OR IGNORE INTO reminders(id, remind_at, notifier) VALUES (?, ?, ?)", d.reminder.Entry.Id(), d.reminder.RemindAt.Format("2006-01-02 15:04:05"), d.notifier.Name())
+			tl.MustExec("UPDATE reminders SET attempts = attempts + 1, attempted_at = ? WHERE id = ? AND remind_at = ? AND notifier = ?", now.Format("2006-01-02 15:04:05"), d.reminder.Entry.Id(), d.reminder.RemindAt.Format("2006-01-02 15:04:05"), d.notifier.Name())
+		}
+	})
+
+	return r
+}
+
+func (tl *Tasklist) recordDeliveries(deliveries []*reminderDelivery) {
+	tl.WithTransaction(func() {
+		for _, d := range deliveries {
+			remindAt := d.reminder.RemindAt.Format("2006-01-02 15:04:05")
+			if d.err != nil {
+				Logf(WARN, "Couldn't send reminder for %s through %s: %s\n", d.reminder.Entry.Id(), d.notifier.Name(), d.err)
+				tl.MustExec("UPDATE reminders SET error = ? WHERE id = ? AND remind_at = ? AND notifier = ?", d.err.Error(), d.reminder.Entry.Id(), remindAt, d.notifier.Name())
+			} else {
+				tl.MustExec("UPDATE reminders SET delivered = 1, error = '' WHERE id = ? AND remind_at = ? AND notifier = ?", d.reminder.Entry.Id(), remindAt, d.notifier.Name())
+			}
+		}
+	})
+}
+
+// Returns the time of the next reminder that should be sent, nil if there isn't one
+func (tl *Tasklist) nextReminderAt() *time.Time {
+	notifiers := tl.notifiers()
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	timezone := tl.GetTimezone()
+	now := time.Now().UTC()
+	var r *time.Time
+
+	for _, entry := range tl.reminderEntries() {
+		for _, remindAt := range entry.Reminders(timezone) {
+			for _, notifier := range notifiers {
+				next := tl.reminderNextAttempt(entry.Id(), remindAt, notifier.Name(), now)
+				if next != nil && (r == nil || next.Before(*r)) {
+					r = next
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+// Sends the reminders that are due, the tasklist is only locked while reading and recording them
+func (tl *Tasklist) sendReminders() {
+	var deliveries []*reminderDelivery
+	tl.withLock(func() {
+		deliveries = tl.dueReminders()
+	})
+
+	if len(deliveries) == 0 {
+		return
+	}
+
+	for _, d := range deliveries {
+		Logf(INFO, "Sending reminder for %s through %s\n", d.reminder.Entry.Id(), d.notifier.Name())
+		d.err = d.notifier.Notify(d.reminder)
+	}
+
+	tl.withLock(func() {
+		tl.recordDeliveries(deliveries)
+	})
+}
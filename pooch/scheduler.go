@@ -0,0 +1,197 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ The scheduler runs the timed triggers (!trigger code and recurrences) of a
+ set of tasklists and sends their reminders when they are due, whether or
+ not someone is using the tasklist at the time. For each tasklist it
+ remembers the time of the next trigger or reminder, which is updated when
+ entries are saved by this process. Tasklists modified by other processes
+ are rescanned when the modification time of their file changes.
+*/
+
+const SCHEDULER_POLL_INTERVAL = time.Minute
+
+type scheduledTasklist struct {
+	next    *time.Time
+	mtime   time.Time
+	scanned bool
+}
+
+// RunTimedTriggers only picks up entries whose trigger time is strictly in the past
+func (st *scheduledTasklist) dueAt() time.Time {
+	return st.next.Add(time.Second)
+}
+
+type Scheduler struct {
+	mutex     sync.Mutex
+	tasklists map[string]*scheduledTasklist
+	wake      chan bool
+}
+
+var scheduler *Scheduler
+
+// Starts the scheduler in the background, only one scheduler can be started
+func StartScheduler(filenames []string) *Scheduler {
+	scheduler = &Scheduler{tasklists: make(map[string]*scheduledTasklist), wake: make(chan bool, 1)}
+	for _, filename := range filenames {
+		scheduler.Watch(filename)
+	}
+	go scheduler.run()
+	return scheduler
+}
+
+// Adds filename to the tasklists handled by the scheduler
+func (s *Scheduler) Watch(filename string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.tasklists[filename]; ok {
+		return
+	}
+	s.tasklists[filename] = &scheduledTasklist{}
+	s.wakeUp()
+}
+
+func (s *Scheduler) wakeUp() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// Tells the scheduler that filename has a trigger at t
+func (s *Scheduler) notify(filename string, t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st, ok := s.tasklists[filename]
+	if !ok {
+		return
+	}
+	if st.next == nil || t.Before(*st.next) {
+		st.next = &t
+		s.wakeUp()
+	}
+}
+
+func fileMtime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func (s *Scheduler) run() {
+	for {
+		for _, filename := range s.due() {
+			s.fire(filename)
+		}
+
+		s.mutex.Lock()
+		sleep := SCHEDULER_POLL_INTERVAL
+		now := time.Now()
+		for _, st := range s.tasklists {
+			if st.next != nil && st.dueAt().Sub(now) < sleep {
+				sleep = st.dueAt().Sub(now)
+			}
+		}
+		s.mutex.Unlock()
+
+		if sleep < time.Second {
+			sleep = time.Second
+		}
+
+		select {
+		case <-time.After(sleep):
+		case <-s.wake:
+		}
+	}
+}
+
+// Returns the tasklists that need to be scanned
+func (s *Scheduler) due() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	r := []string{}
+	for filename, st := range s.tasklists {
+		if !st.scanned || (st.next != nil && !st.dueAt().After(now)) || !fileMtime(filename).Equal(st.mtime) {
+			r = append(r, filename)
+		}
+	}
+	return r
+}
+
+// Runs the timed triggers of filename and finds out when it should be scanned again
+func (s *Scheduler) fire(filename string) {
+	var next *time.Time
+
+	func() {
+		defer func() {
+			if rerr := recover(); rerr != nil {
+				Logf(ERROR, "Error running timed triggers of %s: %v\n", filename, rerr)
+			}
+		}()
+
+		tl, err := OpenOrCreate(filename)
+		Must(err)
+		defer tl.Close()
+		tl.withLock(func() {
+			tl.RunTimedTriggers()
+		})
+		tl.sendReminders()
+		tl.withLock(func() {
+			next = tl.nextTriggerAt()
+			if reminderAt := tl.nextReminderAt(); reminderAt != nil && (next == nil || reminderAt.Before(*next)) {
+				next = reminderAt
+			}
+		})
+	}()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := s.tasklists[filename]
+	st.next = next
+	st.mtime = fileMtime(filename)
+	st.scanned = true
+}
+
+// Returns the time when the next timed entry will trigger, nil if there aren't timed entries
+func (tl *Tasklist) nextTriggerAt() *time.Time {
+	stmt, err := tl.conn.Prepare("SELECT min(trigger_at_field) FROM tasks WHERE priority = ? AND trashed_at = 0 AND trigger_at_field <> ''")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec(TIMED))
+
+	if !stmt.Next() {
+		return nil
+	}
+
+	var triggerAt string
+	Must(stmt.Scan(&triggerAt))
+	t, _ := ParseDateTime(triggerAt, time.UTC)
+	return t
+}
+
+func (tl *Tasklist) notifyScheduler(e *Entry) {
+	if scheduler == nil {
+		return
+	}
+	if e.Priority() == TIMED && e.TriggerAt() != nil {
+		scheduler.notify(tl.filename, *e.TriggerAt())
+	}
+	for _, remindAt := range e.Reminders(tl.GetTimezone()) {
+		scheduler.notify(tl.filename, remindAt)
+	}
+}
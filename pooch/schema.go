@@ -0,0 +1,228 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"fmt"
+
+	"github.com/carmark/gosqlite/sqlite"
+)
+
+/*
+Schema migrations for tasklist databases.
+
+The version of the schema of a tasklist is stored in the schema_version
+table, a database without that table is at version 0. The i-th element of
+schemaMigrations upgrades a database from version i to version i+1, each
+step runs inside its own transaction, together with the update of
+schema_version, so that a failed upgrade leaves the database at the last
+version that was completely applied.
+
+Migrations are never changed once released, new schema changes must be
+appended to the list.
+*/
+var schemaMigrations = []func(conn *sqlite.Conn){
+	migrateInitialSchema,
+	migrateHistory,
+	migrateTrash,
+	migrateTimestamps,
+	migrateReminders,
+	migrateAttachments,
+	migrateLinks,
+	migrateFTS5,
+	migrateColumnTypes,
+	migrateTimelog,
+	migrateSecretText,
+	migrateBackfillTimestamps,
+}
+
+func SchemaVersionLatest() int {
+	return len(schemaMigrations)
+}
+
+func SchemaVersion(conn *sqlite.Conn) int {
+	if !HasTable(conn, "schema_version") {
+		return 0
+	}
+
+	stmt, err := conn.Prepare("SELECT version FROM schema_version")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec())
+
+	if !stmt.Next() {
+		return 0
+	}
+
+	var version int
+	Must(stmt.Scan(&version))
+	return version
+}
+
+func setSchemaVersion(conn *sqlite.Conn, version int) {
+	MustExec(conn, "DELETE FROM schema_version")
+	MustExec(conn, "INSERT INTO schema_version(version) VALUES (?)", version)
+}
+
+/*
+Upgrades conn from version to version+1. The version is read again inside
+the transaction, if another process already upgraded the database nothing
+is done and false is returned.
+*/
+func migrateSchemaStep(conn *sqlite.Conn, version int) bool {
+	MustExec(conn, "BEGIN EXCLUSIVE TRANSACTION")
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			Logf(ERROR, "Rolling back migration to schema version %d, because of %v\n", version+1, rerr)
+			conn.Exec("ROLLBACK TRANSACTION")
+			panic(rerr)
+		}
+	}()
+
+	if SchemaVersion(conn) != version {
+		MustExec(conn, "COMMIT TRANSACTION")
+		return false
+	}
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS schema_version(version INTEGER)")
+	schemaMigrations[version](conn)
+	setSchemaVersion(conn, version+1)
+
+	MustExec(conn, "COMMIT TRANSACTION")
+	return true
+}
+
+/*
+Upgrades the schema of conn to the latest version known to this binary,
+refuses to touch databases created by a newer version of the program
+*/
+func MigrateSchema(filename string, conn *sqlite.Conn) {
+	version := SchemaVersion(conn)
+	latest := SchemaVersionLatest()
+
+	if version < latest {
+		Logf(INFO, "Upgrading schema of %s from version %d to version %d\n", filename, version, latest)
+	}
+
+	for version < latest {
+		if migrateSchemaStep(conn, version) {
+			Logf(INFO, "Schema of %s upgraded to version %d\n", filename, version+1)
+		}
+		version = SchemaVersion(conn)
+	}
+
+	if version > latest {
+		panic(fmt.Errorf("Tasklist %s has schema version %d, this program only supports up to version %d", filename, version, latest))
+	}
+}
+
+// Version 0 to 1: the schema as it was before schema_version was introduced.
+// Databases created by older versions can be in any intermediate state so
+// every statement here must be idempotent.
+func migrateInitialSchema(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS tasks(id TEXT PRIMARY KEY, title_field TEXT, text_field TEXT, priority INTEGER, trigger_at_field DATE, sort TEXT);")
+	MustExec(conn, "CREATE INDEX IF NOT EXISTS tasks_id ON tasks(id);")
+
+	if !HasTable(conn, "ridx") { // Workaround for non-accepted CREATE VIRTUAL TABLE IF NOT EXISTS
+		MustExec(conn, "CREATE VIRTUAL TABLE ridx USING fts3(id TEXT, title_field TEXT, text_field TEXT);")
+	}
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS columns(id TEXT, name TEXT, value TEXT, FOREIGN KEY (id) REFERENCES tasks (id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED)")
+	MustExec(conn, "CREATE INDEX IF NOT EXISTS columns_id ON columns(id);")
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS saved_searches(name TEXT, value TEXT);")
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS settings(name TEXT UNIQUE, value TEXT);")
+	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"timezone\", \"0\");")
+	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"theme\", \"tlist.css\");")
+	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"setup\", \"\");")
+	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"defaultsorttime\", \"0\");")
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS errorlog(timestamp TEXT, message TEXT);")
+
+	MustExec(conn, "CREATE TABLE IF NOT EXISTS private_settings(name TEXT UNIQUE, value TEXT);")
+	MustExec(conn, "INSERT OR IGNORE INTO private_settings(name, value) VALUES (\"enable_lua_execution_limit\", \"1\")")
+}
+
+// Version 1 to 2: revision history of entries
+func migrateHistory(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE history(rev INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT, timestamp INTEGER, action TEXT, title_field TEXT, text_field TEXT, priority INTEGER, trigger_at_field DATE, sort TEXT, columns TEXT);")
+	MustExec(conn, "CREATE INDEX history_id ON history(id);")
+}
+
+// Version 2 to 3: trash bin
+func migrateTrash(conn *sqlite.Conn) {
+	MustExec(conn, "ALTER TABLE tasks ADD COLUMN trashed_at INTEGER NOT NULL DEFAULT 0;")
+	MustExec(conn, "INSERT OR IGNORE INTO settings(name, value) VALUES (\"trashretention\", \"30\");")
+}
+
+// Version 3 to 4: creation and modification times, entries that already
+// exist are left with empty timestamps
+func migrateTimestamps(conn *sqlite.Conn) {
+	MustExec(conn, "ALTER TABLE tasks ADD COLUMN created_at DATE NOT NULL DEFAULT '';")
+	MustExec(conn, "ALTER TABLE tasks ADD COLUMN modified_at DATE NOT NULL DEFAULT '';")
+}
+
+// Version 4 to 5: delivery attempts of reminders, one row for each reminder
+// of an entry and notifier
+func migrateReminders(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE reminders(id TEXT, remind_at DATE, notifier TEXT, attempts INTEGER NOT NULL DEFAULT 0, attempted_at DATE NOT NULL DEFAULT '', delivered INTEGER NOT NULL DEFAULT 0, error TEXT NOT NULL DEFAULT '', PRIMARY KEY (id, remind_at, notifier));")
+}
+
+// Version 5 to 6: files attached to entries
+func migrateAttachments(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE attachments(id TEXT, name TEXT, content_type TEXT, size INTEGER, created_at DATE, data BLOB, PRIMARY KEY (id, name), FOREIGN KEY (id) REFERENCES tasks (id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED);")
+}
+
+// Version 6 to 7: typed links between entries
+func migrateLinks(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE links(id TEXT, type TEXT, target TEXT, PRIMARY KEY (id, type, target));")
+	MustExec(conn, "CREATE INDEX links_target ON links(target);")
+}
+
+// Version 7 to 8: ridx becomes a fts5 table with a stemming tokenizer, kept
+// in sync with tasks by triggers
+func migrateFTS5(conn *sqlite.Conn) {
+	MustExec(conn, "DROP TABLE ridx;")
+	MustExec(conn, "CREATE VIRTUAL TABLE ridx USING fts5(id UNINDEXED, title_field, text_field, tokenize = 'porter unicode61 remove_diacritics 1');")
+	MustExec(conn, "INSERT INTO ridx(id, title_field, text_field) SELECT id, title_field, text_field FROM tasks;")
+	MustExec(conn, "CREATE TRIGGER ridx_insert AFTER INSERT ON tasks BEGIN INSERT INTO ridx(id, title_field, text_field) VALUES (new.id, new.title_field, new.text_field); END;")
+	MustExec(conn, "CREATE TRIGGER ridx_update AFTER UPDATE OF id, title_field, text_field ON tasks WHEN old.id IS NOT new.id OR old.title_field IS NOT new.title_field OR old.text_field IS NOT new.text_field BEGIN DELETE FROM ridx WHERE id = old.id; INSERT INTO ridx(id, title_field, text_field) VALUES (new.id, new.title_field, new.text_field); END;")
+	MustExec(conn, "CREATE TRIGGER ridx_delete AFTER DELETE ON tasks BEGIN DELETE FROM ridx WHERE id = old.id; END;")
+}
+
+// Version 8 to 9: declared column types and typed copies of column values
+func migrateColumnTypes(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE coltypes(name TEXT, tag TEXT DEFAULT '', type TEXT, PRIMARY KEY (name, tag));")
+	MustExec(conn, "ALTER TABLE columns ADD COLUMN value_type TEXT DEFAULT '';")
+	MustExec(conn, "ALTER TABLE columns ADD COLUMN typed_value REAL;")
+}
+
+// Version 9 to 10: time tracked on entries
+func migrateTimelog(conn *sqlite.Conn) {
+	MustExec(conn, "CREATE TABLE timelog(id TEXT, started_at DATE, stopped_at DATE DEFAULT '', FOREIGN KEY (id) REFERENCES tasks (id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED);")
+	MustExec(conn, "CREATE INDEX timelog_id ON timelog(id);")
+}
+
+// Version 10 to 11: encrypted text (see secret.go) is not indexed by ridx,
+// the text of entries with the secret tag is removed from ridx and history
+func migrateSecretText(conn *sqlite.Conn) {
+	const indexedText = "CASE WHEN substr(new.text_field, 1, 16) = 'pooch-encrypted:' THEN '' ELSE new.text_field END"
+	MustExec(conn, "DROP TRIGGER ridx_insert;")
+	MustExec(conn, "DROP TRIGGER ridx_update;")
+	MustExec(conn, "CREATE TRIGGER ridx_insert AFTER INSERT ON tasks BEGIN INSERT INTO ridx(id, title_field, text_field) VALUES (new.id, new.title_field, "+indexedText+"); END;")
+	MustExec(conn, "CREATE TRIGGER ridx_update AFTER UPDATE OF id, title_field, text_field ON tasks WHEN old.id IS NOT new.id OR old.title_field IS NOT new.title_field OR old.text_field IS NOT new.text_field BEGIN DELETE FROM ridx WHERE id = old.id; INSERT INTO ridx(id, title_field, text_field) VALUES (new.id, new.title_field, "+indexedText+"); END;")
+	forgetSecretText(conn)
+}
+
+// Version 11 to 12: entries that existed before version 4 and have a history
+// get the time of their first revision as creation time and of their last
+// revision as modification time, the others are left with empty timestamps
+// (searches on :created and :modified skip them)
+func migrateBackfillTimestamps(conn *sqlite.Conn) {
+	MustExec(conn, "UPDATE tasks SET created_at = (SELECT datetime(min(timestamp), 'unixepoch') FROM history WHERE history.id = tasks.id) WHERE created_at = '' AND id IN (SELECT id FROM history);")
+	MustExec(conn, "UPDATE tasks SET modified_at = (SELECT datetime(max(timestamp), 'unixepoch') FROM history WHERE history.id = tasks.id) WHERE modified_at = '' AND id IN (SELECT id FROM history);")
+}
@@ -0,0 +1,328 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carmark/gosqlite/sqlite"
+)
+
+/*
+ The text of entries with the tag named by the secrettag setting (for
+ example secret) is encrypted before being saved, with AES-256-GCM and a key
+ derived from a passphrase. The passphrase is never stored: the tasklist
+ only keeps the salt used to derive the key (private setting secret_salt)
+ and a known string encrypted with it (private setting secret_check), so
+ that a wrong passphrase is detected. The passphrase must be set
+ explicitly with SetPassphrase (the setpassphrase command or the
+ /set-passphrase form), and can not be changed.
+
+ Encrypted text is saved as SECRET_PREFIX followed by the base64 of the
+ nonce and the ciphertext, it is not indexed by ridx and plain text copies
+ of it are removed from history.
+
+ Without the key (see Unlock) the encrypted text is returned as is, new or
+ changed text can not be saved in entries with the secret tag and the tag
+ can not be added to entries with text. Entries that had the tag before the
+ secrettag setting was set keep their text in clear until they are saved
+ unlocked, but it is removed from ridx and history.
+*/
+
+const SECRET_PREFIX = "pooch-encrypted:"
+const SECRET_CHECK = "pooch"
+const secretKeyIterations = 100000
+
+// PBKDF2 with HMAC-SHA256, producing a single block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	var blockIndex [4]byte
+	binary.BigEndian.PutUint32(blockIndex[:], 1)
+	mac.Write(blockIndex[:])
+	u := mac.Sum(nil)
+
+	r := make([]byte, len(u))
+	copy(r, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range r {
+			r[j] ^= u[j]
+		}
+	}
+	return r
+}
+
+func IsEncrypted(text string) bool {
+	return strings.HasPrefix(text, SECRET_PREFIX)
+}
+
+func encryptText(key []byte, text string) string {
+	block, err := aes.NewCipher(key)
+	Must(err)
+	gcm, err := cipher.NewGCM(block)
+	Must(err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	Must(err)
+	return SECRET_PREFIX + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(text), nil))
+}
+
+func decryptText(key []byte, text string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, SECRET_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", MakeParseError("Encrypted text is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (tl *Tasklist) hasPassphrase() bool {
+	return tl.GetPrivateSetting("secret_check") != ""
+}
+
+// Sets the passphrase of the tasklist, returns an error if it already has one
+func (tl *Tasklist) SetPassphrase(passphrase string) (err error) {
+	defer catchError(&err)
+
+	if passphrase == "" {
+		panic(MakeParseError("Empty passphrase"))
+	}
+	if tl.hasPassphrase() {
+		panic(MakeParseError("The tasklist already has a passphrase"))
+	}
+
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	Must(err)
+	key := pbkdf2SHA256([]byte(passphrase), salt, secretKeyIterations)
+
+	tl.WithTransaction(func() {
+		tl.MustExec("INSERT OR REPLACE INTO private_settings(name, value) VALUES ('secret_salt', ?)", base64.StdEncoding.EncodeToString(salt))
+		tl.MustExec("INSERT OR REPLACE INTO private_settings(name, value) VALUES ('secret_check', ?)", encryptText(key, SECRET_CHECK))
+	})
+	return nil
+}
+
+/*
+ Derives the key for passphrase, returns an error if passphrase isn't the
+ passphrase of this tasklist or if the tasklist doesn't have one
+*/
+func (tl *Tasklist) SecretKey(passphrase string) (key []byte, err error) {
+	defer catchError(&err)
+
+	if !tl.hasPassphrase() {
+		panic(MakeParseError("The tasklist doesn't have a passphrase, set one first"))
+	}
+
+	salt, serr := base64.StdEncoding.DecodeString(tl.GetPrivateSetting("secret_salt"))
+	Must(serr)
+	key = pbkdf2SHA256([]byte(passphrase), salt, secretKeyIterations)
+
+	plain, derr := decryptText(key, tl.GetPrivateSetting("secret_check"))
+	if derr != nil || subtle.ConstantTimeCompare([]byte(plain), []byte(SECRET_CHECK)) != 1 {
+		panic(MakeParseError("Wrong passphrase"))
+	}
+	return key, nil
+}
+
+// Sets the key used to encrypt and decrypt the text of secret entries, nil locks the tasklist
+func (tl *Tasklist) Unlock(key []byte) {
+	tl.secretKey = key
+}
+
+func (tl *Tasklist) secretTag() string {
+	return strings.TrimPrefix(strings.TrimSpace(tl.GetSetting("secrettag")), "#")
+}
+
+// Decrypts the text of e, if it is encrypted and the tasklist is unlocked
+func (tl *Tasklist) openSecret(e *Entry) {
+	if tl.secretKey == nil || !IsEncrypted(e.Text()) {
+		return
+	}
+	text, err := decryptText(tl.secretKey, e.Text())
+	if err != nil {
+		Logf(WARN, "Could not decrypt text of %s: %v\n", e.Id(), err)
+		return
+	}
+	e.SetText(text)
+}
+
+// Text of e as it should be saved
+func (tl *Tasklist) sealedText(e *Entry) string {
+	text := e.Text()
+	if text == "" || IsEncrypted(text) {
+		return text
+	}
+	tag := tl.secretTag()
+	if tag == "" {
+		return text
+	}
+	if value, ok := e.ColumnOk(tag); !ok || value != "" {
+		return text
+	}
+	if tl.secretKey == nil {
+		if tl.storedText(e.Id()) == text && tl.storedHasTag(e.Id(), tag) {
+			// tagged before secrettag was set, it will be encrypted the next time it's saved unlocked
+			return text
+		}
+		panic(MakeParseError("Entries tagged #" + tag + " are encrypted, unlock the tasklist first"))
+	}
+	return encryptText(tl.secretKey, text)
+}
+
+// Text of id as currently saved, empty if it doesn't exist
+func (tl *Tasklist) storedText(id string) string {
+	stmt, err := tl.conn.Prepare("SELECT text_field FROM tasks WHERE id = ?")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+
+	if !stmt.Next() {
+		return ""
+	}
+	var text string
+	Must(stmt.Scan(&text))
+	return text
+}
+
+// Returns true if id is saved with tag
+func (tl *Tasklist) storedHasTag(id, tag string) bool {
+	return len(tl.queryIds("SELECT id FROM columns WHERE id = ? AND name = ? AND value = ''", id, tag)) > 0
+}
+
+/*
+ Removes from ridx and history the plain text of the entries tagged with the
+ tag of the secrettag setting, it stays in tasks until they are saved
+ unlocked
+*/
+func forgetSecretText(conn *sqlite.Conn) {
+	tagged := "SELECT id FROM columns WHERE value = '' AND name = (SELECT ltrim(trim(value), '#') FROM settings WHERE name = 'secrettag')"
+	MustExec(conn, "UPDATE ridx SET text_field = '' WHERE id IN ("+tagged+")")
+	MustExec(conn, "UPDATE history SET text_field = '' WHERE substr(text_field, 1, ?) <> ? AND id IN ("+tagged+")", len(SECRET_PREFIX), SECRET_PREFIX)
+}
+
+// Removes from the history of id the copies of its text saved before it was encrypted
+func (tl *Tasklist) forgetPlainText(id string) {
+	tl.MustExec("UPDATE history SET text_field = '' WHERE id = ? AND substr(text_field, 1, ?) <> ?", id, len(SECRET_PREFIX), SECRET_PREFIX)
+}
+
+/*
+ Keys of the web sessions that unlocked a tasklist, by session token. They
+ are only kept in memory and forgotten after an hour of inactivity.
+*/
+type unlockedSession struct {
+	filename string
+	key      []byte
+	lastUsed time.Time
+}
+
+const unlockTimeout = time.Hour
+
+var unlockedSessions = map[string]*unlockedSession{}
+var unlockedSessionsMutex sync.Mutex
+
+func sessionKey(req *http.Request, tl *Tasklist) []byte {
+	token := GetCookies(req)["unlock"]
+	if token == "" {
+		return nil
+	}
+
+	unlockedSessionsMutex.Lock()
+	defer unlockedSessionsMutex.Unlock()
+
+	for k, s := range unlockedSessions {
+		if time.Since(s.lastUsed) > unlockTimeout {
+			delete(unlockedSessions, k)
+		}
+	}
+
+	s, ok := unlockedSessions[token]
+	if !ok || s.filename != tl.filename {
+		return nil
+	}
+	s.lastUsed = time.Now()
+	return s.key
+}
+
+// Calls fn with tl unlocked if the session of req unlocked it
+func withSessionKey(req *http.Request, tl *Tasklist, fn func()) {
+	tl.Unlock(sessionKey(req, tl))
+	defer tl.Unlock(nil)
+	fn()
+}
+
+func UnlockServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	if req.Method != "POST" {
+		UnlockHTML(map[string]interface{}{"unlocked": sessionKey(req, tl) != nil, "hasPassphrase": tl.hasPassphrase()}, c)
+		return
+	}
+
+	key, err := tl.SecretKey(req.FormValue("passphrase"))
+	Must(err)
+
+	token := MakeRandomString(20)
+	unlockedSessionsMutex.Lock()
+	unlockedSessions[token] = &unlockedSession{tl.filename, key, time.Now()}
+	unlockedSessionsMutex.Unlock()
+
+	s := ""
+	if SecureCookies {
+		s = " Secure"
+	}
+	c.Header().Set("Set-Cookie", "unlock="+token+"; path=/; HttpOnly; SameSite=Strict;"+s)
+	http.Redirect(c, req, "/list", http.StatusSeeOther)
+}
+
+func SetPassphraseServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	if req.Method != "POST" {
+		http.Redirect(c, req, "/unlock", http.StatusSeeOther)
+		return
+	}
+
+	if req.FormValue("passphrase") != req.FormValue("confirm") {
+		panic(MakeParseError("The passphrases don't match"))
+	}
+	Must(tl.SetPassphrase(req.FormValue("passphrase")))
+	http.Redirect(c, req, "/unlock", http.StatusSeeOther)
+}
+
+func LockServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	if token := GetCookies(req)["unlock"]; token != "" {
+		unlockedSessionsMutex.Lock()
+		delete(unlockedSessions, token)
+		unlockedSessionsMutex.Unlock()
+	}
+	c.Header().Set("Set-Cookie", "unlock=; path=/; Max-Age=0; HttpOnly")
+	http.Redirect(c, req, "/list", http.StatusSeeOther)
+}
@@ -6,10 +6,16 @@
 package pooch
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -23,9 +29,9 @@ func SingleWrapperTasklistWithIdServer(fn TasklistWithIdServer) http.HandlerFunc
 		WithOpenDefault(func(tl *Tasklist) {
 			id := req.FormValue("id")
 			if !tl.Exists(id) {
-				panic(fmt.Sprintf("Non-existent id specified"))
+				panic(MakeNotFoundError("Non-existent id specified"))
 			}
-			fn(c, req, tl, id)
+			withSessionKey(req, tl, func() { fn(c, req, tl, id) })
 		})
 	}
 }
@@ -33,18 +39,43 @@ func SingleWrapperTasklistWithIdServer(fn TasklistWithIdServer) http.HandlerFunc
 func SingleWrapperTasklistServer(fn TasklistServer) http.HandlerFunc {
 	return func(c http.ResponseWriter, req *http.Request) {
 		WithOpenDefault(func(tl *Tasklist) {
-			fn(c, req, tl)
+			withSessionKey(req, tl, func() { fn(c, req, tl) })
 		})
 	}
 }
 
+// HTTP status code for the value of a recovered panic
+func errorStatus(rerr interface{}) int {
+	err, ok := rerr.(error)
+	switch {
+	case !ok:
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrParse):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func WrapperServer(sub http.HandlerFunc) http.HandlerFunc {
 	return func(c http.ResponseWriter, req *http.Request) {
 		defer func() {
 			if rerr := recover(); rerr != nil {
+				status := errorStatus(rerr)
 				Log(ERROR, "Error while serving:", rerr)
-				WriteStackTrace(rerr, LoggerWriter)
-				io.WriteString(c, fmt.Sprintf("Internal server error: %s", rerr))
+				if status == http.StatusInternalServerError {
+					WriteStackTrace(rerr, LoggerWriter)
+				}
+				c.WriteHeader(status)
+				switch status {
+				case http.StatusNotFound:
+					io.WriteString(c, fmt.Sprintf("Not found: %s", rerr))
+				case http.StatusBadRequest:
+					io.WriteString(c, fmt.Sprintf("Bad request: %s", rerr))
+				default:
+					io.WriteString(c, fmt.Sprintf("Internal server error: %s", rerr))
+				}
 			}
 		}()
 
@@ -112,7 +143,7 @@ func StaticInMemoryServer(c http.ResponseWriter, req *http.Request) {
 func CheckFormValue(req *http.Request, name string) string {
 	v := req.FormValue(name)
 	if v == "" {
-		panic(fmt.Sprintf("Parameter %s not specified", name))
+		panic(MakeParseError(fmt.Sprintf("Parameter %s not specified", name)))
 	}
 	return v
 }
@@ -123,7 +154,7 @@ func CheckBool(in string, name string) bool {
 	} else if in == "false" {
 		return false
 	} else {
-		panic(fmt.Sprintf("Parameter %s not in true or false", name))
+		panic(MakeParseError(fmt.Sprintf("Parameter %s not in true or false", name)))
 	}
 
 	return false
@@ -132,20 +163,22 @@ func CheckBool(in string, name string) bool {
 func ChangePriorityServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
 	special := CheckBool(CheckFormValue(req, "special"), "special")
 
-	priority := tl.UpgradePriority(id, special)
+	priority, err := tl.UpgradePriority(id, special)
+	Must(err)
 
 	io.WriteString(c, fmt.Sprintf("priority-change-to: %d %s", priority, strings.ToUpper(priority.String())))
 }
 
 func GetServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
-	entry := tl.Get(id)
+	entry, err := tl.Get(id)
+	Must(err)
 	addCols := !(req.FormValue("nocols") == "1")
 	io.WriteString(c, time.Now().UTC().Format("2006-01-02 15:04:05")+"\n")
 	json.NewEncoder(c).Encode(MarshalEntry(entry, tl.GetTimezone(), addCols))
 }
 
 func RemoveServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
-	tl.Remove(id)
+	Must(tl.Remove(id))
 	v := req.URL.Query()["pid"]
 	if v != nil && len(v) == 1 {
 		pid := v[0]
@@ -156,15 +189,145 @@ func RemoveServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id str
 	io.WriteString(c, "removed")
 }
 
+func HistoryServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	history, err := tl.GetHistory(CheckFormValue(req, "id"))
+	Must(err)
+	Must(json.NewEncoder(c).Encode(history))
+}
+
+func RevertServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	id := CheckFormValue(req, "id")
+	rev, err := strconv.Atoi(CheckFormValue(req, "rev"))
+	if err != nil {
+		panic(MakeParseError(fmt.Sprintf("Error converting rev parameter to int %s: %s", req.FormValue("rev"), err)))
+	}
+	Must(tl.Revert(id, rev))
+	io.WriteString(c, "reverted")
+}
+
 func ExplodeBodyServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
-	tl.Explode(id)
+	Must(tl.Explode(id))
 	io.WriteString(c, "exploded")
 }
 
+// GET downloads the attachment called name, POST attaches the file field of a multipart form
+func AttachmentServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	if req.Method == "POST" {
+		file, header, err := req.FormFile("file")
+		if err != nil {
+			panic(MakeParseError(fmt.Sprintf("Couldn't read uploaded file: %s", err)))
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		Must(err)
+
+		name := req.FormValue("name")
+		if name == "" {
+			name = header.Filename
+		}
+		Must(tl.Attach(id, name, "", data))
+		io.WriteString(c, "attached: "+name)
+		return
+	}
+
+	a, err := tl.GetAttachment(id, CheckFormValue(req, "name"))
+	Must(err)
+	c.Header().Set("Content-Type", a.ContentType)
+	c.Header().Set("Content-Length", strconv.Itoa(len(a.Data)))
+	c.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	c.Header().Set("X-Content-Type-Options", "nosniff")
+	c.Write(a.Data)
+}
+
+func AttachmentsServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	attachments, err := tl.Attachments(id)
+	Must(err)
+	Must(json.NewEncoder(c).Encode(attachments))
+}
+
+func DetachServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	Must(tl.Detach(id, CheckFormValue(req, "name")))
+	io.WriteString(c, "detached")
+}
+
+func LinkServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	Must(tl.Link(id, CheckFormValue(req, "type"), CheckFormValue(req, "target")))
+	io.WriteString(c, "linked")
+}
+
+func UnlinkServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	Must(tl.Unlink(id, CheckFormValue(req, "type"), CheckFormValue(req, "target")))
+	io.WriteString(c, "unlinked")
+}
+
+func LinksServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	links, err := tl.Links(id)
+	Must(err)
+	Must(json.NewEncoder(c).Encode(links))
+}
+
+func StartTimerServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
+	_, err := tl.StartTimer(id)
+	Must(err)
+	io.WriteString(c, "started")
+}
+
+func StopTimerServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	_, err := tl.StopTimer()
+	Must(err)
+	io.WriteString(c, "stopped")
+}
+
+func TimerServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	ti, err := tl.RunningTimer()
+	Must(err)
+	Must(json.NewEncoder(c).Encode(ti))
+}
+
+func formTime(req *http.Request, name string, timezone *time.Location) *time.Time {
+	if req.FormValue(name) == "" {
+		return nil
+	}
+	t, err := ParseDateTime(req.FormValue(name), timezone)
+	Must(err)
+	return t
+}
+
+func TimeReportServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	timezone := tl.GetTimezone()
+	query := req.FormValue("q")
+	report, err := tl.TimeReport(query, formTime(req, "from", timezone), formTime(req, "to", timezone))
+	Must(err)
+
+	headerInfo := headerInfo(tl, "/timereport", query, "", false, false, nil, nil, nil)
+	CommonHeaderHTML(headerInfo, c)
+
+	TimeReportHeaderHTML(map[string]string{"from": req.FormValue("from"), "to": req.FormValue("to")}, c)
+	TimeReportSectionHTML(map[string]string{"name": "Entry"}, c)
+	for i, line := range report.Entries {
+		TimeReportLineHTML(map[string]interface{}{"htmlClass": listRowClass(i), "line": line, "link": "#:id=" + line.Name}, c)
+	}
+	TimeReportLineHTML(map[string]interface{}{"htmlClass": "entry", "line": &report.Total}, c)
+
+	TimeReportSectionHTML(map[string]string{"name": "Tag"}, c)
+	for i, line := range report.Tags {
+		TimeReportLineHTML(map[string]interface{}{"htmlClass": listRowClass(i), "line": line, "link": "#" + line.Name}, c)
+	}
+
+	ListEnderHTML(nil, c)
+}
+
+func listRowClass(idx int) string {
+	if idx%2 != 0 {
+		return "entry oddentry"
+	}
+	return "entry"
+}
+
 func QaddServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	entry := tl.ParseNew(CheckFormValue(req, "text"), req.FormValue("q"))
 
-	tl.Add(entry)
+	Must(tl.Add(entry))
 
 	isi, parent := IsSubitem(entry.Columns())
 	if isi {
@@ -178,11 +341,11 @@ func SaveServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	umentry := &UnmarshalEntry{}
 
 	if err := json.NewDecoder(req.Body).Decode(umentry); err != nil {
-		panic(err)
+		panic(MakeParseError(err.Error()))
 	}
 
 	if !tl.Exists(umentry.Id) {
-		panic("Specified id does not exists")
+		panic(MakeNotFoundError("Specified id does not exists"))
 	}
 
 	entry := DemarshalEntry(umentry, tl.GetTimezone())
@@ -192,7 +355,7 @@ func SaveServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 		entry.Print()
 	}
 
-	tl.Update(entry, false)
+	Must(tl.Update(entry, false))
 
 	io.WriteString(c, "saved-at-timestamp: "+time.Now().UTC().Format("2006-01-02 15:04:05"))
 }
@@ -285,7 +448,7 @@ func headerInfo(tl *Tasklist, pageName string, query string, trigger string, isS
 		"query":         query,
 		"queryForTitle": queryForTitle(query),
 		"theme":         css,
-		"timezone":      fmt.Sprintf("%d", timezone),
+		"timezone":      timezone.String(),
 		"removeSearch":  removeSearch,
 		"retrieveError": retrieveError,
 		"parseError":    parseError,
@@ -338,7 +501,8 @@ func RunServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 
 	Logf(INFO, "Running command: "+command[0])
 
-	fentry := tl.Get(command[0])
+	fentry, err := tl.Get(command[0])
+	Must(err)
 	tl.DoRunString(fentry.Text(), command[1:len(command)])
 
 	headerInfo := headerInfo(tl, "/list", commandstr, "", false, false, nil, nil, map[string]string{"hideprioritycol": "", "showidcol": "", "hidecatscol": ""})
@@ -401,7 +565,13 @@ func ListJsonServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	}
 
 	_, incsub := options["sub"]
-	v, rerr := tl.Retrieve(theselect, code, incsub, sortCols)
+	scopeQuery, filenames, rerr := webSearchScope(req, tl, query)
+	var v []*Entry
+	if rerr == nil && filenames != nil {
+		v, _, rerr = tl.SearchTasklists(scopeQuery, filenames)
+	} else if rerr == nil {
+		v, rerr = tl.Retrieve(theselect, code, incsub, sortCols)
+	}
 
 	answ.RetrieveError = rerr
 	if rerr != nil {
@@ -409,15 +579,39 @@ func ListJsonServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 		return
 	}
 
+	snippets, _ := tl.Snippets(query)
+
 	answ.Results = make([]UnmarshalEntry, 0)
 
 	for _, entry := range v {
-		answ.Results = append(answ.Results, *MarshalEntry(entry, timezone, true))
+		umentry := MarshalEntry(entry, timezone, true)
+		umentry.Snippet = snippets[entry.Id()]
+		answ.Results = append(answ.Results, *umentry)
+	}
+
+	if spec := AggregateSpecFromOptions(options); spec != nil {
+		aggregates, err := tl.Aggregate(v, spec)
+		Must(err)
+		answ.Aggregates = aggregates
 	}
 
 	serializeAnswer()
 }
 
+// Like SearchScope for the search of a request, the multi user server only searches the tasklist of the user
+func webSearchScope(req *http.Request, tl *Tasklist, query string) (scopeQuery string, filenames []string, err error) {
+	defer catchError(&err)
+
+	scopeQuery, in := tl.searchIn(query, req.FormValue("in"))
+	if in == "" {
+		return query, nil, nil
+	}
+	if multiuserDb != nil {
+		panic(MakeParseError("Searches across tasklists (#:in) are not available on this server"))
+	}
+	return scopeQuery, ResolveTasklists(in), nil
+}
+
 func ListServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	gutsOnly := req.FormValue("guts") != ""
 	query := strings.Replace(req.FormValue("q"), "\r", "", -1)
@@ -442,7 +636,14 @@ func ListServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	}
 
 	_, incsub := options["sub"]
-	v, rerr := tl.Retrieve(theselect, code, incsub, sortCols)
+	scopeQuery, filenames, rerr := webSearchScope(req, tl, query)
+	var v []*Entry
+	if rerr == nil && filenames != nil {
+		// entries of other tasklists, with a tasklist column
+		v, showCols, rerr = tl.SearchTasklists(scopeQuery, filenames)
+	} else if rerr == nil {
+		v, rerr = tl.Retrieve(theselect, code, incsub, sortCols)
+	}
 
 	_, subsort := options["ssort"]
 
@@ -463,6 +664,11 @@ func ListServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 
 	catordering := tl.CategoryDepth()
 
+	snippets := map[string]string{}
+	if perr == nil {
+		snippets, _ = tl.Snippets(query)
+	}
+
 	headerInfo := headerInfo(tl, "/list", query, trigger, isSavedSearch, true, perr, rerr, options)
 
 	if !gutsOnly {
@@ -470,42 +676,51 @@ func ListServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 		EntryListHeaderHTML(nil, c)
 	}
 
-	var curp Priority = INVALID
-	for idx, entry := range v {
-		if (curp != entry.Priority()) && !subsort && (len(v) > 1) {
-			EntryListPriorityChangeHTML(map[string]interface{}{"entry": entry, "colNames": showCols, "PrioritySize": prioritySize}, c)
-			curp = entry.Priority()
-		}
+	var aggregates *Aggregates
+	if spec := AggregateSpecFromOptions(options); spec != nil && rerr == nil {
+		var err error
+		aggregates, err = tl.Aggregate(v, spec)
+		Must(err)
+	}
 
-		htmlClass := "entry"
-		if idx%2 != 0 {
-			htmlClass += " oddentry"
+	aggregateRow := func(label string, a *Aggregate) {
+		if values := a.Values(); len(values) > 0 {
+			EntryListAggregateHTML(map[string]interface{}{"label": label, "values": values, "colspan": prioritySize + len(showCols)}, c)
 		}
+	}
 
-		cols := []string{}
-		for _, colName := range showCols {
-			cols = append(cols, entry.Columns()[colName])
+	if aggregates != nil && len(aggregates.Groups) > 0 {
+		entries := map[string]*Entry{}
+		for _, entry := range v {
+			entries[entry.Id()] = entry
 		}
-
-		entryEntry := map[string](interface{}){
-			"heading":   entry.Id(),
-			"entry":     entry,
-			"etime":     TimeString(entry.TriggerAt(), entry.Sort(), timezone),
-			"ecats":     entry.CatString(catordering),
-			"htmlClass": htmlClass,
-			"cols":      cols,
+		idx := 0
+		for _, group := range aggregates.Groups {
+			title := aggregates.Spec.GroupBy + "=" + group.Group
+			if group.Group == "" {
+				title = "without " + aggregates.Spec.GroupBy
+			}
+			EntryListGroupHTML(map[string]interface{}{"group": title, "colNames": showCols, "PrioritySize": prioritySize}, c)
+			for _, id := range group.Ids {
+				listServerEntry(c, entries[id], idx, len(v), showCols, snippets, catordering, timezone)
+				idx++
+			}
+			aggregateRow("Subtotal", group)
 		}
+	} else {
+		var curp Priority = INVALID
+		for idx, entry := range v {
+			if (curp != entry.Priority()) && !subsort && (len(v) > 1) {
+				EntryListPriorityChangeHTML(map[string]interface{}{"entry": entry, "colNames": showCols, "PrioritySize": prioritySize}, c)
+				curp = entry.Priority()
+			}
 
-		text := entry.text
-		if len(v) > 1 {
-			entry.text = ""
+			listServerEntry(c, entry, idx, len(v), showCols, snippets, catordering, timezone)
 		}
+	}
 
-		EntryListEntryHTML(entryEntry, c)
-
-		entry.text = text
-
-		EntryListEntryEditorHTML(entryEntry, c)
+	if aggregates != nil {
+		aggregateRow("Total", aggregates.Total)
 	}
 
 	if !gutsOnly {
@@ -515,6 +730,39 @@ func ListServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	}
 }
 
+func listServerEntry(c http.ResponseWriter, entry *Entry, idx, count int, showCols []string, snippets map[string]string, catordering map[string]int, timezone *time.Location) {
+	htmlClass := "entry"
+	if idx%2 != 0 {
+		htmlClass += " oddentry"
+	}
+
+	cols := []string{}
+	for _, colName := range showCols {
+		cols = append(cols, entry.Columns()[colName])
+	}
+
+	entryEntry := map[string](interface{}){
+		"heading":   entry.Id(),
+		"entry":     entry,
+		"etime":     TimeString(entry.TriggerAt(), entry.Sort(), timezone),
+		"ecats":     entry.CatString(catordering),
+		"htmlClass": htmlClass,
+		"cols":      cols,
+		"snippet":   snippets[entry.Id()],
+	}
+
+	text := entry.text
+	if count > 1 {
+		entry.text = ""
+	}
+
+	EntryListEntryHTML(entryEntry, c)
+
+	entry.text = text
+
+	EntryListEntryEditorHTML(entryEntry, c)
+}
+
 func ChildsServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	id := req.FormValue("id")
 
@@ -531,7 +779,8 @@ func NewServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	if asChild != "0" {
 		pid = id
 	} else {
-		entry := tl.Get(id)
+		entry, err := tl.Get(id)
+		Must(err)
 		var ok bool
 		ok, pid = IsSubitem(entry.Columns())
 		if !ok {
@@ -544,7 +793,7 @@ func NewServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	childs := tl.GetChildren(pid)
 	nentry := tl.ParseNew("#"+subcol, "")
 	nentry.SetColumn(subcol, strconv.Itoa(len(childs)))
-	tl.Add(nentry)
+	Must(tl.Add(nentry))
 
 	if asChild == "0" {
 		newchilds := addAfter(nentry.Id(), id, childs)
@@ -584,7 +833,8 @@ func MoveChildServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	dst := req.FormValue("dst")
 	asChild := req.FormValue("child")
 
-	sentry := tl.Get(src)
+	sentry, err := tl.Get(src)
+	Must(err)
 
 	wasChild, spid := IsSubitem(sentry.Columns())
 
@@ -594,13 +844,14 @@ func MoveChildServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 
 	pid := dst
 	if asChild == "0" {
-		dentry := tl.Get(dst)
+		dentry, err := tl.Get(dst)
+		Must(err)
 		_, pid = IsSubitem(dentry.Columns())
 	}
 
 	siblings := tl.GetChildren(pid)
 	sentry.SetColumn("sub/"+pid, strconv.Itoa(len(siblings)))
-	tl.Update(sentry, false)
+	Must(tl.Update(sentry, false))
 
 	if asChild == "0" {
 		newsiblings := addAfter(src, dst, siblings)
@@ -651,8 +902,8 @@ func GetCalendarEvents(tl *Tasklist, query string, start, end string, endSecs in
 		if entry.Priority() != TIMED {
 			continue
 		}
-		if freq := entry.Freq(); freq > 0 {
-			for newEntry := entry.NextEntry(""); newEntry.Before(endSecs); newEntry = newEntry.NextEntry("") {
+		if rec := entry.Recurrence(timezone); rec != nil && !rec.AfterCompletion {
+			for newEntry := entry.NextEntry("", timezone); newEntry != nil && newEntry.Before(endSecs); newEntry = newEntry.NextEntry("", timezone) {
 				r = append(r, ToCalendarEvent(newEntry, className, timezone))
 			}
 		}
@@ -665,10 +916,10 @@ func CalendarEventServer(c http.ResponseWriter, req *http.Request, tl *Tasklist)
 	var startSecs, endSecs int64
 	var err error
 	if startSecs, err = strconv.ParseInt(req.FormValue("start"), 10, 64); err != nil {
-		panic(fmt.Sprintf("Error converting start parameter to int %s: %s", req.FormValue("start"), err))
+		panic(MakeParseError(fmt.Sprintf("Error converting start parameter to int %s: %s", req.FormValue("start"), err)))
 	}
 	if endSecs, err = strconv.ParseInt(req.FormValue("end"), 10, 64); err != nil {
-		panic(fmt.Sprintf("Error converting start parameter to int %s: %s", req.FormValue("end"), err))
+		panic(MakeParseError(fmt.Sprintf("Error converting end parameter to int %s: %s", req.FormValue("end"), err)))
 	}
 
 	start := time.Unix(startSecs, 0).Format("2006-01-02")
@@ -685,8 +936,54 @@ func CalendarEventServer(c http.ResponseWriter, req *http.Request, tl *Tasklist)
 	}
 }
 
+/*
+ Calendar clients can't log in, feeds are authenticated by the apiToken
+ parameter, which must be one of the API tokens of the user (multiuser) or
+ the api_token private option of the tasklist
+*/
+func checkAPIToken(c http.ResponseWriter, req *http.Request, multiuserDb *MultiuserDb, tl *Tasklist) bool {
+	token := req.FormValue("apiToken")
+	ok := false
+	if multiuserDb != nil {
+		ok = token != "" && multiuserDb.usernameFromAPIToken(req) == multiuserDb.UsernameFromReq(req)
+	} else {
+		expected := tl.GetPrivateSetting("api_token")
+		ok = expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+	}
+	if !ok {
+		c.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(c, "Unauthorized: a valid apiToken is required\n")
+	}
+	return ok
+}
+
+func IcsServer(c http.ResponseWriter, req *http.Request, multiuserDb *MultiuserDb, tl *Tasklist) {
+	if !checkAPIToken(c, req, multiuserDb, tl) {
+		return
+	}
+
+	var buf bytes.Buffer
+	Must(tl.WriteICS(&buf, req.FormValue("q")))
+
+	c.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	buf.WriteTo(c)
+}
+
+func ImportIcsServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		panic(MakeParseError(fmt.Sprintf("Couldn't read uploaded file: %s", err)))
+	}
+	defer file.Close()
+
+	added, updated, err := tl.ImportICS(file, req.FormValue("tags"))
+	Must(err)
+	io.WriteString(c, fmt.Sprintf("imported: %d added, %d updated", added, updated))
+}
+
 func HtmlGetServer(c http.ResponseWriter, req *http.Request, tl *Tasklist, id string) {
-	entry := tl.Get(id)
+	entry, err := tl.Get(id)
+	Must(err)
 
 	entryEntry := map[string](interface{}){
 		"heading": nil,
@@ -712,7 +1009,7 @@ func SaveSearchServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	}
 
 	if query != "" {
-		tl.SaveSearch(name, query)
+		Must(tl.SaveSearch(name, query))
 	} else {
 		query = tl.GetSavedSearch(name)
 	}
@@ -723,14 +1020,14 @@ func SaveSearchServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 func RemoveSearchServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	pr := tl.ParseEx(req.FormValue("query"))
 	if pr.savedSearch != "" {
-		tl.RemoveSaveSearch(pr.savedSearch)
+		Must(tl.RemoveSaveSearch(pr.savedSearch))
 	}
 }
 
 func RenTagServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 	sourceTag := req.FormValue("from")
 	destTag := req.FormValue("to")
-	tl.RenameTag(sourceTag, destTag)
+	Must(tl.RenameTag(sourceTag, destTag))
 	io.WriteString(c, "rename successful")
 }
 
@@ -747,7 +1044,7 @@ func OptionServer(c http.ResponseWriter, req *http.Request, multiuserDb *Multius
 				settings[k] = v[0]
 			}
 		}
-		tl.SetSettings(settings)
+		Must(tl.SetSettings(settings))
 
 		if settings["setup"] != "" {
 			tl.DoString(settings["setup"], nil)
@@ -869,7 +1166,7 @@ func OntologyServer(c http.ResponseWriter, req *http.Request, tl *Tasklist) {
 
 		mor, err := json.Marshal(ontology)
 		Must(err)
-		tl.SetSetting("ontology", string(mor))
+		Must(tl.SetSetting("ontology", string(mor)))
 
 		c.Write([]byte("ok"))
 	} else {
@@ -885,7 +1182,7 @@ func OntologySaveServer(c http.ResponseWriter, req *http.Request, tl *Tasklist)
 
 	mor, err := json.Marshal(or)
 	Must(err)
-	tl.SetSetting("ontology", string(mor))
+	Must(tl.SetSetting("ontology", string(mor)))
 
 	c.Write([]byte("ok"))
 }
@@ -912,6 +1209,8 @@ func SetupHandleFunc(wrapperTasklistServer func(TasklistServer) http.HandlerFunc
 	http.HandleFunc("/qadd", WrapperServer(wrapperTasklistServer(QaddServer)))
 	http.HandleFunc("/remove", WrapperServer(wrapperTasklistWithIdServer(RemoveServer)))
 	http.HandleFunc("/htmlget", WrapperServer(wrapperTasklistWithIdServer(HtmlGetServer)))
+	http.HandleFunc("/history", WrapperServer(wrapperTasklistServer(HistoryServer)))
+	http.HandleFunc("/revert", WrapperServer(wrapperTasklistServer(RevertServer)))
 	http.HandleFunc("/save-search", WrapperServer(wrapperTasklistServer(SaveSearchServer)))
 	http.HandleFunc("/remove-search", WrapperServer(wrapperTasklistServer(RemoveSearchServer)))
 	http.HandleFunc("/ontology", WrapperServer(wrapperTasklistServer(OntologyServer)))
@@ -922,6 +1221,11 @@ func SetupHandleFunc(wrapperTasklistServer func(TasklistServer) http.HandlerFunc
 
 	// Calendar ajax urls
 	http.HandleFunc("/calevents", WrapperServer(wrapperTasklistServer(CalendarEventServer)))
+	http.HandleFunc("/cal.ics", WrapperServer(wrapperTasklistServer(
+		func(res http.ResponseWriter, req *http.Request, tl *Tasklist) {
+			IcsServer(res, req, multiuserDb, tl)
+		})))
+	http.HandleFunc("/importics", WrapperServer(wrapperTasklistServer(ImportIcsServer)))
 
 	// Options support urls
 	http.HandleFunc("/rentag", WrapperServer(wrapperTasklistServer(RenTagServer)))
@@ -932,9 +1236,33 @@ func SetupHandleFunc(wrapperTasklistServer func(TasklistServer) http.HandlerFunc
 	http.HandleFunc("/newsubitem", WrapperServer(wrapperTasklistServer(NewServer)))
 	http.HandleFunc("/movechild", WrapperServer(wrapperTasklistServer(MoveChildServer)))
 	http.HandleFunc("/explode", WrapperServer(wrapperTasklistWithIdServer(ExplodeBodyServer)))
+
+	// Attachments
+	http.HandleFunc("/attachment", WrapperServer(wrapperTasklistWithIdServer(AttachmentServer)))
+	http.HandleFunc("/attachments.json", WrapperServer(wrapperTasklistWithIdServer(AttachmentsServer)))
+	http.HandleFunc("/detach", WrapperServer(wrapperTasklistWithIdServer(DetachServer)))
+
+	// Links
+	http.HandleFunc("/link", WrapperServer(wrapperTasklistWithIdServer(LinkServer)))
+	http.HandleFunc("/unlink", WrapperServer(wrapperTasklistWithIdServer(UnlinkServer)))
+	http.HandleFunc("/links.json", WrapperServer(wrapperTasklistWithIdServer(LinksServer)))
+
+	// Encrypted entries
+	http.HandleFunc("/unlock", WrapperServer(wrapperTasklistServer(UnlockServer)))
+	http.HandleFunc("/set-passphrase", WrapperServer(wrapperTasklistServer(SetPassphraseServer)))
+	http.HandleFunc("/lock", WrapperServer(wrapperTasklistServer(LockServer)))
+
+	// Time tracking
+	http.HandleFunc("/start", WrapperServer(wrapperTasklistWithIdServer(StartTimerServer)))
+	http.HandleFunc("/stop", WrapperServer(wrapperTasklistServer(StopTimerServer)))
+	http.HandleFunc("/timer.json", WrapperServer(wrapperTasklistServer(TimerServer)))
+	http.HandleFunc("/timereport", WrapperServer(wrapperTasklistServer(TimeReportServer)))
 }
 
 func Serve(port string) {
+	if dbname := os.Getenv("POOCHDB"); dbname != "" {
+		StartScheduler([]string{dbname})
+	}
 	SetupHandleFunc(SingleWrapperTasklistServer, SingleWrapperTasklistWithIdServer, nil)
 	err := http.ListenAndServe(":"+port, nil)
 	if err != nil {
@@ -946,7 +1274,7 @@ func Serve(port string) {
 
 type EventForJSON map[string]interface{}
 
-func ToCalendarEvent(entry *Entry, className string, timezone int) EventForJSON {
+func ToCalendarEvent(entry *Entry, className string, timezone *time.Location) EventForJSON {
 	return map[string]interface{}{
 		"id":             entry.Id(),
 		"title":          entry.Title(),
@@ -0,0 +1,215 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+ Time spent on entries is recorded in the timelog table as intervals,
+ the interval of the running timer has an empty stopped_at. Only one timer
+ runs at a time, starting a timer stops the one that is running.
+*/
+
+type TimeInterval struct {
+	Id    string
+	Title string
+	Start time.Time
+	// nil while the timer is running
+	Stop *time.Time
+}
+
+func (ti *TimeInterval) Duration() time.Duration {
+	if ti.Stop == nil {
+		return time.Now().Sub(ti.Start)
+	}
+	return ti.Stop.Sub(ti.Start)
+}
+
+func formatTimelog(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (tl *Tasklist) queryIntervals(query string, v ...interface{}) []*TimeInterval {
+	stmt, serr := tl.conn.Prepare("SELECT timelog.id, tasks.title_field, timelog.started_at, timelog.stopped_at FROM timelog, tasks WHERE tasks.id = timelog.id AND " + query)
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec(v...))
+
+	r := []*TimeInterval{}
+	for stmt.Next() {
+		ti := &TimeInterval{}
+		var startedAt, stoppedAt string
+		Must(stmt.Scan(&ti.Id, &ti.Title, &startedAt, &stoppedAt))
+		if t, _ := ParseDateTime(startedAt, time.UTC); t != nil {
+			ti.Start = *t
+		}
+		if stoppedAt != "" {
+			ti.Stop, _ = ParseDateTime(stoppedAt, time.UTC)
+		}
+		r = append(r, ti)
+	}
+	return r
+}
+
+// Returns the running timer, nil if there isn't one
+func (tl *Tasklist) RunningTimer() (ti *TimeInterval, err error) {
+	defer catchError(&err)
+	return tl.runningTimer(), nil
+}
+
+func (tl *Tasklist) runningTimer() *TimeInterval {
+	r := tl.queryIntervals("timelog.stopped_at = ''")
+	if len(r) == 0 {
+		return nil
+	}
+	return r[0]
+}
+
+// Starts a timer for id, returns the timer that was stopped to start it, if any
+func (tl *Tasklist) StartTimer(id string) (stopped *TimeInterval, err error) {
+	defer catchError(&err)
+	if !tl.Exists(id) {
+		panic(MakeNotFoundError("Couldn't find entry %s", id))
+	}
+	tl.WithTransaction(func() {
+		now := time.Now()
+		stopped = tl.stopTimer(now)
+		tl.MustExec("INSERT INTO timelog(id, started_at, stopped_at) VALUES (?, ?, '')", id, formatTimelog(now))
+	})
+	return stopped, nil
+}
+
+// Stops the running timer and returns it
+func (tl *Tasklist) StopTimer() (ti *TimeInterval, err error) {
+	defer catchError(&err)
+	if ti = tl.stopTimer(time.Now()); ti == nil {
+		panic(MakeNotFoundError("No timer is running"))
+	}
+	return ti, nil
+}
+
+func (tl *Tasklist) stopTimer(now time.Time) *TimeInterval {
+	ti := tl.runningTimer()
+	if ti == nil {
+		return nil
+	}
+	tl.MustExec("UPDATE timelog SET stopped_at = ? WHERE stopped_at = ''", formatTimelog(now))
+	stop := now.UTC()
+	ti.Stop = &stop
+	return ti
+}
+
+// Returns the time tracked on id, including the running timer
+func (tl *Tasklist) TrackedTime(id string) (d time.Duration, err error) {
+	defer catchError(&err)
+	for _, ti := range tl.queryIntervals("timelog.id = ?", id) {
+		d += ti.Duration()
+	}
+	return d, nil
+}
+
+type TimeReportLine struct {
+	Name     string
+	Title    string
+	Duration time.Duration
+}
+
+func (trl *TimeReportLine) DurationString() string {
+	return FormatColumnDuration(trl.Duration.Seconds())
+}
+
+type TimeReport struct {
+	Entries []*TimeReportLine
+	Tags    []*TimeReportLine
+	Total   TimeReportLine
+}
+
+func sortedReportLines(m map[string]*TimeReportLine) []*TimeReportLine {
+	r := []*TimeReportLine{}
+	for _, line := range m {
+		r = append(r, line)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Duration == r[j].Duration {
+			return r[i].Name < r[j].Name
+		}
+		return r[i].Duration > r[j].Duration
+	})
+	return r
+}
+
+// Sums the time tracked between from and to (either can be nil) on the entries matching queryText, by entry and by tag
+func (tl *Tasklist) TimeReport(queryText string, from, to *time.Time) (r *TimeReport, err error) {
+	defer catchError(&err)
+
+	// done entries are usually the ones with the most time tracked
+	theselect, code, _, _, _, _, _, _, perr := tl.ParseSearch("#:w/done "+queryText, nil)
+	Must(perr)
+	entries, rerr := tl.Retrieve(theselect, code, false, nil)
+	Must(rerr)
+
+	byId := map[string]*Entry{}
+	for _, entry := range entries {
+		byId[entry.Id()] = entry
+	}
+
+	where, v := "1", []interface{}{}
+	if from != nil {
+		where += " AND (timelog.stopped_at = '' OR timelog.stopped_at > ?)"
+		v = append(v, formatTimelog(*from))
+	}
+	if to != nil {
+		where += " AND timelog.started_at < ?"
+		v = append(v, formatTimelog(*to))
+	}
+
+	perEntry := map[string]*TimeReportLine{}
+	perTag := map[string]*TimeReportLine{}
+	r = &TimeReport{Total: TimeReportLine{Name: "total"}}
+
+	for _, ti := range tl.queryIntervals(where, v...) {
+		entry, ok := byId[ti.Id]
+		if !ok {
+			continue
+		}
+
+		if from != nil && ti.Start.Before(*from) {
+			ti.Start = *from
+		}
+		if to != nil && (ti.Stop == nil && to.Before(time.Now()) || ti.Stop != nil && to.Before(*ti.Stop)) {
+			stop := *to
+			ti.Stop = &stop
+		}
+		d := ti.Duration()
+		if d <= 0 {
+			continue
+		}
+
+		if perEntry[ti.Id] == nil {
+			perEntry[ti.Id] = &TimeReportLine{Name: ti.Id, Title: entry.Title()}
+		}
+		perEntry[ti.Id].Duration += d
+
+		for tag, value := range entry.Columns() {
+			if value != "" {
+				continue
+			}
+			if perTag[tag] == nil {
+				perTag[tag] = &TimeReportLine{Name: tag}
+			}
+			perTag[tag].Duration += d
+		}
+
+		r.Total.Duration += d
+	}
+
+	r.Entries = sortedReportLines(perEntry)
+	r.Tags = sortedReportLines(perTag)
+	return r, nil
+}
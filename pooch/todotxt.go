@@ -0,0 +1,358 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ Entries are written to todo.txt files one per line:
+
+	x 2013-03-10		done, with the date of done-at
+	(A) (B) (C) (D)		sticky, now, later, notes
+	2013-03-01		creation date
+	+tag			tags, @context is also read as a tag
+	key:value		columns whose name and value are a single word
+	due:2013-03-12 at:10:00	time of timed entries
+	id:abc			id of the entry
+	\word			a word of the title that would be read as one
+				of the above (\+1, \10:30)
+
+ When a file is imported lines with an id update the entry with that id,
+ the other lines are added as new entries. The text of the entries and the
+ columns that can't be written in todo.txt are left as they are. Every line
+ is checked before the tasklist is changed and the entries are written in a
+ single transaction.
+*/
+
+var todoTxtPriorities = map[Priority]string{STICKY: "A", NOW: "B", LATER: "C", NOTES: "D"}
+
+// keys with a special meaning, columns with these names aren't exported
+var todoTxtKeys = map[string]bool{"due": true, "at": true, "id": true}
+
+// Returns true if the column can be written in a todo.txt line
+func todoTxtExportable(name, value string) bool {
+	switch {
+	case name == "uncat" || name == "done-at" || todoTxtKeys[name]:
+		return false
+	case strings.ContainsAny(name, ":/") || strings.IndexFunc(name, isTodoTxtSpace) >= 0:
+		return false
+	case strings.IndexFunc(value, isTodoTxtSpace) >= 0:
+		return false
+	}
+	return true
+}
+
+func isTodoTxtSpace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+func todoTxtLine(e *Entry, timezone *time.Location) string {
+	words := []string{}
+
+	if e.Priority() == DONE {
+		words = append(words, "x")
+		if doneDate := todoTxtDoneDate(e, timezone); doneDate != "" {
+			words = append(words, doneDate)
+		}
+	} else if letter, ok := todoTxtPriorities[e.Priority()]; ok {
+		words = append(words, "("+letter+")")
+	}
+
+	if e.CreatedAt() != nil {
+		words = append(words, e.CreatedAt().In(timezone).Format("2006-01-02"))
+	}
+
+	for i, word := range strings.Fields(e.Title()) {
+		words = append(words, todoTxtTitleWord(word, i == 0))
+	}
+
+	names := []string{}
+	for name, value := range e.Columns() {
+		if todoTxtExportable(name, value) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if e.Column(name) == "" {
+			words = append(words, "+"+name)
+		}
+	}
+	for _, name := range names {
+		if value := e.Column(name); value != "" {
+			words = append(words, name+":"+value)
+		}
+	}
+
+	if e.TriggerAt() != nil {
+		local := e.TriggerAt().In(timezone)
+		words = append(words, "due:"+local.Format("2006-01-02"))
+		if local.Format("15:04:05") != "00:00:00" {
+			words = append(words, "at:"+local.Format("15:04"))
+		}
+	}
+
+	words = append(words, "id:"+e.Id())
+
+	return strings.Join(words, " ")
+}
+
+// Writes the entries matching queryText as a todo.txt file
+func (tl *Tasklist) TodoTxtExport(w io.Writer, queryText string) (err error) {
+	defer catchError(&err)
+
+	theselect, code, _, _, _, _, _, sortCols, perr := tl.ParseSearch(queryText, nil)
+	Must(perr)
+	entries, rerr := tl.Retrieve(theselect, code, false, sortCols)
+	Must(rerr)
+
+	timezone := tl.GetTimezone()
+	for _, e := range entries {
+		_, err := io.WriteString(w, todoTxtLine(e, timezone)+"\n")
+		Must(err)
+	}
+	return nil
+}
+
+func isTodoTxtDate(word string) bool {
+	_, err := time.Parse("2006-01-02", word)
+	return err == nil
+}
+
+func isTodoTxtPriority(word string) bool {
+	return len(word) == 3 && word[0] == '(' && word[2] == ')' && word[1] >= 'A' && word[1] <= 'Z'
+}
+
+func isTodoTxtTag(word string) bool {
+	return len(word) > 1 && (word[0] == '+' || word[0] == '@')
+}
+
+// Splits a key:value word, returns nil if word isn't one
+func todoTxtKeyValue(word string) []string {
+	if kv := strings.SplitN(word, ":", 2); len(kv) == 2 && kv[0] != "" && kv[1] != "" && !strings.HasPrefix(kv[1], "//") {
+		return kv
+	}
+	return nil
+}
+
+// Escapes a word of the title that would be read back as something else, first is true for the first word of the title
+func todoTxtTitleWord(word string, first bool) string {
+	switch {
+	case strings.HasPrefix(word, "\\") || isTodoTxtTag(word) || todoTxtKeyValue(word) != nil:
+		return "\\" + word
+	case first && (word == "x" || isTodoTxtPriority(word) || isTodoTxtDate(word)):
+		return "\\" + word
+	}
+	return word
+}
+
+// Parses a line of a todo.txt file, the id of the returned entry is empty if the line doesn't have one
+func parseTodoTxtLine(line string, timezone *time.Location) (*Entry, error) {
+	words := strings.Fields(line)
+
+	priority := Priority(-1)
+	cols := Columns{}
+	var createdAt *time.Time
+
+	if len(words) > 0 && words[0] == "x" {
+		priority = DONE
+		words = words[1:]
+		if len(words) > 0 && isTodoTxtDate(words[0]) {
+			doneAt, _ := time.ParseInLocation("2006-01-02", words[0], timezone)
+			cols["done-at"] = doneAt.UTC().Format("2006-01-02_15:04:05")
+			words = words[1:]
+		}
+	} else if len(words) > 0 && isTodoTxtPriority(words[0]) {
+		priority = LATER
+		for p, letter := range todoTxtPriorities {
+			if letter == words[0][1:2] {
+				priority = p
+			}
+		}
+		words = words[1:]
+	}
+
+	if len(words) > 0 && isTodoTxtDate(words[0]) {
+		t, _ := time.ParseInLocation("2006-01-02", words[0], timezone)
+		t = t.UTC()
+		createdAt = &t
+		words = words[1:]
+	}
+
+	id, due, at := "", "", ""
+	title := []string{}
+	for _, word := range words {
+		if strings.HasPrefix(word, "\\") {
+			title = append(title, word[1:])
+			continue
+		}
+		if isTodoTxtTag(word) {
+			cols[word[1:]] = ""
+			continue
+		}
+		if kv := todoTxtKeyValue(word); kv != nil {
+			switch kv[0] {
+			case "id":
+				id = kv[1]
+			case "due":
+				due = kv[1]
+			case "at":
+				at = kv[1]
+			default:
+				cols[kv[0]] = kv[1]
+			}
+			continue
+		}
+		title = append(title, word)
+	}
+
+	var triggerAt *time.Time
+	if due != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", due+" 00:00", timezone)
+		if at != "" {
+			t, err = time.ParseInLocation("2006-01-02 15:04", due+" "+at, timezone)
+		}
+		if err != nil {
+			return nil, MakeParseError(fmt.Sprintf("Wrong due date in todo.txt line: %s", line))
+		}
+		t = t.UTC()
+		triggerAt = &t
+	}
+
+	switch {
+	case priority >= 0:
+	case triggerAt != nil:
+		priority = TIMED
+	default:
+		priority = NOW
+	}
+
+	e := MakeEntry(id, strings.Join(title, " "), "", priority, triggerAt, "", cols)
+	e.SetCreatedAt(createdAt)
+	return e, nil
+}
+
+/*
+ Imports a todo.txt file, returns the number of entries that were added and
+ the number of entries that were updated
+*/
+func (tl *Tasklist) TodoTxtImport(r io.Reader) (added, updated int, err error) {
+	defer catchError(&err)
+
+	timezone := tl.GetTimezone()
+	defaultWithTime := tl.GetSetting("defaultsorttime") == "1"
+
+	entries := []*Entry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		e, err := parseTodoTxtLine(scanner.Text(), timezone)
+		Must(err)
+		entries = append(entries, e)
+	}
+	Must(scanner.Err())
+
+	// every line is checked before the tasklist is changed
+	adds, updates := []*Entry{}, []*Entry{}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if e.Id() != "" {
+			if seen[e.Id()] {
+				panic(MakeParseError(fmt.Sprintf("Id %s appears twice in the todo.txt file", e.Id())))
+			}
+			seen[e.Id()] = true
+		}
+
+		setUncat(e.Columns())
+
+		if e.Id() == "" || !tl.Exists(e.Id()) {
+			e.SetSort(SortFromTriggerAt(e.TriggerAt(), defaultWithTime))
+			setTodoTxtDoneAt(e)
+			checkRecurrence(e, timezone)
+			tl.checkColumnTypes(e)
+			adds = append(adds, e)
+			continue
+		}
+
+		old := tl.get(e.Id())
+		e.SetText(old.Text())
+		e.SetCreatedAt(old.CreatedAt())
+		for k, v := range old.Columns() {
+			if !todoTxtExportable(k, v) && k != "uncat" && k != "done-at" {
+				e.SetColumn(k, v)
+			}
+		}
+		if doneDate := todoTxtDoneDate(e, timezone); e.Priority() == DONE && (doneDate == "" || doneDate == todoTxtDoneDate(old, timezone)) {
+			// the file only has the date
+			if oldDoneAt, ok := old.ColumnOk("done-at"); ok {
+				e.SetColumn("done-at", oldDoneAt)
+			}
+		}
+		setTodoTxtDoneAt(e)
+		e.SetSort(old.Sort())
+		if !sameTriggerAt(old.TriggerAt(), e.TriggerAt()) {
+			e.SetSort(SortFromTriggerAt(e.TriggerAt(), defaultWithTime))
+		}
+
+		if todoTxtLine(old, timezone) == todoTxtLine(e, timezone) {
+			continue
+		}
+
+		checkRecurrence(e, timezone)
+		tl.checkColumnTypes(e)
+		updates = append(updates, e)
+	}
+
+	completed := map[*Entry]bool{}
+	tl.WithTransaction(func() {
+		for _, e := range adds {
+			if e.Id() == "" {
+				e.SetId(tl.MakeRandomId())
+			}
+			tl.insert(e)
+		}
+		for _, e := range updates {
+			completed[e] = tl.rewrite(e, false, "update")
+		}
+	})
+
+	for _, e := range append(adds, updates...) {
+		tl.afterUpdate(e, completed[e])
+	}
+
+	return len(adds), len(updates), nil
+}
+
+// Entries marked done without a completion date are done now
+func setTodoTxtDoneAt(e *Entry) {
+	if _, ok := e.ColumnOk("done-at"); !ok && e.Priority() == DONE {
+		e.SetColumn("done-at", time.Now().UTC().Format("2006-01-02_15:04:05"))
+	}
+}
+
+// Date of done-at in timezone, empty if the entry doesn't have one
+func todoTxtDoneDate(e *Entry, timezone *time.Location) string {
+	if t, err := time.Parse("2006-01-02_15:04:05", e.Column("done-at")); err == nil {
+		return t.In(timezone).Format("2006-01-02")
+	}
+	return ""
+}
+
+func sameTriggerAt(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -206,7 +206,7 @@ func (t *Tokenizer) RealNext() string {
 		}
 	}
 
-	panic("Can not tokenize string")
+	panic(MakeParseError("Can not tokenize string"))
 
 	return ""
 }
@@ -0,0 +1,190 @@
+/*
+ This program is distributed under the terms of GPLv3
+ Copyright 2010 - 2013, Alessandro Arzilli
+*/
+
+package pooch
+
+import (
+	"strconv"
+	"time"
+)
+
+/*
+ Removed entries are not deleted, instead trashed_at is set to the time of
+ removal and they are excluded from every search that doesn't specify
+ #:w/trash. Entries stay in the trash for the number of days specified by
+ the trashretention setting, after which they are purged.
+*/
+
+type TrashEntry struct {
+	Entry     *Entry
+	TrashedAt time.Time
+}
+
+func (te *TrashEntry) TimeString() string {
+	return te.TrashedAt.Format("2006-01-02 15:04:05")
+}
+
+func (tl *Tasklist) getChildrenEx(id string, trashed bool) []string {
+	q := "SELECT id FROM columns WHERE name = ? AND id IN (SELECT id FROM tasks WHERE trashed_at = 0) ORDER BY cast(value as int) ASC"
+	if trashed {
+		q = "SELECT id FROM columns WHERE name = ? AND id IN (SELECT id FROM tasks WHERE trashed_at <> 0) ORDER BY cast(value as int) ASC"
+	}
+	stmt, serr := tl.conn.Prepare(q)
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec("sub/" + id))
+
+	r := []string{}
+	for stmt.Next() {
+		var x string
+		Must(stmt.Scan(&x))
+		r = append(r, x)
+	}
+	return r
+}
+
+func (tl *Tasklist) IsTrashed(id string) (trashed bool, err error) {
+	defer catchError(&err)
+	return tl.isTrashed(id), nil
+}
+
+func (tl *Tasklist) isTrashed(id string) bool {
+	stmt, err := tl.conn.Prepare("SELECT id FROM tasks WHERE id = ? AND trashed_at <> 0")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+	return stmt.Next()
+}
+
+// Moves id and all its subitems to the trash
+func (tl *Tasklist) trash(id string, timestamp int64) {
+	for _, child := range tl.getChildrenEx(id, false) {
+		tl.trash(child, timestamp)
+	}
+	tl.saveRevision(id, "remove")
+	tl.MustExec("UPDATE tasks SET trashed_at = ? WHERE id = ?", timestamp, id)
+	tl.unblock(tl.laterDependents(id))
+}
+
+// Takes id and the subitems that were trashed with it out of the trash
+func (tl *Tasklist) Restore(id string) (err error) {
+	defer catchError(&err)
+	if !tl.isTrashed(id) {
+		panic(MakeNotFoundError("Couldn't find %s in the trash", id))
+	}
+	tl.WithTransaction(func() {
+		tl.restore(id, tl.trashedAt(id))
+	})
+	return nil
+}
+
+// Subitems trashed separately, before their parent, have a different timestamp and stay in the trash
+func (tl *Tasklist) restore(id string, timestamp int64) {
+	for _, child := range tl.getChildrenEx(id, true) {
+		if tl.trashedAt(child) == timestamp {
+			tl.restore(child, timestamp)
+		}
+	}
+	tl.MustExec("UPDATE tasks SET trashed_at = 0 WHERE id = ?", id)
+}
+
+func (tl *Tasklist) trashedAt(id string) int64 {
+	stmt, err := tl.conn.Prepare("SELECT trashed_at FROM tasks WHERE id = ?")
+	Must(err)
+	defer stmt.Finalize()
+	Must(stmt.Exec(id))
+
+	var r int64
+	if stmt.Next() {
+		Must(stmt.Scan(&r))
+	}
+	return r
+}
+
+// Deletes id for good, without going through the trash
+func (tl *Tasklist) Purge(id string) (err error) {
+	defer catchError(&err)
+	tl.WithTransaction(func() {
+		tl.purge(id)
+	})
+	return nil
+}
+
+func (tl *Tasklist) purge(id string) {
+	dependents := tl.laterDependents(id)
+	tl.MustExec("DELETE FROM columns WHERE id = ?", id)
+	tl.MustExec("DELETE FROM tasks WHERE id = ?", id)
+	tl.MustExec("DELETE FROM reminders WHERE id = ?", id)
+	tl.MustExec("DELETE FROM attachments WHERE id = ?", id)
+	tl.MustExec("DELETE FROM links WHERE id = ? OR target = ?", id, id)
+	tl.MustExec("DELETE FROM timelog WHERE id = ?", id)
+	tl.unblock(dependents)
+}
+
+func (tl *Tasklist) GetTrash() (r []*TrashEntry, err error) {
+	defer catchError(&err)
+	return tl.getTrash(), nil
+}
+
+func (tl *Tasklist) getTrash() []*TrashEntry {
+	stmt, serr := tl.conn.Prepare("SELECT tasks.id, title_field, text_field, priority, trigger_at_field, sort, group_concat(columns.name||'\u001f'||columns.value, '\u001f'), trashed_at\nFROM tasks NATURAL JOIN columns WHERE trashed_at <> 0 GROUP BY tasks.id ORDER BY trashed_at DESC")
+	Must(serr)
+	defer stmt.Finalize()
+	Must(stmt.Exec())
+
+	r := []*TrashEntry{}
+	for stmt.Next() {
+		var priority_num int
+		var trashedAt int64
+		var id, title, text, trigger_str, sort, columns string
+		Must(stmt.Scan(&id, &title, &text, &priority_num, &trigger_str, &sort, &columns, &trashedAt))
+		triggerAt, _ := ParseDateTime(trigger_str, time.UTC)
+		entry := MakeEntry(id, title, text, Priority(priority_num), triggerAt, sort, ParseColumnsString(columns))
+		r = append(r, &TrashEntry{entry, time.Unix(trashedAt, 0)})
+	}
+
+	return r
+}
+
+// Number of days an entry is kept in the trash, 0 means forever
+func (tl *Tasklist) trashRetention() int {
+	r, _ := strconv.Atoi(tl.GetSetting("trashretention"))
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+func (tl *Tasklist) purgeTrash() {
+	days := tl.trashRetention()
+	if days == 0 {
+		return
+	}
+
+	limit := time.Now().Unix() - int64(days)*24*60*60
+
+	stmt, serr := tl.conn.Prepare("SELECT id FROM tasks WHERE trashed_at <> 0 AND trashed_at < ?")
+	Must(serr)
+	Must(stmt.Exec(limit))
+	ids := []string{}
+	for stmt.Next() {
+		var id string
+		Must(stmt.Scan(&id))
+		ids = append(ids, id)
+	}
+	stmt.Finalize()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	Logf(INFO, "Purging %d entries from the trash of %s\n", len(ids), tl.filename)
+
+	tl.WithTransaction(func() {
+		for _, id := range ids {
+			tl.purge(id)
+		}
+	})
+}
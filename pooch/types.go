@@ -12,7 +12,6 @@ import (
 	"hash/crc32"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -29,6 +28,10 @@ func (e *ParseError) Error() string {
 	return e.error
 }
 
+func (e *ParseError) Is(target error) bool {
+	return target == ErrParse
+}
+
 func MakeParseError(error string) error {
 	return &ParseError{error}
 }
@@ -71,23 +74,6 @@ func (p *Priority) ToInteger() int {
 	return int(*p)
 }
 
-func FrequencyToString(freq int) string {
-	switch freq {
-	case 1:
-		return "daily"
-	case 7:
-		return "weekly"
-	case 14:
-		return "biweekly"
-	case 30:
-		return "monthly"
-	case 365:
-		return "yearly"
-	}
-
-	return fmt.Sprintf("%d", int64(freq))
-}
-
 type UnmarshalEntry struct {
 	Id        string
 	Title     string
@@ -95,6 +81,7 @@ type UnmarshalEntry struct {
 	Priority  Priority
 	TriggerAt string
 	Sort      string
+	Snippet   string `json:",omitempty"`
 }
 
 type Columns map[string]string
@@ -107,6 +94,9 @@ type Entry struct {
 	triggerAt *time.Time
 	sort      string
 	columns   Columns
+
+	createdAt  *time.Time
+	modifiedAt *time.Time
 }
 
 type ErrorEntry struct {
@@ -124,7 +114,7 @@ func Must(err error) {
 	}
 }
 
-func MarshalEntry(entry *Entry, timezone int, addCols bool) *UnmarshalEntry {
+func MarshalEntry(entry *Entry, timezone *time.Location, addCols bool) *UnmarshalEntry {
 	triggerAtString := entry.TriggerAtString(timezone)
 
 	text := entry.Text()
@@ -139,10 +129,11 @@ func MarshalEntry(entry *Entry, timezone int, addCols bool) *UnmarshalEntry {
 		text,
 		entry.Priority(),
 		triggerAtString,
-		entry.Sort()}
+		entry.Sort(),
+		""}
 }
 
-func DemarshalEntry(umentry *UnmarshalEntry, timezone int) *Entry {
+func DemarshalEntry(umentry *UnmarshalEntry, timezone *time.Location) *Entry {
 	triggerAt, _ := ParseDateTime(umentry.TriggerAt, timezone)
 
 	sort := umentry.Sort
@@ -174,7 +165,7 @@ func DemarshalEntry(umentry *UnmarshalEntry, timezone int) *Entry {
 }
 
 func MakeEntry(id string, title string, text string, priority Priority, triggerAt *time.Time, sort string, columns Columns) *Entry {
-	return &Entry{id, title, text, priority, triggerAt, sort, columns}
+	return &Entry{id, title, text, priority, triggerAt, sort, columns, nil, nil}
 }
 
 func (e *Entry) Title() string                                { return e.title }
@@ -189,13 +180,34 @@ func (e *Entry) TriggerAt() *time.Time                        { return e.trigger
 func (e *Entry) SetTriggerAt(tat *time.Time)                  { e.triggerAt = tat }
 func (e *Entry) SetSort(sort string)                          { e.sort = sort }
 func (e *Entry) Sort() string                                 { return e.sort }
+func (e *Entry) CreatedAt() *time.Time                        { return e.createdAt }
+func (e *Entry) SetCreatedAt(t *time.Time)                    { e.createdAt = t }
+func (e *Entry) ModifiedAt() *time.Time                       { return e.modifiedAt }
+func (e *Entry) SetModifiedAt(t *time.Time)                   { e.modifiedAt = t }
 func (e *Entry) Columns() Columns                             { return e.columns }
 func (e *Entry) ColumnOk(name string) (value string, ok bool) { value, ok = e.columns[name]; return }
 func (e *Entry) Column(name string) string                    { return e.columns[name] }
 func (e *Entry) SetColumn(name, value string) *Entry          { e.columns[name] = value; return e }
 func (e *Entry) RemoveColumn(name string) *Entry              { delete(e.columns, name); return e }
 
-func (e *Entry) SetColumns(cols Columns, tz int) *Entry {
+// Value used to sort by key, created and modified refer to the timestamps of the entry, anything else is a column
+func (e *Entry) SortKey(key string) string {
+	var t *time.Time
+	switch key {
+	case "created":
+		t = e.CreatedAt()
+	case "modified":
+		t = e.ModifiedAt()
+	default:
+		return e.columns[key]
+	}
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func (e *Entry) SetColumns(cols Columns, tz *time.Location) *Entry {
 	e.columns = cols
 	if v, ok := e.columns[":when"]; ok {
 		if t, err := ParseDateTime(v, tz); err == nil {
@@ -226,57 +238,21 @@ func (e *Entry) MergeColumns(cols Columns) *Entry {
 	return e
 }
 
-func ParseFrequency(freq string) int {
-	switch freq {
-	case "daily":
-		return 1
-	case "weekly":
-		return 7
-	case "biweekly":
-		return 14
-	case "monthly":
-		return 30
-	case "yearly":
-		return 365
-	}
-	v, _ := strconv.Atoi(freq)
-	return v
-}
-
-func (e *Entry) Freq() int {
-	freqStr, ok := e.ColumnOk("freq")
-	if !ok {
-		return -1
-	}
-	freq := ParseFrequency(freqStr)
-	if freq > 0 {
-		return freq
-	}
-	return -1
-}
-
 /*
- * Rules for timezones: add timezone to convert to local time
- * subtract timezone to convert to utc
+ * Times are stored in UTC and converted to the timezone of the tasklist
+ * when they are parsed or displayed
  */
 
-func (entry *Entry) TriggerAtString(timezone int) string {
+func (entry *Entry) TriggerAtString(timezone *time.Location) string {
 	triggerAt := entry.TriggerAt()
 	triggerAtString := ""
 	if triggerAt != nil {
-		z := time.Unix(triggerAt.Unix()+(int64(timezone)*60*60), 0).In(time.FixedZone("fixed-zone", timezone*60))
-		triggerAtString = z.Format(TRIGGER_AT_FORMAT)
+		triggerAtString = triggerAt.In(timezone).Format(TRIGGER_AT_FORMAT)
 	}
 
 	return triggerAtString
 }
 
-func (entry *Entry) NextEntry(newId string) *Entry {
-	newTriggerAt := time.Unix(entry.TriggerAt().Unix()+int64(entry.Freq()*24*60*60), 0)
-
-	return MakeEntry(newId, entry.Title(), entry.Text(), entry.Priority(), &newTriggerAt, entry.Sort(), entry.Columns())
-}
-
 func (e *Entry) Before(time int64) bool {
 	return e.triggerAt.Unix() < time
 }
@@ -461,6 +437,12 @@ func (entry *Entry) Print() {
 		w.WriteString("When:\tN/A\n")
 	}
 	w.WriteString(fmt.Sprintf("Sort:\t%s\n", entry.Sort()))
+	if entry.CreatedAt() != nil {
+		w.WriteString(fmt.Sprintf("Created:\t%s\n", entry.CreatedAt()))
+	}
+	if entry.ModifiedAt() != nil {
+		w.WriteString(fmt.Sprintf("Modified:\t%s\n", entry.ModifiedAt()))
+	}
 	for k, v := range entry.Columns() {
 		pv := v
 		if v == "" {
@@ -522,11 +504,12 @@ func (e *Entry) CatString(catordering map[string]int) string {
 	return "#" + strings.Join(r, "#")
 }
 
-func TimeString(triggerAt *time.Time, sort string, timezone int) string {
+func TimeString(triggerAt *time.Time, sort string, timezone *time.Location) string {
 	if triggerAt != nil {
-		now := time.Now().UTC()
-		showYear := (triggerAt.Format("2006") != now.Format("2006"))
-		showTime := (triggerAt.Format("15:04") != "00:00")
+		now := time.Now().In(timezone)
+		local := triggerAt.In(timezone)
+		showYear := (local.Format("2006") != now.Format("2006"))
+		showTime := (local.Format("15:04") != "00:00")
 
 		var formatString string
 		if showYear {
@@ -552,6 +535,7 @@ type ListJsonAnswer struct {
 	ParseError    error
 	RetrieveError error
 	Results       []UnmarshalEntry
+	Aggregates    *Aggregates `json:",omitempty"`
 }
 
 type OntologyNodeOut struct {
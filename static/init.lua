@@ -15,20 +15,26 @@ end
 --    repeat_weekdays({ [0] = true, [1] = true })
 -- makes the entry repeat on sunday and monday only
 --
+weekday_names = { [0] = "sun", "mon", "tue", "wed", "thu", "fri", "sat" }
+
 function repeat_weekdays(weekdays)
    next_when = when()
    if next_when <= 0 then
       return false
    end
 
-   while true do
-      next_when = next_when + (60 * 60 * 24)
-      weekday = localtime(next_when).weekday
+   rule = "weekly on"
+   for weekday = 0, 6 do
       if memberof(weekdays, weekday) then
-	 break
+	 rule = rule .. " " .. weekday_names[weekday]
       end
    end
 
+   next_when = nextoccurrence(rule, next_when)
+   if next_when <= 0 then
+      return false
+   end
+
    persist()
    clonecursor()
    when(next_when)
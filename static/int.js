@@ -320,6 +320,23 @@ function save_editor_by_id(name, event) {
     save_editor($("#ediv_"+quoteName(name)).get(0));
 }
 
+function undo_last_change(name) {
+    $.ajax({ url: "/history?id=" + encodeURIComponent(name), success: function(data, textStatus, req) {
+        var revs = $.parseJSON(data);
+        if (revs.length == 0) {
+            $("#ts_"+quoteName(name)).html("Nothing to undo");
+            return;
+        }
+        $.ajax({ url: "/revert?id=" + encodeURIComponent(name) + "&rev=" + revs[0].Rev, success: function(data, textStatus, req) {
+            if (data.match(/^reverted/)) {
+                fill_editor(name, function() { });
+            } else {
+                $("#ts_"+quoteName(name)).html("Undo failed: " + data);
+            }
+        }});
+    }});
+}
+
 function explode_body(name) {
     save_open_editor(true);
     $.ajax({ type: "GET", url: "/explode?id=" + encodeURIComponent(name),  success: function(data, textStatus, req) {